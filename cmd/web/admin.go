@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+maxPDFSize is the maximal size of uploaded PDFs. The UKSH PDFs are about 100kB
+*/
+const maxPDFSize = 10 << 20
+
+/*
+adminPlan, summarizes a cached WeekPlan for the admin api
+*/
+type adminPlan struct {
+	Week      string    `json:"week"`
+	Source    string    `json:"source"`
+	Hash      string    `json:"hash"`
+	Published time.Time `json:"published"`
+	Updated   time.Time `json:"updated"`
+	Days      []string  `json:"days"`
+	Dishes    int       `json:"dishes"`
+	Warnings  []string  `json:"warnings"`
+}
+
+func newAdminPlan(p *WeekPlan) *adminPlan {
+	days := make([]string, 0, 7)
+	for _, day := range groupByDay(p.Dishes) {
+		days = append(days, day.Date.Format("2006-01-02"))
+	}
+	warnings := p.Warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return &adminPlan{
+		Week:      formatISOWeek(p.Year, p.Week),
+		Source:    p.Source,
+		Hash:      p.Hash,
+		Published: p.Published,
+		Updated:   p.Updated,
+		Days:      days,
+		Dishes:    len(p.Dishes),
+		Warnings:  warnings,
+	}
+}
+
+/*
+adminPlanUpdate, is a PlanUpdate found by a refresh triggered via the admin api
+*/
+type adminPlanUpdate struct {
+	Plan        *adminPlan `json:"plan"`
+	Changed     bool       `json:"changed"`
+	ChangedDays []string   `json:"changedDays"`
+}
+
+/*
+adminRefreshResult, is the response to a refresh triggered via the admin api
+*/
+type adminRefreshResult struct {
+	Start      time.Time          `json:"start"`
+	DurationMs int64              `json:"durationMs"`
+	Error      string             `json:"error,omitempty"`
+	Updates    []*adminPlanUpdate `json:"updates"`
+}
+
+/*
+readPDF, reads a PDF of at most maxSize bytes passed either as "pdf" field of a multipart form or as raw request
+body
+*/
+func readPDF(w http.ResponseWriter, r *http.Request, maxSize int64) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	var pdf []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("pdf")
+		if err != nil {
+			return nil, fmt.Errorf("readPDF: %w: %v", badRequestError, err)
+		}
+		defer file.Close()
+		if pdf, err = ioutil.ReadAll(file); err != nil {
+			return nil, fmt.Errorf("readPDF: %w: %v", badRequestError, err)
+		}
+	} else {
+		var err error
+		if pdf, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, fmt.Errorf("readPDF: %w: %v", badRequestError, err)
+		}
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		return nil, fmt.Errorf("readPDF: %w: body is not a pdf", badRequestError)
+	}
+	return pdf, nil
+}
+
+/*
+adminWebhook, is the representation of a webhook in the listing. The secret is only returned once, when the
+webhook is registered
+*/
+type adminWebhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Static bool   `json:"static"`
+}
+
+/*
+adminListWebhooksHandler returns all registered webhooks without their secrets
+*/
+func (app *application) adminListWebhooksHandler(w http.ResponseWriter, _ *http.Request) {
+	hooks := app.webhooks.List()
+	res := make([]*adminWebhook, 0, len(hooks))
+	for _, h := range hooks {
+		res = append(res, &adminWebhook{ID: h.ID, URL: h.URL, Static: h.Static})
+	}
+	app.writeJSON(w, http.StatusOK, res)
+}
+
+/*
+adminAddWebhookHandler registers the webhook passed as {"url": string, "secret": string} in the body. If secret
+is omitted, a random one is generated and returned in the response
+*/
+func (app *application) adminAddWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("adminAddWebhookHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+	h, err := app.webhooks.Add(req.URL, req.Secret)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, h)
+}
+
+/*
+adminRemoveWebhookHandler unregisters the webhook with the id passed in the url
+*/
+func (app *application) adminRemoveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.webhooks.Remove(r.URL.Query().Get(":id")); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+adminWebhookDeliveriesHandler returns the newest entries of the webhook delivery log. The amount is controlled
+by the limit query parameter
+*/
+func (app *application) adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			app.writeProblem(w, r, fmt.Errorf("adminWebhookDeliveriesHandler: %w: limit must be a positive number", badRequestError))
+			return
+		}
+	}
+	deliveries, err := app.webhooks.Deliveries(limit)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, deliveries)
+}
+
+/*
+adminListSubscribersHandler returns all digest subscribers
+*/
+func (app *application) adminListSubscribersHandler(w http.ResponseWriter, _ *http.Request) {
+	app.writeJSON(w, http.StatusOK, app.subscribers.List())
+}
+
+/*
+adminAddSubscriberHandler subscribes the address passed as {"email": string, "vegetarianOnly": bool} in the body
+to the weekly digest
+*/
+func (app *application) adminAddSubscriberHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email          string `json:"email"`
+		VegetarianOnly bool   `json:"vegetarianOnly"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("adminAddSubscriberHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+	sub, err := app.subscribers.Add(req.Email, req.VegetarianOnly)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, sub)
+}
+
+/*
+adminRemoveSubscriberHandler unsubscribes the subscriber with the id passed in the url
+*/
+func (app *application) adminRemoveSubscriberHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.subscribers.Remove(r.URL.Query().Get(":id")); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+adminListAlertsHandler returns all keyword alerts
+*/
+func (app *application) adminListAlertsHandler(w http.ResponseWriter, _ *http.Request) {
+	app.writeJSON(w, http.StatusOK, app.alerts.List())
+}
+
+/*
+adminAddAlertHandler registers the alert passed as {"pattern": string, "email": string} in the body. The pattern is
+a keyword or regular expression, email is optional
+*/
+func (app *application) adminAddAlertHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pattern string `json:"pattern"`
+		Email   string `json:"email"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("adminAddAlertHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+	a, err := app.alerts.Add(req.Pattern, req.Email)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, a)
+}
+
+/*
+adminRemoveAlertHandler unregisters the alert with the id passed in the url
+*/
+func (app *application) adminRemoveAlertHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.alerts.Remove(r.URL.Query().Get(":id")); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+adminListCorrectionsHandler returns all manual corrections
+*/
+func (app *application) adminListCorrectionsHandler(w http.ResponseWriter, _ *http.Request) {
+	app.writeJSON(w, http.StatusOK, app.corrections.List())
+}
+
+/*
+adminSetCorrectionHandler stores the correction passed as {"week": "yyyy-Www", "day": 1-7, "column": number,
+"fields": {"price": string, ...}, "author": string, "comment": string} in the body and applies it to the cache
+*/
+func (app *application) adminSetCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Week    string            `json:"week"`
+		Day     int               `json:"day"`
+		Column  int               `json:"column"`
+		Fields  map[string]string `json:"fields"`
+		Author  string            `json:"author"`
+		Comment string            `json:"comment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("adminSetCorrectionHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+	c, err := app.corrections.Set(req.Week, req.Day, req.Column, req.Fields, req.Author, req.Comment)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.menuModel.ApplyCorrections()
+	app.writeJSON(w, http.StatusOK, c)
+}
+
+/*
+adminRemoveCorrectionHandler deletes the correction with the id passed in the url. The author may be passed in
+the author query parameter for the audit log
+*/
+func (app *application) adminRemoveCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.corrections.Remove(r.URL.Query().Get(":id"), r.URL.Query().Get("author")); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.menuModel.ApplyCorrections()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+adminCorrectionAuditHandler returns the newest entries of the correction audit log. The amount is controlled by
+the limit query parameter
+*/
+func (app *application) adminCorrectionAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			app.writeProblem(w, r, fmt.Errorf("adminCorrectionAuditHandler: %w: limit must be a positive number", badRequestError))
+			return
+		}
+	}
+	entries, err := app.corrections.Audit(limit)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, entries)
+}
+
+/*
+adminListReportsHandler returns the error reports of users. Pass open=true to omit promoted reports
+*/
+func (app *application) adminListReportsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, app.reports.List(r.URL.Query().Get("open") == "true"))
+}
+
+/*
+adminPromoteReportHandler turns the report with the id passed in the url into a correction. The optional body
+{"value": string, "author": string} overrides the suggestion of the report
+*/
+func (app *application) adminPromoteReportHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Value  string `json:"value"`
+		Author string `json:"author"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		app.writeProblem(w, r, fmt.Errorf("adminPromoteReportHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+	rep, err := app.promoteReport(r.URL.Query().Get(":id"), req.Value, req.Author)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, rep)
+}
+
+/*
+adminRemoveReportHandler deletes the report with the id passed in the url, e.g. to dismiss it
+*/
+func (app *application) adminRemoveReportHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.reports.Remove(r.URL.Query().Get(":id")); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+adminRefreshHandler starts a refresh job, see adminJobHandler, whose result contains the duration, error and the
+new or changed plans of the refresh. If a refresh job is running, that job is returned
+*/
+func (app *application) adminRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := app.startJob("refresh", true, func(context.Context) (interface{}, error) {
+		start := time.Now()
+		updates, err := app.menuModel.RefreshWithUpdates()
+		res := &adminRefreshResult{
+			Start:      start,
+			DurationMs: time.Since(start).Milliseconds(),
+			Updates:    make([]*adminPlanUpdate, 0, len(updates)),
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		for _, u := range updates {
+			days := make([]string, 0, len(u.ChangedDays))
+			for _, d := range u.ChangedDays {
+				days = append(days, d.Format("2006-01-02"))
+			}
+			res.Updates = append(res.Updates, &adminPlanUpdate{Plan: newAdminPlan(u.Plan), Changed: u.Changed, ChangedDays: days})
+		}
+		return res, nil
+	})
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJobStarted(w, j, "/admin/jobs/"+j.ID)
+}
+
+/*
+adminJobHandler returns the refresh or upload job with the id passed in the url
+*/
+func (app *application) adminJobHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJob(w, r, "refresh", "upload")
+}
+
+/*
+adminListCacheHandler returns all cached weeks with their source and parse warnings
+*/
+func (app *application) adminListCacheHandler(w http.ResponseWriter, _ *http.Request) {
+	plans := app.menuModel.CachedWeeks()
+	res := make([]*adminPlan, 0, len(plans))
+	for _, p := range plans {
+		res = append(res, newAdminPlan(p))
+	}
+	app.writeJSON(w, http.StatusOK, res)
+}
+
+/*
+adminUploadPDFHandler starts a job, see adminJobHandler, that parses the PDF passed in the body, see readPDF, and
+caches its week. The result of the job is the cached plan
+*/
+func (app *application) adminUploadPDFHandler(w http.ResponseWriter, r *http.Request) {
+	pdf, err := readPDF(w, r, maxPDFSize)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	j, err := app.startJob("upload", false, func(ctx context.Context) (interface{}, error) {
+		plan, err := app.menuModel.AddPDF(ctx, pdf)
+		if err != nil {
+			//the layout of an uploaded pdf is the fault of the client, not of the UKSH website
+			if errors.Is(err, parser.HeaderMissingError) {
+				err = fmt.Errorf("adminUploadPDFHandler: %w: %v", badRequestError, err)
+			}
+			return nil, err
+		}
+		return newAdminPlan(plan), nil
+	})
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJobStarted(w, j, "/admin/jobs/"+j.ID)
+}
+
+/*
+adminEvictWeekHandler removes the week passed in the url from the cache
+*/
+func (app *application) adminEvictWeekHandler(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	if err := app.menuModel.EvictWeek(year, week); err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
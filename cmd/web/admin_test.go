@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	parserMock "github.com/alyrot/uksh-menu-parser/mocks/pkg/parser"
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/golang/mock/gomock"
+)
+
+func TestAdminCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	pdf := []byte("%PDF-1.4 plan")
+	parseMock := parserMock.NewMockUKSHParserI(ctrl)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), pdf).Return([]*parser.Dish{
+		{Title: "Pasta-Pfanne", Price: "€ 4,80 / € 6,00", Kcal: "kcal 528 / kJ 2212", Type: "Wok Station", Date: monday},
+		{Title: "Rumpsteak", Price: "€ 5,90", Type: "Gericht 2", Date: monday.AddDate(0, 0, 1)},
+	}, nil).Times(2)
+
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	app := &application{
+		cfg:      cfg,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+		menuModel: &MenuCache{
+			parse:    parseMock,
+			infoLog:  log.New(ioutil.Discard, "", 0),
+			errorLog: log.New(ioutil.Discard, "", 0),
+		},
+	}
+	srv := app.routes()
+	do := func(method, path, contentType string, body []byte, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		return rec
+	}
+	listCache := func() []*adminPlan {
+		rec := do(http.MethodGet, "/admin/cache", "", nil, "secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+		}
+		plans := make([]*adminPlan, 0)
+		if err := json.Unmarshal(rec.Body.Bytes(), &plans); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		return plans
+	}
+
+	if rec := do(http.MethodPost, "/admin/cache", "application/pdf", pdf, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v without token got %v\n", http.StatusUnauthorized, rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/cache", "application/pdf", []byte("<html>"), "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for non pdf got %v\n", http.StatusBadRequest, rec.Code)
+	}
+
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+	if j := waitForJob(t, srv, do(http.MethodPost, "/admin/cache", "application/pdf", pdf, "secret"), auth); j.Status != jobDone {
+		t.Fatalf("Expected upload to succeed got %+v\n", j.Problem)
+	}
+	plans := listCache()
+	if len(plans) != 1 {
+		t.Fatalf("Expected 1 cached week got %v\n", len(plans))
+	}
+	if p := plans[0]; p.Week != "2020-W47" || p.Source != uploadSource || p.Dishes != 2 || len(p.Days) != 2 {
+		t.Errorf("Unexpected plan %+v\n", p)
+	}
+	if w := plans[0].Warnings; len(w) != 1 || w[0] != "2020-11-17 Gericht 2: no kcal" {
+		t.Errorf("Unexpected warnings %v\n", w)
+	}
+	if _, ok := app.menuModel.CachedMenu(monday); !ok {
+		t.Errorf("Expected uploaded dishes to be cached\n")
+	}
+
+	//multipart upload of the same pdf does not create a new plan
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	part, _ := mw.CreateFormFile("pdf", "plan.pdf")
+	part.Write(pdf)
+	mw.Close()
+	if j := waitForJob(t, srv, do(http.MethodPost, "/admin/cache", mw.FormDataContentType(), body.Bytes(), "secret"), auth); j.Status != jobDone {
+		t.Fatalf("Expected upload to succeed got %+v\n", j.Problem)
+	}
+	if l := len(app.menuModel.PlanUpdates()); l != 1 {
+		t.Errorf("Expected 1 plan update got %v\n", l)
+	}
+
+	if rec := do(http.MethodGet, "/admin/jobs/unknown", "", nil, "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v for unknown job got %v\n", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/admin/cache/2020-W47", "", nil, "secret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %v got %v\n", http.StatusNoContent, rec.Code)
+	}
+	if plans := listCache(); len(plans) != 0 {
+		t.Errorf("Expected empty cache after evict got %v\n", plans)
+	}
+	if rec := do(http.MethodDelete, "/admin/cache/2020-W47", "", nil, "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v for evicted week got %v\n", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+unknownAlertError is returned when an alert id is not registered
+*/
+var unknownAlertError = errors.New("alert not found")
+
+/*
+alertConfirmTimeout, alerts registered by users are removed if they are not confirmed within this time
+*/
+const alertConfirmTimeout = 24 * time.Hour
+
+/*
+maxAlertsPerEmail, limits the alerts users can register for an email address
+*/
+const maxAlertsPerEmail = 10
+
+/*
+Alert, notifies about dishes matching Pattern as soon as a new or changed plan is parsed
+*/
+type Alert struct {
+	ID string `json:"id"`
+	//keyword or regular expression, matched case insensitive against title and description
+	Pattern string `json:"pattern"`
+	//receives the alert via email. Alerts without email are posted to the chat webhook
+	Email string `json:"email,omitempty"`
+	//secret part of the alert management link
+	Token string `json:"token"`
+	//alerts registered by users are only sent after the email address was confirmed
+	Confirmed bool      `json:"confirmed"`
+	Created   time.Time `json:"created"`
+	matcher   *regexp.Regexp
+}
+
+/*
+alertMatch, is a dish matching an Alert
+*/
+type alertMatch struct {
+	Alert *Alert
+	Dish  *parser.Dish
+}
+
+/*
+alertChannel, delivers the alert text for a to its recipients
+*/
+type alertChannel func(a *Alert, text string) error
+
+/*
+AlertNotifier, checks new and changed plans against the registered alerts. Register Notify with
+MenuCache.Subscribe
+*/
+type AlertNotifier struct {
+	lock   sync.Mutex
+	alerts []*Alert
+	path   string
+	//sends the matches of alerts without email, e.g. to the team chat
+	chat alertChannel
+	//sends the matches of alerts with email, nil if SMTP is not configured
+	mail alertChannel
+	//hashes of the checked plans, see NotifyMissed
+	notified *planHashes
+	inFlight sync.WaitGroup
+	errorLog *log.Logger
+	infoLog  *log.Logger
+}
+
+/*
+compileAlertPattern, returns the case insensitive matcher for pattern
+*/
+func compileAlertPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("%w: empty pattern", badRequestError)
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid pattern %q: %v", badRequestError, pattern, err)
+	}
+	return re, nil
+}
+
+/*
+NewAlertNotifier, loads the alerts persisted in dataDir. mail may be nil, then only alerts without email can be
+registered
+*/
+func NewAlertNotifier(dataDir string, chat, mail alertChannel, errorLog, infoLog *log.Logger) (*AlertNotifier, error) {
+	n := &AlertNotifier{
+		alerts:   make([]*Alert, 0),
+		path:     filepath.Join(dataDir, "alerts.json"),
+		chat:     chat,
+		mail:     mail,
+		errorLog: errorLog,
+		infoLog:  infoLog,
+	}
+	if err := loadJSON(n.path, &n.alerts); err != nil {
+		return nil, fmt.Errorf("NewAlertNotifier: %v", err)
+	}
+	for _, a := range n.alerts {
+		var err error
+		if a.matcher, err = compileAlertPattern(a.Pattern); err != nil {
+			return nil, fmt.Errorf("NewAlertNotifier: alert %v: %v", a.ID, err)
+		}
+	}
+	notified, err := loadPlanHashes(filepath.Join(dataDir, "alert-notified.json"))
+	if err != nil {
+		return nil, fmt.Errorf("NewAlertNotifier: %v", err)
+	}
+	n.notified = notified
+	return n, nil
+}
+
+/*
+List, returns copies of all registered alerts
+*/
+func (n *AlertNotifier) List() []*Alert {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	res := make([]*Alert, 0, len(n.alerts))
+	for _, a := range n.alerts {
+		tmp := *a
+		res = append(res, &tmp)
+	}
+	return res
+}
+
+/*
+newAlert, validates pattern and email and creates an alert for them
+*/
+func (n *AlertNotifier) newAlert(pattern, email string, confirmed bool) (*Alert, error) {
+	matcher, err := compileAlertPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if email != "" {
+		if n.mail == nil {
+			return nil, fmt.Errorf("%w: email alerts require smtp", badRequestError)
+		}
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid email address %q", badRequestError, email)
+		}
+		email = addr.Address
+	}
+	id, err := randomID(8)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomID(16)
+	if err != nil {
+		return nil, err
+	}
+	return &Alert{ID: id, Pattern: pattern, Email: email, Token: token, Confirmed: confirmed, Created: time.Now(), matcher: matcher}, nil
+}
+
+/*
+add, persists a. Caller must hold n.lock
+*/
+func (n *AlertNotifier) add(a *Alert) error {
+	n.alerts = append(n.alerts, a)
+	if err := saveJSON(n.path, n.alerts); err != nil {
+		n.alerts = n.alerts[:len(n.alerts)-1]
+		return err
+	}
+	return nil
+}
+
+/*
+Add, registers a confirmed alert for pattern. email is optional, alerts without email are posted to the chat
+*/
+func (n *AlertNotifier) Add(pattern, email string) (*Alert, error) {
+	a, err := n.newAlert(pattern, email, true)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %w", err)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err := n.add(a); err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	tmp := *a
+	return &tmp, nil
+}
+
+/*
+Register, adds an unconfirmed alert for pattern and email on behalf of a user. The alert is only sent after
+ConfirmToken was called with its token, unconfirmed alerts are dropped after alertConfirmTimeout
+*/
+func (n *AlertNotifier) Register(pattern, email string, now time.Time) (*Alert, error) {
+	if strings.TrimSpace(email) == "" {
+		return nil, fmt.Errorf("Register: %w: email is required", badRequestError)
+	}
+	a, err := n.newAlert(pattern, email, false)
+	if err != nil {
+		return nil, fmt.Errorf("Register: %w", err)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	alerts := make([]*Alert, 0, len(n.alerts))
+	count := 0
+	for _, v := range n.alerts {
+		if !v.Confirmed && now.Sub(v.Created) > alertConfirmTimeout {
+			continue
+		}
+		if v.Email == a.Email {
+			count++
+		}
+		alerts = append(alerts, v)
+	}
+	if count >= maxAlertsPerEmail {
+		return nil, fmt.Errorf("Register: %w: at most %v alerts per email address", badRequestError, maxAlertsPerEmail)
+	}
+	n.alerts = alerts
+	if err := n.add(a); err != nil {
+		return nil, fmt.Errorf("Register: %v", err)
+	}
+	tmp := *a
+	return &tmp, nil
+}
+
+/*
+update, applies f to the first alert for which match returns true and persists the result. If f returns true
+the alert is removed instead
+*/
+func (n *AlertNotifier) update(match func(*Alert) bool, f func(*Alert) (remove bool)) (*Alert, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i, a := range n.alerts {
+		if !match(a) {
+			continue
+		}
+		old := make([]*Alert, len(n.alerts))
+		copy(old, n.alerts)
+		updated := *a
+		if f(&updated) {
+			n.alerts = append(n.alerts[:i:i], n.alerts[i+1:]...)
+		} else {
+			n.alerts[i] = &updated
+		}
+		if err := saveJSON(n.path, n.alerts); err != nil {
+			n.alerts = old
+			return nil, err
+		}
+		tmp := updated
+		return &tmp, nil
+	}
+	return nil, unknownAlertError
+}
+
+/*
+Remove, unregisters the alert with id
+*/
+func (n *AlertNotifier) Remove(id string) error {
+	if _, err := n.update(func(a *Alert) bool { return a.ID == id }, func(*Alert) bool { return true }); err != nil {
+		return fmt.Errorf("Remove: %w: %v", err, id)
+	}
+	return nil
+}
+
+/*
+ByToken, returns the alert with the management token
+*/
+func (n *AlertNotifier) ByToken(token string) (*Alert, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, a := range n.alerts {
+		if a.Token == token {
+			tmp := *a
+			return &tmp, nil
+		}
+	}
+	return nil, fmt.Errorf("ByToken: %w", unknownAlertError)
+}
+
+/*
+ConfirmToken, confirms the alert with the management token
+*/
+func (n *AlertNotifier) ConfirmToken(token string) (*Alert, error) {
+	a, err := n.update(func(a *Alert) bool { return a.Token == token }, func(a *Alert) bool {
+		a.Confirmed = true
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ConfirmToken: %w", err)
+	}
+	return a, nil
+}
+
+/*
+RemoveToken, unregisters the alert with the management token
+*/
+func (n *AlertNotifier) RemoveToken(token string) error {
+	if _, err := n.update(func(a *Alert) bool { return a.Token == token }, func(*Alert) bool { return true }); err != nil {
+		return fmt.Errorf("RemoveToken: %w", err)
+	}
+	return nil
+}
+
+/*
+matches, returns the dishes of u served on a changed day that match a confirmed alert. Unchanged days have
+already been alerted for
+*/
+func (n *AlertNotifier) matches(u *PlanUpdate) []*alertMatch {
+	changed := make(map[time.Time]bool, len(u.ChangedDays))
+	for _, day := range u.ChangedDays {
+		changed[roundToDay(day)] = true
+	}
+	res := make([]*alertMatch, 0)
+	for _, a := range n.List() {
+		if !a.Confirmed {
+			continue
+		}
+		for _, d := range sortedDishes(u.Plan.Dishes) {
+			if changed[roundToDay(d.Date)] && (a.matcher.MatchString(d.Title) || a.matcher.MatchString(d.Description)) {
+				res = append(res, &alertMatch{Alert: a, Dish: d})
+			}
+		}
+	}
+	return res
+}
+
+/*
+alertText, renders the notification for m
+*/
+func alertText(m *alertMatch) string {
+	d := m.Dish
+	return fmt.Sprintf("%q is on the menu on %v, %v in column %v (%v): %v",
+		m.Alert.Pattern, weekdayNames[d.Date.Weekday()], d.Date.Format("02.01.2006"), d.ColID(), d.Type, formatDish(d))
+}
+
+/*
+alertMailText, appends the link to manage a to the alert text for emails
+*/
+func alertMailText(baseURL string, a *Alert, text string) string {
+	return fmt.Sprintf("%v\n\nTo stop this alert, visit %v/alert/%v", text, baseURL, a.Token)
+}
+
+/*
+alertConfirmText, is the email asking to confirm the alert a registered by a user
+*/
+func alertConfirmText(baseURL string, a *Alert) string {
+	return fmt.Sprintf("Someone, hopefully you, asked to be notified when a dish matching %q is on the menu of the UKSH "+
+		"Bistro Lübeck.\n\nTo confirm the alert, visit %v/alert/%v\n\nIf you did not ask for it, ignore this email. "+
+		"The alert is deleted in 24 hours unless it is confirmed.", a.Pattern, baseURL, a.Token)
+}
+
+/*
+Notify, is a PlanListener that asynchronously sends a notification for every dish of u matching an alert to the
+email of the alert, or to the chat if it has none. The hash of the plan is recorded for NotifyMissed
+*/
+func (n *AlertNotifier) Notify(u *PlanUpdate) {
+	if err := n.notified.record(u.Plan); err != nil {
+		n.errorLog.Printf("AlertNotifier: %v\n", err)
+	}
+	for _, m := range n.matches(u) {
+		send := n.chat
+		if m.Alert.Email != "" {
+			send = n.mail
+		}
+		if send == nil {
+			n.errorLog.Printf("AlertNotifier: no channel for alert %v\n", m.Alert.ID)
+			continue
+		}
+		text := alertText(m)
+		n.inFlight.Add(1)
+		go func(a *Alert) {
+			defer n.inFlight.Done()
+			if err := send(a, text); err != nil {
+				n.errorLog.Printf("AlertNotifier: failed to send alert %v: %v\n", a.ID, err)
+			}
+		}(m.Alert)
+		n.infoLog.Printf("Alert %v matched %v\n", m.Alert.ID, m.Dish.ID())
+	}
+}
+
+/*
+NotifyMissed, checks the plans that changed since they were last checked, e.g. because they were found by the
+refresh on startup before Notify was subscribed. Pass MenuCache.CachedWeeks
+*/
+func (n *AlertNotifier) NotifyMissed(plans []*WeekPlan) error {
+	updates, err := n.notified.missed(plans)
+	if err != nil {
+		return fmt.Errorf("NotifyMissed: %v", err)
+	}
+	for _, u := range updates {
+		n.Notify(u)
+	}
+	return nil
+}
+
+/*
+Wait, blocks until all pending notifications are sent
+*/
+func (n *AlertNotifier) Wait() {
+	n.inFlight.Wait()
+}
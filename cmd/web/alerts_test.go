@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestAlertNotifier(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	var lock sync.Mutex
+	sent := make([]string, 0)
+	//every alert is sent to its own target
+	channel := func(email bool) alertChannel {
+		return func(a *Alert, text string) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if (a.Email != "") != email {
+				t.Errorf("Alert %+v sent to the wrong channel\n", a)
+			}
+			sent = append(sent, text)
+			return nil
+		}
+	}
+	n, err := NewAlertNotifier(dataDir, channel(false), channel(true), log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Add("köfte", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Add("schnitzel|steak", "jane@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Add("(", ""); err == nil {
+		t.Errorf("Expected error for invalid pattern\n")
+	}
+
+	//alerts are persisted
+	reloaded, err := NewAlertNotifier(dataDir, nil, nil, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.List()) != 2 {
+		t.Errorf("Expected 2 persisted alerts got %v\n", len(reloaded.List()))
+	}
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	tuesday := monday.AddDate(0, 0, 1)
+	plan := &WeekPlan{Year: 2020, Week: 47, Dishes: []*parser.Dish{
+		{Title: "Köfte", Type: "Gericht 1", Date: monday},
+		{Title: "Gemüse-Curry", Type: vegetarianType, Date: monday},
+		{Title: "Rumpsteak", Type: "Gericht 2", Date: tuesday},
+	}}
+
+	type testCase struct {
+		name        string
+		changedDays []time.Time
+		expAlerts   []string
+	}
+
+	tests := []*testCase{
+		{name: "New plan", changedDays: []time.Time{monday, tuesday}, expAlerts: []string{"Montag, 16.11.2020", "Dienstag, 17.11.2020 in column"}},
+		{name: "Only changed days", changedDays: []time.Time{tuesday}, expAlerts: []string{"Rumpsteak"}},
+		{name: "Nothing changed", changedDays: []time.Time{}, expAlerts: []string{}},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				sent = sent[:0]
+				n.Notify(&PlanUpdate{Plan: plan, Changed: true, ChangedDays: tc.changedDays})
+				n.Wait()
+				//channels are called concurrently
+				sort.Strings(sent)
+				if len(sent) != len(tc.expAlerts) {
+					t.Fatalf("Expected %v alerts got %v\n", len(tc.expAlerts), sent)
+				}
+				for i, exp := range tc.expAlerts {
+					if !strings.Contains(sent[i], exp) {
+						t.Errorf("Expected %q in alert %q\n", exp, sent[i])
+					}
+				}
+			})
+		}(v)
+	}
+}
+
+func TestAlertRegistration(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	var lock sync.Mutex
+	sent := make([]string, 0)
+	mail := func(a *Alert, text string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, a.Email)
+		return nil
+	}
+	n, err := NewAlertNotifier(dataDir, nil, mail, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := n.Register("köfte", "", now); !errors.Is(err, badRequestError) {
+		t.Errorf("Expected %v without email got %v\n", badRequestError, err)
+	}
+	a, err := n.Register("köfte", "jane@example.org", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if a.Confirmed || a.Token == "" {
+		t.Errorf("Expected unconfirmed alert with token got %+v\n", a)
+	}
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	update := &PlanUpdate{
+		Plan:        &WeekPlan{Year: 2020, Week: 47, Hash: "a", Dishes: []*parser.Dish{{Title: "Köfte", Type: "Gericht 1", Date: monday}}},
+		ChangedDays: []time.Time{monday},
+	}
+	n.Notify(update)
+	n.Wait()
+	if len(sent) != 0 {
+		t.Errorf("Expected no alert before confirmation got %v\n", sent)
+	}
+	if _, err := n.ConfirmToken(a.Token); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	n.Notify(update)
+	n.Wait()
+	if len(sent) != 1 || sent[0] != "jane@example.org" {
+		t.Errorf("Expected alert to jane got %v\n", sent)
+	}
+
+	//unconfirmed alerts expire, the number of alerts per address is limited
+	for i := 1; i < maxAlertsPerEmail; i++ {
+		if _, err := n.Register("steak", "jane@example.org", now); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+	if _, err := n.Register("steak", "jane@example.org", now); !errors.Is(err, badRequestError) {
+		t.Errorf("Expected %v beyond limit got %v\n", badRequestError, err)
+	}
+	if _, err := n.Register("steak", "jane@example.org", now.Add(alertConfirmTimeout+time.Minute)); err != nil {
+		t.Errorf("Expected expired alerts to be dropped got %v\n", err)
+	}
+	if l := len(n.List()); l != 2 {
+		t.Errorf("Expected the confirmed and the new alert got %v\n", l)
+	}
+
+	if err := n.RemoveToken(a.Token); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, err := n.ByToken(a.Token); !errors.Is(err, unknownAlertError) {
+		t.Errorf("Expected %v got %v\n", unknownAlertError, err)
+	}
+
+	//without smtp only alerts for the chat can be added
+	chatOnly, err := NewAlertNotifier(dataDir, nil, nil, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chatOnly.Add("köfte", "jane@example.org"); !errors.Is(err, badRequestError) {
+		t.Errorf("Expected %v got %v\n", badRequestError, err)
+	}
+}
+
+func TestAlertNotifyMissed(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	var lock sync.Mutex
+	sent := 0
+	chat := func(*Alert, string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		sent++
+		return nil
+	}
+	start := func() *AlertNotifier {
+		n, err := NewAlertNotifier(dataDir, chat, nil, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	n := start()
+	if _, err := n.Add("köfte", ""); err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	plan := &WeekPlan{Year: 2020, Week: 47, Hash: "a", Dishes: []*parser.Dish{{Title: "Köfte", Type: "Gericht 1", Date: monday}}}
+	n.Notify(&PlanUpdate{Plan: plan, ChangedDays: []time.Time{monday}})
+	n.Wait()
+
+	//the plan changed while the service was down
+	changed := *plan
+	changed.Hash = "b"
+	for i := 0; i < 2; i++ {
+		n = start()
+		if err := n.NotifyMissed([]*WeekPlan{&changed}); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		n.Wait()
+	}
+	if sent != 2 {
+		t.Errorf("Expected the missed plan to be alerted once got %v alerts\n", sent)
+	}
+}
+
+func TestAlertPages(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewDigestMailer(&smtpConfig{from: "menu@example.org"}, nil, nil, "https://menu.example.org",
+		log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mails []string
+	mailer.send = func(to string, msg []byte) error {
+		//joins the soft line breaks of quoted-printable
+		mails = append(mails, strings.ReplaceAll(string(msg), "=\r\n", ""))
+		return nil
+	}
+	alerts, err := NewAlertNotifier(dataDir, nil, func(*Alert, string) error { return nil }, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		cfg:           defaultConfig(),
+		infoLog:       log.New(ioutil.Discard, "", 0),
+		errorLog:      log.New(ioutil.Discard, "", 0),
+		templateCache: templateCache,
+		mailer:        mailer,
+		alerts:        alerts,
+	}
+	srv := app.routes()
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/alerts", nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `action="/alerts"`) {
+		t.Errorf("Unexpected form %v %v\n", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/alerts", url.Values{"pattern": {"("}, "email": {"jane@example.org"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for invalid pattern got %v\n", http.StatusBadRequest, rec.Code)
+	}
+	if rec := do(http.MethodPost, "/alerts", url.Values{"pattern": {"köfte"}, "email": {"jane@example.org"}}); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %v got %v: %v\n", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	list := alerts.List()
+	if len(list) != 1 || list[0].Confirmed {
+		t.Fatalf("Expected an unconfirmed alert got %+v\n", list)
+	}
+	token := list[0].Token
+	if len(mails) != 1 || !strings.Contains(mails[0], "https://menu.example.org/alert/"+token) {
+		t.Fatalf("Expected confirmation mail with link got %v\n", mails)
+	}
+
+	//opening the link does not confirm the alert
+	if rec := do(http.MethodGet, "/alert/"+token, nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/confirm") {
+		t.Errorf("Unexpected alert page %v %v\n", rec.Code, rec.Body.String())
+	}
+	if a, _ := alerts.ByToken(token); a.Confirmed {
+		t.Errorf("Expected alert to be unconfirmed\n")
+	}
+	if rec := do(http.MethodPost, "/alert/"+token+"/confirm", url.Values{}); rec.Code != http.StatusOK {
+		t.Errorf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+	if a, _ := alerts.ByToken(token); !a.Confirmed {
+		t.Errorf("Expected alert to be confirmed\n")
+	}
+	if rec := do(http.MethodPost, "/alert/"+token+"/remove", url.Values{}); rec.Code != http.StatusOK {
+		t.Errorf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+	if rec := do(http.MethodGet, "/alert/"+token, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v for removed alert got %v\n", http.StatusNotFound, rec.Code)
+	}
+
+	//registration requires smtp
+	app.mailer = nil
+	if rec := do(http.MethodGet, "/alerts", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v without smtp got %v\n", http.StatusNotFound, rec.Code)
+	}
+}
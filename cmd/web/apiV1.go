@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+openAPIDocument, describes the /v1 API. Keep it in sync with the types below
+*/
+//go:embed openapi.json
+var openAPIDocument []byte
+
+/*
+v1Price, amounts are in euro cents. Nil amounts indicate that the raw OCR value could not be parsed
+*/
+type v1Price struct {
+	Raw      string `json:"raw"`
+	Currency string `json:"currency"`
+	Employee *int   `json:"employee"`
+	Guest    *int   `json:"guest"`
+}
+
+type v1Nutrition struct {
+	Raw  string `json:"raw"`
+	Kcal *int   `json:"kcal"`
+	KJ   *int   `json:"kj"`
+}
+
+type v1Dish struct {
+	ID          string      `json:"id"`
+	Date        string      `json:"date"`
+	Type        string      `json:"type"`
+	Column      int         `json:"column"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Price       v1Price     `json:"price"`
+	Nutrition   v1Nutrition `json:"nutrition"`
+	//true if an admin corrected the parser output
+	Edited       bool     `json:"edited"`
+	EditedFields []string `json:"editedFields,omitempty"`
+	//path of the png of the cell in the plan, empty if the dish was not parsed from a plan
+	Tile string `json:"tile,omitempty"`
+}
+
+type v1Day struct {
+	Date   string    `json:"date"`
+	Dishes []*v1Dish `json:"dishes"`
+}
+
+type v1Week struct {
+	Year      int       `json:"year"`
+	Week      int       `json:"week"`
+	Published time.Time `json:"published"`
+	Updated   time.Time `json:"updated"`
+	Dishes    []*v1Dish `json:"dishes"`
+}
+
+/*
+newV1Dish, converts d with info to its /v1 representation
+*/
+func newV1Dish(d *parser.Dish, info dishInfo) *v1Dish {
+	res := &v1Dish{
+		ID:           d.ID(),
+		Date:         d.Date.Format("2006-01-02"),
+		Type:         d.Type,
+		Column:       d.ColID(),
+		Title:        d.Title,
+		Description:  d.Description,
+		Price:        v1Price{Raw: d.Price, Currency: "EUR"},
+		Nutrition:    v1Nutrition{Raw: d.Kcal},
+		Edited:       len(info.edited) > 0,
+		EditedFields: info.edited,
+	}
+	if info.tile != nil {
+		res.Tile = tilePath(d)
+	}
+	if p, err := parser.ParsePrice(d.Price); err == nil {
+		res.Price.Employee = &p.Employee
+		res.Price.Guest = &p.Guest
+	}
+	if n, err := parser.ParseNutrition(d.Kcal); err == nil {
+		res.Nutrition.Kcal = &n.Kcal
+		res.Nutrition.KJ = &n.KJ
+	}
+	return res
+}
+
+/*
+newV1Dishes, converts dishes to their /v1 representation sorted by date and column. info returns the dishInfo of
+a dish, nil if nothing besides the dishes is known, e.g. for uncached dishes
+*/
+func newV1Dishes(dishes []*parser.Dish, info func(d *parser.Dish) dishInfo) []*v1Dish {
+	res := make([]*v1Dish, 0, len(dishes))
+	for _, d := range sortedDishes(dishes) {
+		var i dishInfo
+		if info != nil {
+			i = info(d)
+		}
+		res = append(res, newV1Dish(d, i))
+	}
+	return res
+}
+
+/*
+writeJSON, marshals v and writes it with status to w
+*/
+func (app *application) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		app.errorLog.Printf("Failed to marshal json: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(response); err != nil {
+		app.errorLog.Printf("Failed to write json response: %v\n", err)
+	}
+}
+
+/*
+marshalV1, returns v as json body if enc is the json encoder and dishes encoded with enc otherwise
+*/
+func marshalV1(enc *dishEncoder, v interface{}, dishes []*parser.Dish) ([]byte, error) {
+	if enc.name != "json" {
+		return encodeDishes(enc, dishes)
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshalV1: %v", err)
+	}
+	return body, nil
+}
+
+/*
+v1MenuHandler returns all dishes for the day specified in the url in the format negotiated with the client
+*/
+func (app *application) v1MenuHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := parseDate(r.URL.Query().Get(":date"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+
+	app.serveNegotiated(w, r, func(enc *dishEncoder) ([]byte, error) {
+		dishes, err := app.menuModel.GetMenu(date)
+		if err != nil {
+			return nil, err
+		}
+		return marshalV1(enc, v1Day{Date: date.Format("2006-01-02"), Dishes: newV1Dishes(dishes, app.menuModel.DishInfo)}, dishes)
+	})
+}
+
+/*
+v1WeekHandler returns all dishes of the iso week specified in the url in the format negotiated with the client
+*/
+func (app *application) v1WeekHandler(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+
+	app.serveNegotiated(w, r, func(enc *dishEncoder) ([]byte, error) {
+		plan, err := app.menuModel.GetWeek(year, week)
+		if err != nil {
+			return nil, err
+		}
+		return marshalV1(enc, v1Week{
+			Year:      plan.Year,
+			Week:      plan.Week,
+			Published: plan.Published,
+			Updated:   plan.Updated,
+			Dishes:    newV1Dishes(plan.Dishes, plan.dishInfo),
+		}, plan.Dishes)
+	})
+}
+
+/*
+v1ReportHandler stores the error report {"kind": string, "suggestion": string, "comment": string} for the dish
+specified in the url. For kind dish-missing the column is the one the missing dish should be shown in
+*/
+func (app *application) v1ReportHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := parseDate(r.URL.Query().Get(":date"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	col, err := strconv.Atoi(r.URL.Query().Get(":col"))
+	if err != nil || col < 0 {
+		app.writeProblem(w, r, fmt.Errorf("v1ReportHandler: %w: column must be a non negative number", badRequestError))
+		return
+	}
+	var req struct {
+		Kind       string `json:"kind"`
+		Suggestion string `json:"suggestion"`
+		Comment    string `json:"comment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("v1ReportHandler: %w: malformed body: %v", badRequestError, err))
+		return
+	}
+
+	rep, err := app.submitReport(date, col, req.Kind, req.Suggestion, req.Comment)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJSON(w, http.StatusCreated, rep)
+}
+
+/*
+v1PlanPDFHandler serves the archived PDF of the iso week specified in the url
+*/
+func (app *application) v1PlanPDFHandler(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	pdf, mod, err := app.archive.PDF(year, week)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"plan-%v.pdf\"", formatISOWeek(year, week)))
+	serveArchived(w, r, pdf, mod)
+}
+
+/*
+v1PlanPNGHandler serves the first page of the archived PDF of the iso week specified in the url as png
+*/
+func (app *application) v1PlanPNGHandler(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	png, mod, err := app.archive.PNG(r.Context(), year, week)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	serveArchived(w, r, png, mod)
+}
+
+/*
+serveArchived, writes the archived file content with caching headers. Conditional and range requests are handled
+by http.ServeContent
+*/
+func serveArchived(w http.ResponseWriter, r *http.Request, content []byte, mod time.Time) {
+	w.Header().Set("ETag", `"`+pdfHash(content)+`"`)
+	//the UKSH rarely replaces a published plan
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(w, r, "", mod, bytes.NewReader(content))
+}
+
+/*
+tilePath, returns the path of the endpoint serving the tile of d
+*/
+func tilePath(d *parser.Dish) string {
+	return "/v1/dish/" + d.Date.Format("2006-01-02") + "/" + strconv.Itoa(d.ColID()) + "/tile"
+}
+
+/*
+v1TileHandler serves the png of the cell in the plan the dish specified in the url was parsed from. Allows to
+compare the OCR output with the original
+*/
+func (app *application) v1TileHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := parseDate(r.URL.Query().Get(":date"))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	col, err := strconv.Atoi(r.URL.Query().Get(":col"))
+	if err != nil {
+		app.writeProblem(w, r, fmt.Errorf("v1TileHandler: %w: column must be a number", badRequestError))
+		return
+	}
+	dishes, err := app.menuModel.GetMenu(date)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	for _, d := range dishes {
+		if d.ColID() != col {
+			continue
+		}
+		if tile := app.menuModel.DishInfo(d).tile; tile != nil {
+			w.Header().Set("Content-Type", "image/png")
+			//tiles only change if the plan is parsed again
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			if _, err := w.Write(tile); err != nil {
+				app.errorLog.Printf("Failed to write tile: %v\n", err)
+			}
+			return
+		}
+	}
+	app.writeProblem(w, r, fmt.Errorf("v1TileHandler: %w: no tile for column %v on %v", unknownDishError, col, date.Format("2006-01-02")))
+}
+
+/*
+openAPIHandler serves the OpenAPI document of the /v1 API
+*/
+func (app *application) openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPIDocument); err != nil {
+		app.errorLog.Printf("Failed to write openapi document: %v\n", err)
+	}
+}
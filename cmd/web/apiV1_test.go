@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestV1WeekHandler(t *testing.T) {
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{
+		{Title: "Pasta-Pfanne", Price: "€ 4,80 / € 6,00", Kcal: "kcal 528 / kJ 2212", Type: "Wok Station", Date: monday},
+		{Title: "Rumpsteak", Price: "€ 5,9O", Kcal: "kcal 879 / kJ 3683", Type: "Gericht 2", Date: monday},
+	}, nil, time.Now())
+	app := &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+	}
+
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+
+	var got struct {
+		Week   int `json:"week"`
+		Dishes []struct {
+			ID    string `json:"id"`
+			Date  string `json:"date"`
+			Price struct {
+				Employee *int `json:"employee"`
+			} `json:"price"`
+			Nutrition struct {
+				Kcal *int `json:"kcal"`
+			} `json:"nutrition"`
+		} `json:"dishes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if got.Week != 47 || len(got.Dishes) != 2 {
+		t.Fatalf("Unexpected response %v\n", rec.Body.String())
+	}
+	first := got.Dishes[0]
+	if first.ID != "2020-11-16-0" || first.Date != "2020-11-16" {
+		t.Errorf("Unexpected id %v or date %v\n", first.ID, first.Date)
+	}
+	if first.Price.Employee == nil || *first.Price.Employee != 480 || first.Nutrition.Kcal == nil || *first.Nutrition.Kcal != 528 {
+		t.Errorf("Structured price or nutrition missing in %v\n", rec.Body.String())
+	}
+	if got.Dishes[1].Price.Employee != nil {
+		t.Errorf("Expected null price for unparsable OCR output\n")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil)
+	req.Header.Set("Accept", "text/csv")
+	rec = httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") || !strings.Contains(rec.Body.String(), "Rumpsteak") {
+		t.Errorf("Expected csv week got %v %v %v\n", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	rec = httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("Expected json week for browser got %v %v\n", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestV1TileHandler(t *testing.T) {
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	tile := []byte("\x89PNG\r\n\x1a\ntile")
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{{Title: "Pasta-Pfanne", Type: "Wok Station", Date: monday}}, map[string][]byte{"2020-11-16-0": tile}, time.Now())
+	mc.cacheWeek(2020, 47, mc.plans[weekKey{year: 2020, week: 47}].Dishes)
+	mc.dateToDishes[monday.AddDate(0, 0, 1)] = []*parser.Dish{parser.NewDish(monday.AddDate(0, 0, 1), 0)}
+	app := &application{
+		infoLog:       log.New(ioutil.Discard, "", 0),
+		errorLog:      log.New(ioutil.Discard, "", 0),
+		menuModel:     mc,
+		templateCache: templateCache,
+	}
+	srv := app.routes()
+
+	type testCase struct {
+		name      string
+		url       string
+		expStatus int
+		expBody   string
+	}
+
+	tests := []*testCase{
+		{name: "Tile", url: "/v1/dish/2020-11-16/0/tile", expStatus: http.StatusOK, expBody: string(tile)},
+		{name: "Unknown column", url: "/v1/dish/2020-11-16/1/tile", expStatus: http.StatusNotFound},
+		{name: "Dish without tile", url: "/v1/dish/2020-11-17/0/tile", expStatus: http.StatusNotFound},
+		{name: "Malformed column", url: "/v1/dish/2020-11-16/first/tile", expStatus: http.StatusBadRequest},
+		{name: "Linked in api", url: "/v1/menu/2020-11-16", expStatus: http.StatusOK, expBody: `"tile":"/v1/dish/2020-11-16/0/tile"`},
+		{name: "Shown on dish page", url: "/dish/2020-11-16/0", expStatus: http.StatusOK, expBody: `src="/v1/dish/2020-11-16/0/tile"`},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+				if !strings.Contains(rec.Body.String(), tc.expBody) {
+					t.Errorf("Expected body to contain %q got %v\n", tc.expBody, rec.Body.String())
+				}
+			})
+		}(v)
+	}
+}
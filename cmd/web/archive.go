@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+pageRenderer, renders the first page of pdf as png. Abstraction of parser.PDFToPngContext for testing
+*/
+type pageRenderer func(ctx context.Context, pdf []byte) ([]byte, error)
+
+/*
+PlanArchive, keeps the newest PDF of every week on disk, so that the original plans can be served without
+fetching them from the UKSH website again. Rendered pages are stored next to the PDFs
+*/
+type PlanArchive struct {
+	//serializes writes and renders
+	lock   sync.Mutex
+	dir    string
+	render pageRenderer
+}
+
+/*
+NewPlanArchive, stores the plans in dataDir/plans and renders pages with render
+*/
+func NewPlanArchive(dataDir string, render pageRenderer) (*PlanArchive, error) {
+	a := &PlanArchive{dir: filepath.Join(dataDir, "plans"), render: render}
+	if err := os.MkdirAll(a.dir, 0700); err != nil {
+		return nil, fmt.Errorf("NewPlanArchive: %v", err)
+	}
+	return a, nil
+}
+
+func (a *PlanArchive) path(year, week int, ext string) string {
+	return filepath.Join(a.dir, formatISOWeek(year, week)+ext)
+}
+
+/*
+Store, replaces the PDF of the given iso week. A nil PlanArchive discards the PDF
+*/
+func (a *PlanArchive) Store(year, week int, pdf []byte) error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	//keep the modification time, e.g. when the plan is parsed again after a restart
+	if old, err := ioutil.ReadFile(a.path(year, week, ".pdf")); err == nil && bytes.Equal(old, pdf) {
+		return nil
+	}
+	if err := writeFileAtomic(a.path(year, week, ".pdf"), pdf); err != nil {
+		return fmt.Errorf("Store: %v", err)
+	}
+	//rendered from the previous PDF
+	if err := os.Remove(a.path(year, week, ".png")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Store: %v", err)
+	}
+	return nil
+}
+
+/*
+PDF, returns the archived PDF of the given iso week and the time it was archived
+*/
+func (a *PlanArchive) PDF(year, week int) ([]byte, time.Time, error) {
+	return a.read(a.path(year, week, ".pdf"))
+}
+
+/*
+PNG, returns the first page of the archived PDF of the given iso week as png and the time the PDF was archived.
+The page is rendered on the first call
+*/
+func (a *PlanArchive) PNG(ctx context.Context, year, week int) ([]byte, time.Time, error) {
+	png, mod, err := a.read(a.path(year, week, ".png"))
+	if err == nil {
+		return png, mod, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	pdf, mod, err := a.read(a.path(year, week, ".pdf"))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("PNG: %w", err)
+	}
+	if png, err = a.render(ctx, pdf); err != nil {
+		return nil, time.Time{}, fmt.Errorf("PNG: %w", err)
+	}
+	if err := writeFileAtomic(a.path(year, week, ".png"), png); err != nil {
+		return nil, time.Time{}, fmt.Errorf("PNG: %v", err)
+	}
+	//the png changes with the pdf, so report the time of the pdf
+	if err := os.Chtimes(a.path(year, week, ".png"), mod, mod); err != nil {
+		return nil, time.Time{}, fmt.Errorf("PNG: %v", err)
+	}
+	return png, mod, nil
+}
+
+/*
+read, returns the content and modification time of the file at path. A missing file is an unknownWeekError
+*/
+func (a *PlanArchive) read(path string) ([]byte, time.Time, error) {
+	if a == nil {
+		return nil, time.Time{}, fmt.Errorf("read: %w: archive disabled", unknownWeekError)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, fmt.Errorf("read: %w: %v not archived", unknownWeekError, filepath.Base(path))
+		}
+		return nil, time.Time{}, fmt.Errorf("read: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("read: %v", err)
+	}
+	return data, info.ModTime(), nil
+}
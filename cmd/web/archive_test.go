@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestPlanArchive(t *testing.T) {
+	renders := 0
+	archive, err := NewPlanArchive(t.TempDir(), func(_ context.Context, pdf []byte) ([]byte, error) {
+		renders++
+		return append([]byte("png of "), pdf...), nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		archive:  archive,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	u := mc.recordPlan([]byte("%PDF-1.4 v1"), MenuBaseURL, []*parser.Dish{{Title: "Pasta-Pfanne", Date: monday}}, nil, time.Now())
+	mc.storePlan([]byte("%PDF-1.4 v1"), u.Plan)
+	app := &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+		archive:   archive,
+	}
+	srv := app.routes()
+
+	type testCase struct {
+		name        string
+		url         string
+		ifNoneMatch bool
+		expStatus   int
+		expBody     string
+	}
+
+	tests := []*testCase{
+		{name: "PDF", url: "/v1/week/2020-W47/pdf", expStatus: http.StatusOK, expBody: "%PDF-1.4 v1"},
+		{name: "PNG", url: "/v1/week/2020-W47/png", expStatus: http.StatusOK, expBody: "png of %PDF-1.4 v1"},
+		{name: "PNG rendered once", url: "/v1/week/2020-W47/png", expStatus: http.StatusOK, expBody: "png of %PDF-1.4 v1"},
+		{name: "Not modified", url: "/v1/week/2020-W47/pdf", ifNoneMatch: true, expStatus: http.StatusNotModified},
+		{name: "Unknown week", url: "/v1/week/2020-W48/pdf", expStatus: http.StatusNotFound},
+		{name: "Malformed week", url: "/v1/week/47/png", expStatus: http.StatusBadRequest},
+	}
+
+	etag := ""
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+				if tc.ifNoneMatch {
+					r.Header.Set("If-None-Match", etag)
+				}
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, r)
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+				if tc.expBody != "" && rec.Body.String() != tc.expBody {
+					t.Errorf("Expected body %q got %q\n", tc.expBody, rec.Body.String())
+				}
+				if rec.Code == http.StatusOK && (rec.Header().Get("Cache-Control") == "" || rec.Header().Get("Last-Modified") == "") {
+					t.Errorf("Expected caching headers got %v\n", rec.Header())
+				}
+				if tc.url == "/v1/week/2020-W47/pdf" && etag == "" {
+					etag = rec.Header().Get("ETag")
+				}
+			})
+		}(v)
+	}
+	if renders != 1 {
+		t.Errorf("Expected page to be rendered once got %v\n", renders)
+	}
+
+	//a changed plan replaces the pdf and its rendered page
+	u = mc.recordPlan([]byte("%PDF-1.4 v2"), MenuBaseURL, []*parser.Dish{{Title: "Rumpsteak", Date: monday}}, nil, time.Now())
+	mc.storePlan([]byte("%PDF-1.4 v2"), u.Plan)
+	if png, _, err := archive.PNG(context.Background(), 2020, 47); err != nil || string(png) != "png of %PDF-1.4 v2" {
+		t.Errorf("Expected page of the new pdf got %q, %v\n", png, err)
+	}
+	if _, _, err := archive.PDF(2020, 48); !errors.Is(err, unknownWeekError) {
+		t.Errorf("Expected %v got %v\n", unknownWeekError, err)
+	}
+}
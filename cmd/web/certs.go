@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+certReloader, serves the tls certificate via tls.Config.GetCertificate and reloads it when the files change,
+so that renewed certificates are used without restart
+*/
+type certReloader struct {
+	lock     sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	//modification times of the files cert was loaded from
+	certMod time.Time
+	keyMod  time.Time
+	//the files are checked for changes at most once per checkInterval
+	lastCheck     time.Time
+	checkInterval time.Duration
+	logger        *structuredLogger
+}
+
+/*
+newCertReloader, loads the certificate and private key from the pem files at certPath and keyPath
+*/
+func newCertReloader(certPath, keyPath string, logger *structuredLogger) (*certReloader, error) {
+	r := &certReloader{
+		certPath:      certPath,
+		keyPath:       keyPath,
+		checkInterval: 10 * time.Second,
+		logger:        logger,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, fmt.Errorf("newCertReloader: %v", err)
+	}
+	return r, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+/*
+Reload, loads the certificate and key files. On error the previous certificate stays active
+*/
+func (r *certReloader) Reload() error {
+	certMod, err := modTime(r.certPath)
+	if err != nil {
+		return fmt.Errorf("Reload: %v", err)
+	}
+	keyMod, err := modTime(r.keyPath)
+	if err != nil {
+		return fmt.Errorf("Reload: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("Reload: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("Reload: %v", err)
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	r.lastCheck = time.Now()
+	r.lock.Unlock()
+	r.logger.Info("loaded tls certificate", "path", r.certPath, "subject", cert.Leaf.Subject.String(),
+		"notAfter", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+/*
+reloadIfChanged, reloads the certificate if one of the files has been modified since the last load
+*/
+func (r *certReloader) reloadIfChanged() {
+	r.lock.Lock()
+	if time.Since(r.lastCheck) < r.checkInterval {
+		r.lock.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	certMod, keyMod := r.certMod, r.keyMod
+	r.lock.Unlock()
+
+	newCertMod, err := modTime(r.certPath)
+	if err != nil {
+		r.logger.Error("failed to check tls certificate", "error", err)
+		return
+	}
+	newKeyMod, err := modTime(r.keyPath)
+	if err != nil {
+		r.logger.Error("failed to check tls certificate", "error", err)
+		return
+	}
+	if newCertMod.Equal(certMod) && newKeyMod.Equal(keyMod) {
+		return
+	}
+	if err := r.Reload(); err != nil {
+		//e.g. the certificate has been written but not yet the matching key, retried after checkInterval
+		r.logger.Error("failed to reload tls certificate", "error", err)
+	}
+}
+
+/*
+GetCertificate, implements tls.Config.GetCertificate
+*/
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+writeSelfSignedCert, writes a self signed certificate for commonName and its key to certPath and keyPath
+*/
+func writeSelfSignedCert(t *testing.T, certPath, keyPath, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "privkey.pem")
+	writeSelfSignedCert(t, certPath, keyPath, "old.example.org")
+
+	r, err := newCertReloader(certPath, keyPath, newStructuredLogger(ioutil.Discard, levelInfo))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	commonName := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "old.example.org" {
+		t.Fatalf("Expected old.example.org got %v\n", got)
+	}
+
+	writeSelfSignedCert(t, certPath, keyPath, "new.example.org")
+	//the modification time may not change within the resolution of the file system
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	os.Chtimes(keyPath, future, future)
+	if got := commonName(); got != "old.example.org" {
+		t.Errorf("Expected no check within checkInterval got %v\n", got)
+	}
+	r.checkInterval = 0
+	if got := commonName(); got != "new.example.org" {
+		t.Errorf("Expected reloaded certificate got %v\n", got)
+	}
+
+	//a broken key must not replace the working certificate
+	if err := ioutil.WriteFile(keyPath, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Errorf("Expected error for broken key\n")
+	}
+	if got := commonName(); got != "new.example.org" {
+		t.Errorf("Expected previous certificate after failed reload got %v\n", got)
+	}
+}
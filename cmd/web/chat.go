@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+vegetarianType, is the Dish.Type of the vegetarian column
+*/
+const vegetarianType = "Vegetarisch"
+
+const slashCommandHelp = "Usage: /lunch [today|tomorrow] [veggie]\n" +
+	"Shows the menu of the UKSH Bistro Lübeck. veggie only shows vegetarian dishes."
+
+/*
+slashCommandResponse, is understood by both Slack and Mattermost
+*/
+type slashCommandResponse struct {
+	//"in_channel" is visible to everybody, "ephemeral" only to the user issuing the command
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+/*
+vegetarianDishes, returns the dishes of the vegetarian column
+*/
+func vegetarianDishes(dishes []*parser.Dish) []*parser.Dish {
+	res := make([]*parser.Dish, 0)
+	for _, d := range dishes {
+		if d.Type == vegetarianType {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+/*
+chatMessage, renders the dishes served on date as chat message
+*/
+func chatMessage(date time.Time, dishes []*parser.Dish) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Menu for %v, %v\n", weekdayNames[date.Weekday()], date.Format("02.01.2006"))
+	if len(dishes) == 0 {
+		b.WriteString("No matching dishes.")
+		return b.String()
+	}
+	for _, d := range sortedDishes(dishes) {
+		fmt.Fprintf(&b, "• %v: %v\n", d.Type, formatDish(d))
+	}
+	return b.String()
+}
+
+/*
+parseSlashCommand, parses the text of a /lunch command into the requested date and filter
+*/
+func parseSlashCommand(text string, now time.Time) (date time.Time, veggie bool, err error) {
+	date = roundToDay(now)
+	for _, arg := range strings.Fields(strings.ToLower(text)) {
+		switch arg {
+		case "today", "heute":
+			date = roundToDay(now)
+		case "tomorrow", "morgen":
+			date = roundToDay(now).AddDate(0, 0, 1)
+		case "veggie", "vegetarian", "vegetarisch":
+			veggie = true
+		default:
+			return time.Time{}, false, fmt.Errorf("parseSlashCommand: %w: unknown argument %q", badRequestError, arg)
+		}
+	}
+	return date, veggie, nil
+}
+
+/*
+slashCommandHandler, answers the Slack/Mattermost slash command protocol. The request token must match
+the configured slash command token
+*/
+func (app *application) slashCommandHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.config().Chat.SlashCommandToken
+	if token == "" {
+		app.writeProblem(w, r, fmt.Errorf("slashCommandHandler: %w: slash command is disabled", forbiddenError))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := r.ParseForm(); err != nil {
+		app.writeProblem(w, r, fmt.Errorf("slashCommandHandler: %w: %v", badRequestError, err))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("token")), []byte(token)) != 1 {
+		app.writeProblem(w, r, fmt.Errorf("slashCommandHandler: %w: wrong token", unauthorizedError))
+		return
+	}
+
+	date, veggie, err := parseSlashCommand(r.PostForm.Get("text"), time.Now().In(time.Local))
+	if err != nil {
+		app.writeJSON(w, http.StatusOK, slashCommandResponse{ResponseType: "ephemeral", Text: slashCommandHelp})
+		return
+	}
+
+	//never wait for a refresh, chat servers expect an answer within 3 seconds
+	dishes, ok := app.menuModel.CachedMenu(date)
+	if !ok {
+		app.writeJSON(w, http.StatusOK, slashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("There is no menu for %v, %v.", weekdayNames[date.Weekday()], date.Format("02.01.2006")),
+		})
+		return
+	}
+	if veggie {
+		dishes = vegetarianDishes(dishes)
+	}
+	app.writeJSON(w, http.StatusOK, slashCommandResponse{ResponseType: "in_channel", Text: chatMessage(date, dishes)})
+}
+
+/*
+postToChat, sends text to a Slack/Mattermost incoming webhook
+*/
+func postToChat(client *http.Client, webhookURL, text string) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{Text: text})
+	if err != nil {
+		return fmt.Errorf("postToChat: %v", err)
+	}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("postToChat: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("postToChat: unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+/*
+postDailyMenu, posts today's menu to webhookURL. Days without menu, e.g. weekends, are skipped
+*/
+func (app *application) postDailyMenu(webhookURL string) {
+	today := roundToDay(time.Now().In(time.Local))
+	dishes, ok := app.menuModel.CachedMenu(today)
+	if !ok {
+		app.infoLog.Printf("postDailyMenu: no menu for today, skipping\n")
+		return
+	}
+	if err := postToChat(&http.Client{Timeout: 10 * time.Second}, webhookURL, chatMessage(today, dishes)); err != nil {
+		app.errorLog.Printf("postDailyMenu: %v\n", err)
+		return
+	}
+	app.infoLog.Printf("Posted today's menu to chat\n")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestSlashCommandHandler(t *testing.T) {
+	today := roundToDay(time.Now().In(time.Local))
+	cfg := defaultConfig()
+	cfg.Chat.SlashCommandToken = "token"
+	app := &application{
+		cfg:      cfg,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+		menuModel: &MenuCache{
+			dateToDishes: map[time.Time][]*parser.Dish{today: {
+				{Title: "Pasta-Pfanne", Type: "Wok Station", Date: today},
+				{Title: "Ofenkartoffel", Type: vegetarianType, Date: today},
+			}},
+			infoLog:  log.New(ioutil.Discard, "", 0),
+			errorLog: log.New(ioutil.Discard, "", 0),
+		},
+	}
+
+	type testCase struct {
+		name         string
+		token        string
+		text         string
+		expStatus    int
+		expType      string
+		expContent   string
+		unexpContent string
+	}
+
+	tests := []*testCase{
+		{name: "Today", token: "token", text: "", expStatus: http.StatusOK, expType: "in_channel", expContent: "Pasta-Pfanne"},
+		{name: "Veggie", token: "token", text: "veggie", expStatus: http.StatusOK, expType: "in_channel", expContent: "Ofenkartoffel", unexpContent: "Pasta-Pfanne"},
+		//uncached, must be answered without a refresh
+		{name: "Not published", token: "token", text: "tomorrow", expStatus: http.StatusOK, expType: "ephemeral", expContent: "There is no menu"},
+		{name: "Help", token: "token", text: "yesterday", expStatus: http.StatusOK, expType: "ephemeral", expContent: "Usage"},
+		{name: "Wrong token", token: "guess", expStatus: http.StatusUnauthorized},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				form := url.Values{"token": {tc.token}, "command": {"/lunch"}, "text": {tc.text}}
+				r := httptest.NewRequest(http.MethodPost, "/chat/lunch", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				rec := httptest.NewRecorder()
+				app.slashCommandHandler(rec, r)
+
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v\n", tc.expStatus, rec.Code)
+				}
+				if tc.expStatus != http.StatusOK {
+					return
+				}
+				var got slashCommandResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if got.ResponseType != tc.expType || !strings.Contains(got.Text, tc.expContent) {
+					t.Errorf("Unexpected response %+v\n", got)
+				}
+				if tc.unexpContent != "" && strings.Contains(got.Text, tc.unexpContent) {
+					t.Errorf("Response must not contain %v: %+v\n", tc.unexpContent, got)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestPostToChat(t *testing.T) {
+	var got struct {
+		Text string `json:"text"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+	}))
+	defer srv.Close()
+
+	if err := postToChat(srv.Client(), srv.URL, "hello"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if got.Text != "hello" {
+		t.Errorf("Expected hello got %v\n", got.Text)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+duration, is a time.Duration that is written as e.g. "30s" or "2m" in the config file
+*/
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+/*
+stringList, is a list of strings that may be written as single string in the config file
+*/
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+type serverSection struct {
+	//see parseListenAddr for the format
+	Listen      stringList `yaml:"listen"`
+	UseSSL      bool       `yaml:"useSSL"`
+	CertPath    string     `yaml:"certPath"`
+	PrivKeyPath string     `yaml:"privKeyPath"`
+	//addresses of the plain http listeners that redirect to https, requires UseSSL
+	RedirectListen stringList `yaml:"redirectListen"`
+	ReadTimeout    duration   `yaml:"readTimeout"`
+	WriteTimeout   duration   `yaml:"writeTimeout"`
+	IdleTimeout    duration   `yaml:"idleTimeout"`
+	//lifetime of the /v1/events streams, which are not limited by WriteTimeout
+	StreamTimeout duration `yaml:"streamTimeout"`
+}
+
+type menuSection struct {
+	//page of the UKSH website linking the PDFs
+	SourceURL string `yaml:"sourceURL"`
+	//time of day in the format hh:mm
+	RefreshTime string `yaml:"refreshTime"`
+	//requests for uncached dates at most this many days ahead trigger a refresh
+	DaysAhead int `yaml:"daysAhead"`
+}
+
+type parserSection struct {
+	CommandTimeout duration `yaml:"commandTimeout"`
+	//limits of POST /parse, 0 concurrency disables the endpoint
+	AdHocConcurrency int `yaml:"adHocConcurrency"`
+	AdHocMaxSize     int `yaml:"adHocMaxSize"`
+}
+
+type webhookSection struct {
+	URLs   []string `yaml:"urls"`
+	Secret string   `yaml:"secret"`
+}
+
+type chatSection struct {
+	SlashCommandToken string `yaml:"slashCommandToken"`
+	WebhookURL        string `yaml:"webhookURL"`
+	PostTime          string `yaml:"postTime"`
+}
+
+type mqttSection struct {
+	Broker        string `yaml:"broker"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	CAFile        string `yaml:"caFile"`
+	TopicToday    string `yaml:"topicToday"`
+	TopicTomorrow string `yaml:"topicTomorrow"`
+	HADiscovery   bool   `yaml:"haDiscovery"`
+}
+
+type smtpSection struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	From       string `yaml:"from"`
+	DigestTime string `yaml:"digestTime"`
+}
+
+type apiKey struct {
+	//identifies the client in logs, never sent by clients
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	//requests per day, 0 is unlimited
+	DailyQuota int `yaml:"dailyQuota"`
+	//override api.rateLimit and api.burst for requests with this key if not 0
+	RateLimit int `yaml:"rateLimit"`
+	Burst     int `yaml:"burst"`
+}
+
+type corsSection struct {
+	//origins like https://intranet.example.org that may call the api from the browser, "*" allows all
+	AllowedOrigins stringList `yaml:"allowedOrigins"`
+	MaxAge         duration   `yaml:"maxAge"`
+}
+
+type apiSection struct {
+	Keys []apiKey `yaml:"keys"`
+	//rejects api requests without a valid key
+	RequireKey bool `yaml:"requireKey"`
+	//requests per minute per key or ip, 0 disables rate limiting
+	RateLimit int `yaml:"rateLimit"`
+	Burst     int `yaml:"burst"`
+	//use the last address in X-Forwarded-For as client ip, only safe behind a reverse proxy setting it
+	TrustForwardedFor bool        `yaml:"trustForwardedFor"`
+	CORS              corsSection `yaml:"cors"`
+}
+
+type tracingSection struct {
+	Exporter string `yaml:"exporter"`
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+/*
+Config, contains all settings of the service. It is loaded from the yaml file in ENV_CONFIG_FILE, every setting
+can be overridden by its environment variable. A Config is never modified after loading, reloads replace it
+*/
+type Config struct {
+	Server     serverSection  `yaml:"server"`
+	PublicURL  string         `yaml:"publicURL"`
+	DataDir    string         `yaml:"dataDir"`
+	AdminToken string         `yaml:"adminToken"`
+	LogLevel   string         `yaml:"logLevel"`
+	Menu       menuSection    `yaml:"menu"`
+	Parser     parserSection  `yaml:"parser"`
+	Webhooks   webhookSection `yaml:"webhooks"`
+	Chat       chatSection    `yaml:"chat"`
+	MQTT       mqttSection    `yaml:"mqtt"`
+	SMTP       smtpSection    `yaml:"smtp"`
+	Tracing    tracingSection `yaml:"tracing"`
+	API        apiSection     `yaml:"api"`
+}
+
+/*
+defaultConfig, returns the settings used if neither the config file nor the environment set them
+*/
+func defaultConfig() *Config {
+	return &Config{
+		Server: serverSection{
+			Listen:       stringList{":8080"},
+			ReadTimeout:  duration{5 * time.Second},
+			WriteTimeout: duration{10 * time.Second},
+			IdleTimeout:  duration{time.Minute},
+			//browsers reconnect after it, the keep-alive comments are sent every 25 seconds in between
+			StreamTimeout: duration{time.Hour},
+		},
+		DataDir:  "data",
+		LogLevel: "info",
+		Menu: menuSection{
+			SourceURL:   MenuBaseURL,
+			RefreshTime: "01:00",
+			DaysAhead:   7,
+		},
+		Parser: parserSection{
+			CommandTimeout:   duration{2 * time.Minute},
+			AdHocConcurrency: 2,
+			AdHocMaxSize:     5 << 20,
+		},
+		Chat: chatSection{PostTime: "11:00"},
+		MQTT: mqttSection{
+			TopicToday:    "uksh-menu/today",
+			TopicTomorrow: "uksh-menu/tomorrow",
+			HADiscovery:   true,
+		},
+		SMTP:    smtpSection{Port: 587, DigestTime: "07:00"},
+		Tracing: tracingSection{Endpoint: "localhost:4318"},
+		API: apiSection{
+			RateLimit: 120,
+			Burst:     30,
+			CORS:      corsSection{MaxAge: duration{10 * time.Minute}},
+		},
+	}
+}
+
+/*
+loadConfig, reads the config file at path on top of the defaults, applies the environment overrides returned by
+getenv and validates the result. An empty path only uses defaults and environment
+*/
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loadConfig: %v", err)
+		}
+		//strict, so that typos in setting names are not silently ignored
+		if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+			return nil, fmt.Errorf("loadConfig: %v: %v", path, err)
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, fmt.Errorf("loadConfig: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("loadConfig: %v", err)
+	}
+	return cfg, nil
+}
+
+/*
+applyEnv, overrides every setting whose environment variable is set
+*/
+func (c *Config) applyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		ENV_SSL_CERT_PATH:       &c.Server.CertPath,
+		ENV_SSL_PRIVKEY_PATH:    &c.Server.PrivKeyPath,
+		ENV_PUBLIC_URL:          &c.PublicURL,
+		ENV_DATA_DIR:            &c.DataDir,
+		ENV_ADMIN_TOKEN:         &c.AdminToken,
+		ENV_LOG_LEVEL:           &c.LogLevel,
+		ENV_MENU_SOURCE_URL:     &c.Menu.SourceURL,
+		ENV_REFRESH_TIME:        &c.Menu.RefreshTime,
+		ENV_WEBHOOK_SECRET:      &c.Webhooks.Secret,
+		ENV_SLASH_COMMAND_TOKEN: &c.Chat.SlashCommandToken,
+		ENV_CHAT_WEBHOOK_URL:    &c.Chat.WebhookURL,
+		ENV_CHAT_POST_TIME:      &c.Chat.PostTime,
+		ENV_MQTT_BROKER:         &c.MQTT.Broker,
+		ENV_MQTT_USERNAME:       &c.MQTT.Username,
+		ENV_MQTT_PASSWORD:       &c.MQTT.Password,
+		ENV_MQTT_CA_FILE:        &c.MQTT.CAFile,
+		ENV_MQTT_TOPIC_TODAY:    &c.MQTT.TopicToday,
+		ENV_MQTT_TOPIC_TOMORROW: &c.MQTT.TopicTomorrow,
+		ENV_SMTP_HOST:           &c.SMTP.Host,
+		ENV_SMTP_USERNAME:       &c.SMTP.Username,
+		ENV_SMTP_PASSWORD:       &c.SMTP.Password,
+		ENV_SMTP_FROM:           &c.SMTP.From,
+		ENV_DIGEST_TIME:         &c.SMTP.DigestTime,
+		ENV_TRACING_EXPORTER:    &c.Tracing.Exporter,
+		ENV_OTLP_ENDPOINT:       &c.Tracing.Endpoint,
+	}
+	for env, setting := range strs {
+		if v := getenv(env); v != "" {
+			*setting = v
+		}
+	}
+	bools := map[string]*bool{
+		ENV_USE_SSL:           &c.Server.UseSSL,
+		ENV_MQTT_HA_DISCOVERY: &c.MQTT.HADiscovery,
+		ENV_OTLP_INSECURE:     &c.Tracing.Insecure,
+	}
+	for env, setting := range bools {
+		if v := getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", env, err)
+			}
+			*setting = b
+		}
+	}
+	ints := map[string]*int{
+		ENV_SMTP_PORT:  &c.SMTP.Port,
+		ENV_DAYS_AHEAD: &c.Menu.DaysAhead,
+	}
+	for env, setting := range ints {
+		if v := getenv(env); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", env, err)
+			}
+			*setting = i
+		}
+	}
+	lists := map[string]*[]string{
+		ENV_SERVER_LISTEN:   (*[]string)(&c.Server.Listen),
+		ENV_REDIRECT_LISTEN: (*[]string)(&c.Server.RedirectListen),
+		ENV_WEBHOOK_URLS:    &c.Webhooks.URLs,
+	}
+	for env, setting := range lists {
+		if v := getenv(env); v != "" {
+			*setting = strings.Split(v, ",")
+		}
+	}
+	return nil
+}
+
+/*
+validate, checks the settings for consistency
+*/
+func (c *Config) validate() error {
+	isHTTPURL := func(raw string) bool {
+		u, err := url.Parse(raw)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}
+	isTimeOfDay := func(s string) bool {
+		_, err := time.Parse("15:04", s)
+		return err == nil
+	}
+	errs := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(c.Server.Listen) > 0, "server.listen must not be empty")
+	for _, addr := range append(append([]string{}, c.Server.Listen...), c.Server.RedirectListen...) {
+		_, _, err := parseListenAddr(addr)
+		check(err == nil, "server: invalid listen address %q", addr)
+	}
+	check(len(c.Server.RedirectListen) == 0 || c.Server.UseSSL, "server.redirectListen requires server.useSSL")
+	check(!c.Server.UseSSL || (c.Server.CertPath != "" && c.Server.PrivKeyPath != ""), "server.useSSL requires server.certPath and server.privKeyPath")
+	check(c.Server.ReadTimeout.Duration > 0 && c.Server.WriteTimeout.Duration > 0 && c.Server.IdleTimeout.Duration > 0 && c.Server.StreamTimeout.Duration > 0, "server timeouts must be positive")
+	check(c.PublicURL == "" || isHTTPURL(c.PublicURL), "publicURL %q is not an absolute http(s) url", c.PublicURL)
+	check(c.DataDir != "", "dataDir must not be empty")
+	_, err := parseLogLevel(c.LogLevel)
+	check(err == nil, "logLevel %q must be one of debug, info, warn and error", c.LogLevel)
+	check(isHTTPURL(c.Menu.SourceURL), "menu.sourceURL %q is not an absolute http(s) url", c.Menu.SourceURL)
+	check(isTimeOfDay(c.Menu.RefreshTime), "menu.refreshTime %q is not in the format hh:mm", c.Menu.RefreshTime)
+	check(c.Menu.DaysAhead >= 1 && c.Menu.DaysAhead <= 31, "menu.daysAhead must be between 1 and 31")
+	check(c.Parser.CommandTimeout.Duration > 0, "parser.commandTimeout must be positive")
+	check(c.Parser.AdHocConcurrency >= 0, "parser.adHocConcurrency must not be negative")
+	check(c.Parser.AdHocMaxSize > 0 && c.Parser.AdHocMaxSize <= maxPDFSize, "parser.adHocMaxSize must be between 1 and %v bytes", maxPDFSize)
+	for _, u := range c.Webhooks.URLs {
+		check(isHTTPURL(u), "webhooks.urls: %q is not an absolute http(s) url", u)
+	}
+	check(len(c.Webhooks.URLs) == 0 || c.Webhooks.Secret != "", "webhooks.urls requires webhooks.secret")
+	check(c.Chat.WebhookURL == "" || isHTTPURL(c.Chat.WebhookURL), "chat.webhookURL %q is not an absolute http(s) url", c.Chat.WebhookURL)
+	check(isTimeOfDay(c.Chat.PostTime), "chat.postTime %q is not in the format hh:mm", c.Chat.PostTime)
+	check(c.MQTT.Broker == "" || (c.MQTT.TopicToday != "" && c.MQTT.TopicTomorrow != ""), "mqtt topics must not be empty")
+	if c.SMTP.Host != "" {
+		check(c.SMTP.Port > 0 && c.SMTP.Port < 65536, "smtp.port %v is out of range", c.SMTP.Port)
+		check(c.SMTP.From != "", "smtp.from is required")
+		check(c.PublicURL != "", "smtp requires publicURL for the unsubscribe links")
+	}
+	check(isTimeOfDay(c.SMTP.DigestTime), "smtp.digestTime %q is not in the format hh:mm", c.SMTP.DigestTime)
+	keys := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, k := range c.API.Keys {
+		check(k.Name != "" && !names[k.Name], "api.keys: name %q is empty or not unique", k.Name)
+		check(len(k.Key) >= 16 && !keys[k.Key], "api.keys: key of %q must be unique and have at least 16 characters", k.Name)
+		check(k.DailyQuota >= 0 && k.RateLimit >= 0 && k.Burst >= 0, "api.keys: limits of %q must not be negative", k.Name)
+		check(k.RateLimit == 0 || k.Burst > 0, "api.keys: rateLimit of %q requires burst", k.Name)
+		names[k.Name] = true
+		keys[k.Key] = true
+	}
+	check(!c.API.RequireKey || len(c.API.Keys) > 0, "api.requireKey requires api.keys")
+	check(c.API.RateLimit >= 0, "api.rateLimit must not be negative")
+	check(c.API.RateLimit == 0 || c.API.Burst > 0, "api.burst must be positive")
+	for _, o := range c.API.CORS.AllowedOrigins {
+		u, err := url.Parse(o)
+		check(o == "*" || (err == nil && isHTTPURL(o) && u.Path == "" && u.RawQuery == ""), "api.cors.allowedOrigins: %q is neither * nor an origin like https://intranet.example.org", o)
+	}
+	check(c.API.CORS.MaxAge.Duration >= 0, "api.cors.maxAge must not be negative")
+	check(c.Tracing.Exporter == "" || c.Tracing.Exporter == "otlp" || c.Tracing.Exporter == "stdout", "tracing.exporter must be otlp, stdout or empty")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/*
+restartRequired, returns the settings that differ from old but are only applied on restart
+*/
+func (c *Config) restartRequired(old *Config) []string {
+	res := make([]string, 0)
+	for name, changed := range map[string]bool{
+		"server":    !reflect.DeepEqual(c.Server, old.Server),
+		"publicURL": c.PublicURL != old.PublicURL,
+		"dataDir":   c.DataDir != old.DataDir,
+		"parser":    c.Parser != old.Parser,
+		"mqtt":      c.MQTT != old.MQTT,
+		"smtp":      c.SMTP != old.SMTP,
+		"tracing":   c.Tracing != old.Tracing,
+	} {
+		if changed {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+/*
+config, returns the active configuration. Falls back to the defaults if none has been loaded
+*/
+func (app *application) config() *Config {
+	app.cfgLock.RLock()
+	defer app.cfgLock.RUnlock()
+	if app.cfg == nil {
+		return defaultConfig()
+	}
+	return app.cfg
+}
+
+/*
+reload, reloads the config file and the tls certificate and applies the settings that are safe to change at
+runtime: log level, menu source, refresh window, schedule, notification targets, the tokens and the api settings. Changes to other settings are logged
+and take effect on the next restart. If the new config is invalid, the old one stays active
+*/
+func (app *application) reload() error {
+	old := app.config()
+	cfg, err := loadConfig(app.cfgPath, os.Getenv)
+	if err != nil {
+		return fmt.Errorf("reload: %v", err)
+	}
+	//build everything that can fail before applying anything, so that a failed reload changes nothing
+	hooks, err := staticWebhooks(cfg.Webhooks.URLs, cfg.Webhooks.Secret)
+	if err != nil {
+		return fmt.Errorf("reload: %v", err)
+	}
+	scheduler, err := app.newScheduler(cfg)
+	if err != nil {
+		return fmt.Errorf("reload: %v", err)
+	}
+	app.webhooks.replaceStatic(hooks)
+	app.startScheduler(scheduler)
+	if app.certs != nil {
+		if err := app.certs.Reload(); err != nil {
+			app.logger.Error("failed to reload tls certificate", "error", err)
+		}
+	}
+	//validated by loadConfig
+	level, _ := parseLogLevel(cfg.LogLevel)
+	app.logger.SetLevel(level)
+	app.menuModel.Configure(cfg.Menu.SourceURL, cfg.Menu.DaysAhead)
+
+	app.cfgLock.Lock()
+	app.cfg = cfg
+	app.cfgLock.Unlock()
+
+	if changed := cfg.restartRequired(old); len(changed) > 0 {
+		app.logger.Warn("config changes require a restart", "settings", strings.Join(changed, ","))
+	}
+	app.logger.Info("reloaded config", "path", app.cfgPath)
+	return nil
+}
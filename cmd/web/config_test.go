@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	type testCase struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string
+		check   func(t *testing.T, cfg *Config)
+	}
+
+	tests := []*testCase{
+		{
+			name: "Defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Listen[0] != ":8080" || cfg.Menu.RefreshTime != "01:00" || cfg.Menu.DaysAhead != 7 ||
+					cfg.Menu.SourceURL != MenuBaseURL || cfg.Server.WriteTimeout.Duration != 10*time.Second {
+					t.Errorf("Unexpected defaults %+v\n", cfg)
+				}
+			},
+		},
+		{
+			name: "File",
+			file: "server:\n  listen: \":9090\"\n  readTimeout: 3s\nmenu:\n  refreshTime: \"02:30\"\n  daysAhead: 14\nparser:\n  commandTimeout: 30s\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Listen[0] != ":9090" || cfg.Server.ReadTimeout.Duration != 3*time.Second ||
+					cfg.Menu.RefreshTime != "02:30" || cfg.Menu.DaysAhead != 14 || cfg.Parser.CommandTimeout.Duration != 30*time.Second {
+					t.Errorf("File not applied %+v\n", cfg)
+				}
+				if cfg.Server.IdleTimeout.Duration != time.Minute {
+					t.Errorf("Expected default for missing setting got %v\n", cfg.Server.IdleTimeout)
+				}
+			},
+		},
+		{
+			name: "Env overrides file",
+			file: "logLevel: debug\nwebhooks:\n  secret: s3cret\n",
+			env:  map[string]string{ENV_LOG_LEVEL: "warn", ENV_WEBHOOK_URLS: "https://a.example.org,https://b.example.org", ENV_USE_SSL: "true", ENV_SSL_CERT_PATH: "cert.pem", ENV_SSL_PRIVKEY_PATH: "key.pem"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.LogLevel != "warn" || len(cfg.Webhooks.URLs) != 2 || !cfg.Server.UseSSL || cfg.Webhooks.Secret != "s3cret" {
+					t.Errorf("Env not applied %+v\n", cfg)
+				}
+			},
+		},
+		{name: "Unknown setting", file: "menu:\n  refreshtime: \"02:30\"\n", wantErr: "refreshtime"},
+		{name: "Invalid duration", file: "server:\n  idleTimeout: forever\n", wantErr: "forever"},
+		{name: "Zero stream timeout", file: "server:\n  streamTimeout: 0s\n", wantErr: "server timeouts"},
+		{name: "Invalid env", env: map[string]string{ENV_SMTP_PORT: "smtp"}, wantErr: ENV_SMTP_PORT},
+		{
+			name: "Listen list",
+			file: "server:\n  listen: [\"tcp6://[::1]:8080\", \"unix:/run/menu.sock\"]\n",
+			env:  map[string]string{ENV_USE_SSL: "true", ENV_SSL_CERT_PATH: "cert.pem", ENV_SSL_PRIVKEY_PATH: "key.pem", ENV_REDIRECT_LISTEN: ":80"},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.Server.Listen) != 2 || cfg.Server.Listen[1] != "unix:/run/menu.sock" || cfg.Server.RedirectListen[0] != ":80" {
+					t.Errorf("Unexpected listen addresses %v %v\n", cfg.Server.Listen, cfg.Server.RedirectListen)
+				}
+			},
+		},
+		{name: "Invalid listen address", env: map[string]string{ENV_SERVER_LISTEN: ":8080,udp://:53"}, wantErr: "udp://:53"},
+		{name: "Redirect without ssl", env: map[string]string{ENV_REDIRECT_LISTEN: ":80"}, wantErr: "server.redirectListen"},
+		{name: "Invalid time", file: "menu:\n  refreshTime: \"25:00\"\n", wantErr: "menu.refreshTime"},
+		{name: "SSL without cert", env: map[string]string{ENV_USE_SSL: "true"}, wantErr: "server.useSSL"},
+		{name: "Webhooks without secret", file: "webhooks:\n  urls: [\"https://a.example.org\"]\n", wantErr: "webhooks.secret"},
+		{
+			name: "API",
+			file: "api:\n  requireKey: true\n  keys:\n    - name: signage\n      key: 0123456789abcdef\n      dailyQuota: 1000\n  cors:\n    allowedOrigins: https://intranet.example.org\n",
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.API.Keys) != 1 || cfg.API.Keys[0].DailyQuota != 1000 || cfg.API.RateLimit != 120 ||
+					cfg.API.CORS.AllowedOrigins[0] != "https://intranet.example.org" || cfg.API.CORS.MaxAge.Duration != 10*time.Minute {
+					t.Errorf("Unexpected api settings %+v\n", cfg.API)
+				}
+			},
+		},
+		{name: "Short api key", file: "api:\n  keys:\n    - name: signage\n      key: secret\n", wantErr: "api.keys: key of \"signage\""},
+		{name: "Require key without keys", file: "api:\n  requireKey: true\n", wantErr: "api.requireKey"},
+		{name: "Invalid origin", file: "api:\n  cors:\n    allowedOrigins: [\"https://intranet.example.org/menu\"]\n", wantErr: "api.cors.allowedOrigins"},
+		{name: "Multiple errors", file: "logLevel: verbose\nmenu:\n  daysAhead: 0\n", wantErr: "logLevel \"verbose\" must be one of debug, info, warn and error; menu.daysAhead"},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				path := ""
+				if tc.file != "" {
+					path = filepath.Join(t.TempDir(), "config.yaml")
+					if err := ioutil.WriteFile(path, []byte(tc.file), 0600); err != nil {
+						t.Fatalf("Unexpected error: %v\n", err)
+					}
+				}
+				cfg, err := loadConfig(path, func(key string) string { return tc.env[key] })
+				if tc.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Fatalf("Expected error containing %q got %v\n", tc.wantErr, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				tc.check(t, cfg)
+			})
+		}(v)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+	writeConfig("dataDir: " + dir + "\n")
+	cfg, err := loadConfig(path, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+	webhooks, err := NewWebhookNotifier(dir, nil, "", "", discard, discard)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	buf := new(bytes.Buffer)
+	app := &application{
+		logger:    newStructuredLogger(buf, levelInfo),
+		errorLog:  discard,
+		infoLog:   discard,
+		cfg:       cfg,
+		cfgPath:   path,
+		menuModel: &MenuCache{},
+		webhooks:  webhooks,
+	}
+	if err := app.scheduleJobs(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	defer func() { app.scheduler.Stop() }()
+	oldScheduler := app.scheduler
+
+	writeConfig("dataDir: " + dir + "\nlogLevel: error\nserver:\n  listen: \":9090\"\nmenu:\n  refreshTime: \"03:15\"\n  daysAhead: 3\n" +
+		"webhooks:\n  urls: [\"https://a.example.org\"]\n  secret: s3cret\n")
+	if err := app.reload(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if app.config().Menu.RefreshTime != "03:15" {
+		t.Errorf("Config not replaced\n")
+	}
+	if app.scheduler == oldScheduler || len(app.scheduler.Jobs()) != 1 {
+		t.Errorf("Expected new scheduler with refresh job\n")
+	}
+	if app.menuModel.daysAhead != 3 {
+		t.Errorf("Expected daysAhead 3 got %v\n", app.menuModel.daysAhead)
+	}
+	if hooks := webhooks.List(); len(hooks) != 1 || hooks[0].URL != "https://a.example.org" {
+		t.Errorf("Static webhooks not replaced: %v\n", hooks)
+	}
+	//the level is error now, so the info entry about the reload is discarded
+	if out := buf.String(); strings.Contains(out, "reloaded config") {
+		t.Errorf("Log level not applied: %v\n", out)
+	}
+
+	writeConfig("menu:\n  refreshTime: noon\n")
+	if err := app.reload(); err == nil {
+		t.Fatalf("Expected error for invalid config\n")
+	}
+	if app.config().Menu.RefreshTime != "03:15" {
+		t.Errorf("Invalid config must not replace the active one\n")
+	}
+
+	//reload builds the scheduler and the static webhooks before applying them
+	running := app.scheduler
+	scheduler, err := app.newScheduler(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if app.scheduler != running || scheduler == running {
+		t.Errorf("Expected the running scheduler to be kept\n")
+	}
+	if _, err := staticWebhooks([]string{"https://b.example.org"}, ""); err == nil {
+		t.Errorf("Expected error for webhook urls without secret\n")
+	}
+	if hooks := webhooks.List(); len(hooks) != 1 || hooks[0].URL != "https://a.example.org" {
+		t.Errorf("Static webhooks must not be replaced before the reload is applied: %v\n", hooks)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/snabb/isoweek"
+)
+
+/*
+unknownCorrectionError is returned when a correction id does not exist
+*/
+var unknownCorrectionError = errors.New("correction not found")
+
+/*
+correctableFields, are the dish fields a Correction may override
+*/
+var correctableFields = map[string]func(d *parser.Dish, value string){
+	"title":       func(d *parser.Dish, v string) { d.Title = v },
+	"description": func(d *parser.Dish, v string) { d.Description = v },
+	"price":       func(d *parser.Dish, v string) { d.Price = v },
+	"kcal":        func(d *parser.Dish, v string) { d.Kcal = v },
+	"type":        func(d *parser.Dish, v string) { d.Type = v },
+}
+
+/*
+Correction, overrides fields of the dish in Column on Day of Week. It is applied on top of the parser output
+and survives re-parsing of the plan
+*/
+type Correction struct {
+	ID string `json:"id"`
+	//iso week, e.g. 2020-W47
+	Week string `json:"week"`
+	//iso weekday, 1 is Monday and 7 is Sunday
+	Day    int `json:"day"`
+	Column int `json:"column"`
+	//field name to corrected value, see correctableFields
+	Fields  map[string]string `json:"fields"`
+	Author  string            `json:"author,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+/*
+correctionAudit, is an entry of the append only audit log of all changes to corrections
+*/
+type correctionAudit struct {
+	Time time.Time `json:"time"`
+	//"set" or "remove"
+	Action string `json:"action"`
+	Author string `json:"author,omitempty"`
+	//state before the change, nil for new corrections
+	Before *Correction `json:"before,omitempty"`
+	//state after the change, nil for removed corrections
+	After *Correction `json:"after,omitempty"`
+}
+
+type correctionKey struct {
+	year   int
+	week   int
+	day    int
+	column int
+}
+
+/*
+CorrectionStore, persists the manual corrections of dishes
+*/
+type CorrectionStore struct {
+	lock        sync.Mutex
+	corrections []*Correction
+	byKey       map[correctionKey]*Correction
+	path        string
+	auditPath   string
+}
+
+/*
+NewCorrectionStore, loads the corrections persisted in dataDir
+*/
+func NewCorrectionStore(dataDir string) (*CorrectionStore, error) {
+	s := &CorrectionStore{
+		corrections: make([]*Correction, 0),
+		path:        filepath.Join(dataDir, "corrections.json"),
+		auditPath:   filepath.Join(dataDir, "corrections-audit.log"),
+	}
+	if err := loadJSON(s.path, &s.corrections); err != nil {
+		return nil, fmt.Errorf("NewCorrectionStore: %v", err)
+	}
+	if err := s.index(); err != nil {
+		return nil, fmt.Errorf("NewCorrectionStore: %v", err)
+	}
+	return s, nil
+}
+
+/*
+isoWeekday, returns the iso weekday of t, 1 is Monday and 7 is Sunday
+*/
+func isoWeekday(t time.Time) int {
+	if t.Weekday() == time.Sunday {
+		return 7
+	}
+	return int(t.Weekday())
+}
+
+func newCorrectionKey(week string, day, column int) (correctionKey, error) {
+	year, w, err := parseISOWeek(week)
+	if err != nil {
+		return correctionKey{}, err
+	}
+	if day < 1 || day > 7 {
+		return correctionKey{}, fmt.Errorf("%w: day must be between 1 (Monday) and 7 (Sunday)", badRequestError)
+	}
+	if column < 0 {
+		return correctionKey{}, fmt.Errorf("%w: column must not be negative", badRequestError)
+	}
+	return correctionKey{year: year, week: w, day: day, column: column}, nil
+}
+
+/*
+index, rebuilds s.byKey. Caller must hold s.lock
+*/
+func (s *CorrectionStore) index() error {
+	byKey := make(map[correctionKey]*Correction, len(s.corrections))
+	for _, c := range s.corrections {
+		key, err := newCorrectionKey(c.Week, c.Day, c.Column)
+		if err != nil {
+			return fmt.Errorf("correction %v: %v", c.ID, err)
+		}
+		byKey[key] = c
+	}
+	s.byKey = byKey
+	return nil
+}
+
+/*
+List, returns all corrections
+*/
+func (s *CorrectionStore) List() []*Correction {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]*Correction, len(s.corrections))
+	copy(res, s.corrections)
+	return res
+}
+
+/*
+Set, stores fields as correction for the dish in column on day of week. Fields of an existing correction for the
+same dish are merged, an empty value removes the override of a field
+*/
+func (s *CorrectionStore) Set(week string, day, column int, fields map[string]string, author, comment string) (*Correction, error) {
+	key, err := newCorrectionKey(week, day, column)
+	if err != nil {
+		return nil, fmt.Errorf("Set: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Set: %w: no fields to correct", badRequestError)
+	}
+	for name := range fields {
+		if _, ok := correctableFields[name]; !ok {
+			return nil, fmt.Errorf("Set: %w: field %q cannot be corrected", badRequestError, name)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	old := s.byKey[key]
+	c := &Correction{
+		Week:    formatISOWeek(key.year, key.week),
+		Day:     day,
+		Column:  column,
+		Fields:  make(map[string]string),
+		Author:  author,
+		Comment: comment,
+		Created: now,
+		Updated: now,
+	}
+	if old != nil {
+		c.ID = old.ID
+		c.Created = old.Created
+		for name, v := range old.Fields {
+			c.Fields[name] = v
+		}
+	} else if c.ID, err = randomID(8); err != nil {
+		return nil, fmt.Errorf("Set: %v", err)
+	}
+	for name, v := range fields {
+		if v == "" {
+			delete(c.Fields, name)
+		} else {
+			c.Fields[name] = v
+		}
+	}
+
+	corrections := make([]*Correction, 0, len(s.corrections)+1)
+	for _, other := range s.corrections {
+		if other != old {
+			corrections = append(corrections, other)
+		}
+	}
+	entry := &correctionAudit{Time: now, Action: "set", Author: author, Before: old, After: c}
+	if len(c.Fields) > 0 {
+		corrections = append(corrections, c)
+	} else {
+		//all overrides have been removed
+		entry.Action, entry.After = "remove", nil
+	}
+	if err := s.replace(corrections, entry); err != nil {
+		return nil, fmt.Errorf("Set: %v", err)
+	}
+	return c, nil
+}
+
+/*
+Remove, deletes the correction with id
+*/
+func (s *CorrectionStore) Remove(id, author string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, c := range s.corrections {
+		if c.ID == id {
+			corrections := make([]*Correction, 0, len(s.corrections)-1)
+			corrections = append(corrections, s.corrections[:i]...)
+			corrections = append(corrections, s.corrections[i+1:]...)
+			if err := s.replace(corrections, &correctionAudit{Time: time.Now(), Action: "remove", Author: author, Before: c}); err != nil {
+				return fmt.Errorf("Remove: %v", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Remove: %w: %v", unknownCorrectionError, id)
+}
+
+/*
+replace, persists corrections and records entry in the audit log. Caller must hold s.lock
+*/
+func (s *CorrectionStore) replace(corrections []*Correction, entry *correctionAudit) error {
+	if err := saveJSON(s.path, corrections); err != nil {
+		return err
+	}
+	s.corrections = corrections
+	if err := s.index(); err != nil {
+		return err
+	}
+	return appendJSONLine(s.auditPath, entry)
+}
+
+/*
+Audit, returns the last limit entries of the audit log, newest first
+*/
+func (s *CorrectionStore) Audit(limit int) ([]*correctionAudit, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, err := os.Open(s.auditPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*correctionAudit{}, nil
+		}
+		return nil, fmt.Errorf("Audit: %v", err)
+	}
+	defer f.Close()
+
+	all := make([]*correctionAudit, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &correctionAudit{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("Audit: corrupt log entry: %v", err)
+		}
+		all = append(all, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Audit: %v", err)
+	}
+
+	res := make([]*correctionAudit, 0, limit)
+	for i := len(all) - 1; i >= 0 && len(res) < limit; i-- {
+		res = append(res, all[i])
+	}
+	return res, nil
+}
+
+/*
+Apply, returns dishes with all matching corrections applied and the names of the corrected fields by
+parser.Dish.ID. Corrected dishes are copies, dishes is not modified. Corrections with a title for a column without
+parsed dish add the missing dish, if dishes contains other dishes of the same week. A nil CorrectionStore returns
+dishes unchanged
+*/
+func (s *CorrectionStore) Apply(dishes []*parser.Dish) ([]*parser.Dish, map[string][]string) {
+	edited := make(map[string][]string)
+	if s == nil {
+		return dishes, edited
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]*parser.Dish, 0, len(dishes))
+	applied := make(map[correctionKey]bool)
+	weeks := make(map[correctionKey]bool)
+	for _, d := range dishes {
+		year, week := d.Date.ISOWeek()
+		weeks[correctionKey{year: year, week: week}] = true
+		key := correctionKey{year: year, week: week, day: isoWeekday(d.Date), column: d.ColID()}
+		c, ok := s.byKey[key]
+		if !ok {
+			res = append(res, d)
+			continue
+		}
+		corrected := *d
+		edited[corrected.ID()] = applyCorrection(&corrected, c)
+		res = append(res, &corrected)
+		applied[key] = true
+	}
+
+	for key, c := range s.byKey {
+		if applied[key] || c.Fields["title"] == "" || !weeks[correctionKey{year: key.year, week: key.week}] {
+			continue
+		}
+		date := isoweek.StartTime(key.year, key.week, time.Local).AddDate(0, 0, key.day-1)
+		added := parser.NewDish(date, key.column)
+		edited[added.ID()] = applyCorrection(added, c)
+		res = append(res, added)
+	}
+	return res, edited
+}
+
+/*
+applyCorrection, overrides the fields of d with those of c and returns their sorted names
+*/
+func applyCorrection(d *parser.Dish, c *Correction) []string {
+	edited := make([]string, 0, len(c.Fields))
+	for name, v := range c.Fields {
+		correctableFields[name](d, v)
+		edited = append(edited, name)
+	}
+	sort.Strings(edited)
+	return edited
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestCorrectionStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCorrectionStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	type testCase struct {
+		name    string
+		week    string
+		day     int
+		column  int
+		fields  map[string]string
+		wantErr error
+	}
+
+	tests := []*testCase{
+		{name: "Price", week: "2020-W47", day: 1, column: 0, fields: map[string]string{"price": "€ 4,80 / € 6,00"}},
+		{name: "Merge title", week: "2020-W47", day: 1, column: 0, fields: map[string]string{"title": "Schwarzwurzelgemüse"}},
+		{name: "Unknown field", week: "2020-W47", day: 1, column: 0, fields: map[string]string{"date": "2020-11-17"}, wantErr: badRequestError},
+		{name: "Invalid week", week: "47", day: 1, column: 0, fields: map[string]string{"price": "€ 1,00"}, wantErr: badRequestError},
+		{name: "Invalid day", week: "2020-W47", day: 0, column: 0, fields: map[string]string{"price": "€ 1,00"}, wantErr: badRequestError},
+		{name: "No fields", week: "2020-W47", day: 1, column: 0, wantErr: badRequestError},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := s.Set(tc.week, tc.day, tc.column, tc.fields, "admin", "")
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Expected error %v got %v\n", tc.wantErr, err)
+				}
+			})
+		}(v)
+	}
+
+	corrections := s.List()
+	if len(corrections) != 1 || len(corrections[0].Fields) != 2 {
+		t.Fatalf("Expected a single merged correction got %v\n", corrections)
+	}
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	parsed := []*parser.Dish{{Title: "Schwarzwurzelgmüse", Price: "€ 4,8O", Type: "Wok Station", Date: monday}}
+	got, edited := s.Apply(parsed)
+	if got[0].Title != "Schwarzwurzelgemüse" || got[0].Price != "€ 4,80 / € 6,00" || !reflect.DeepEqual(edited[got[0].ID()], []string{"price", "title"}) {
+		t.Errorf("Correction not applied: %+v %v\n", got[0], edited)
+	}
+	if parsed[0].Title != "Schwarzwurzelgmüse" {
+		t.Errorf("Apply must not modify the parser output\n")
+	}
+	got, edited = s.Apply([]*parser.Dish{{Title: "Tuesday", Date: monday.AddDate(0, 0, 1)}})
+	if edited[got[0].ID()] != nil {
+		t.Errorf("Correction applied to the wrong day\n")
+	}
+	if len(got) != 2 || got[1].Title != "Schwarzwurzelgemüse" || !got[1].Date.Equal(monday) || got[1].ColID() != 0 {
+		t.Errorf("Expected the corrected dish to be added to the week got %v\n", got)
+	}
+	if got, _ := s.Apply([]*parser.Dish{{Title: "Next week", Date: monday.AddDate(0, 0, 7)}}); len(got) != 1 {
+		t.Errorf("Correction added to the wrong week\n")
+	}
+
+	//persisted
+	reloaded, err := NewCorrectionStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if got, _ := reloaded.Apply(parsed); got[0].Title != "Schwarzwurzelgemüse" {
+		t.Errorf("Corrections not persisted\n")
+	}
+
+	if err := s.Remove(corrections[0].ID, "admin"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := s.Remove(corrections[0].ID, "admin"); !errors.Is(err, unknownCorrectionError) {
+		t.Errorf("Expected %v got %v\n", unknownCorrectionError, err)
+	}
+	audit, err := s.Audit(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(audit) != 3 || audit[0].Action != "remove" || audit[0].After != nil || audit[2].Before != nil {
+		t.Fatalf("Unexpected audit log %v\n", audit)
+	}
+	if audit[1].Before.Fields["title"] != "" || audit[1].After.Fields["title"] == "" {
+		t.Errorf("Expected audit entry of the merge to contain the previous state\n")
+	}
+}
+
+func TestAdminCorrections(t *testing.T) {
+	store, err := NewCorrectionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		corrections:  store,
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{{Title: "Rumpsteak", Price: "€ 5,9O", Type: "Wok Station", Date: monday}}, nil, time.Now())
+	mc.cacheWeek(2020, 47, mc.plans[weekKey{year: 2020, week: 47}].Dishes)
+
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	app := &application{
+		cfg:         cfg,
+		infoLog:     log.New(ioutil.Discard, "", 0),
+		errorLog:    log.New(ioutil.Discard, "", 0),
+		menuModel:   mc,
+		corrections: store,
+	}
+	srv := app.routes()
+
+	body := []byte(`{"week": "2020-W47", "day": 1, "column": 0, "fields": {"price": "€ 5,90 / € 7,40"}, "author": "kitchen"}`)
+	r := httptest.NewRequest(http.MethodPost, "/admin/corrections", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v: %v\n", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil))
+	var week struct {
+		Dishes []*v1Dish `json:"dishes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &week); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(week.Dishes) != 1 || !week.Dishes[0].Edited || week.Dishes[0].Price.Employee == nil || *week.Dishes[0].Price.Employee != 590 {
+		t.Errorf("Expected corrected and edited dish got %v\n", rec.Body.String())
+	}
+	if dishes, _ := mc.CachedMenu(monday); dishes[0].Price != "€ 5,90 / € 7,40" {
+		t.Errorf("Expected correction to be applied to the cached dishes\n")
+	}
+	if plan, _ := mc.GetWeek(2020, 47); len(plan.Warnings) != 1 {
+		t.Errorf("Expected only the missing kcal warning got %v\n", plan.Warnings)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+/*
+unknownSubscriberError is returned when a subscriber id or token is not registered
+*/
+var unknownSubscriberError = errors.New("subscriber not found")
+
+/*
+Subscriber, receives the weekly digest via email
+*/
+type Subscriber struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	//only include the vegetarian column in the digest
+	VegetarianOnly bool `json:"vegetarianOnly"`
+	//secret part of the subscription management link
+	Token   string    `json:"token"`
+	Created time.Time `json:"created"`
+}
+
+/*
+SubscriberStore, is the persistent list of digest subscribers
+*/
+type SubscriberStore struct {
+	lock        sync.Mutex
+	subscribers []*Subscriber
+	path        string
+}
+
+/*
+NewSubscriberStore, loads the subscribers persisted in dataDir
+*/
+func NewSubscriberStore(dataDir string) (*SubscriberStore, error) {
+	s := &SubscriberStore{
+		subscribers: make([]*Subscriber, 0),
+		path:        filepath.Join(dataDir, "subscribers.json"),
+	}
+	if err := loadJSON(s.path, &s.subscribers); err != nil {
+		return nil, fmt.Errorf("NewSubscriberStore: %v", err)
+	}
+	return s, nil
+}
+
+/*
+List, returns copies of all subscribers
+*/
+func (s *SubscriberStore) List() []*Subscriber {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]*Subscriber, 0, len(s.subscribers))
+	for _, v := range s.subscribers {
+		tmp := *v
+		res = append(res, &tmp)
+	}
+	return res
+}
+
+/*
+Add, subscribes email to the digest
+*/
+func (s *SubscriberStore) Add(email string, vegetarianOnly bool) (*Subscriber, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %w: invalid email address %q", badRequestError, email)
+	}
+	id, err := randomID(8)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	token, err := randomID(16)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	sub := &Subscriber{ID: id, Email: addr.Address, VegetarianOnly: vegetarianOnly, Token: token, Created: time.Now()}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, v := range s.subscribers {
+		if v.Email == sub.Email {
+			return nil, fmt.Errorf("Add: %w: %v is already subscribed", badRequestError, sub.Email)
+		}
+	}
+	s.subscribers = append(s.subscribers, sub)
+	if err := saveJSON(s.path, s.subscribers); err != nil {
+		s.subscribers = s.subscribers[:len(s.subscribers)-1]
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	tmp := *sub
+	return &tmp, nil
+}
+
+/*
+update, applies f to the first subscriber for which match returns true and persists the result. If f returns
+true the subscriber is removed instead
+*/
+func (s *SubscriberStore) update(match func(*Subscriber) bool, f func(*Subscriber) (remove bool)) (*Subscriber, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, v := range s.subscribers {
+		if !match(v) {
+			continue
+		}
+		old := make([]*Subscriber, len(s.subscribers))
+		copy(old, s.subscribers)
+		updated := *v
+		if f(&updated) {
+			s.subscribers = append(s.subscribers[:i:i], s.subscribers[i+1:]...)
+		} else {
+			s.subscribers[i] = &updated
+		}
+		if err := saveJSON(s.path, s.subscribers); err != nil {
+			s.subscribers = old
+			return nil, err
+		}
+		return &updated, nil
+	}
+	return nil, unknownSubscriberError
+}
+
+/*
+Remove, unsubscribes the subscriber with id
+*/
+func (s *SubscriberStore) Remove(id string) error {
+	_, err := s.update(func(v *Subscriber) bool { return v.ID == id }, func(*Subscriber) bool { return true })
+	if err != nil {
+		return fmt.Errorf("Remove: %w", err)
+	}
+	return nil
+}
+
+/*
+ByToken, returns the subscriber with the management token
+*/
+func (s *SubscriberStore) ByToken(token string) (*Subscriber, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, v := range s.subscribers {
+		if v.Token == token {
+			tmp := *v
+			return &tmp, nil
+		}
+	}
+	return nil, fmt.Errorf("ByToken: %w", unknownSubscriberError)
+}
+
+/*
+UnsubscribeToken, removes the subscriber with the management token
+*/
+func (s *SubscriberStore) UnsubscribeToken(token string) error {
+	_, err := s.update(func(v *Subscriber) bool { return v.Token == token }, func(*Subscriber) bool { return true })
+	if err != nil {
+		return fmt.Errorf("UnsubscribeToken: %w", err)
+	}
+	return nil
+}
+
+/*
+SetFilterToken, changes the filters of the subscriber with the management token
+*/
+func (s *SubscriberStore) SetFilterToken(token string, vegetarianOnly bool) (*Subscriber, error) {
+	sub, err := s.update(func(v *Subscriber) bool { return v.Token == token }, func(v *Subscriber) bool {
+		v.VegetarianOnly = vegetarianOnly
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("SetFilterToken: %w", err)
+	}
+	return sub, nil
+}
+
+/*
+smtpConfig, configures the mail server used to send the digest
+*/
+type smtpConfig struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+/*
+digestData, is passed to the digest templates
+*/
+type digestData struct {
+	Year, Week     int
+	Days           []*dayView
+	VegetarianOnly bool
+	PlanURL        string
+	ManageURL      string
+}
+
+var digestFuncs = map[string]interface{}{
+	"weekday": func(t time.Time) string {
+		return weekdayNames[t.Weekday()]
+	},
+	"date": func(t time.Time) string {
+		return t.Format("02.01.2006")
+	},
+}
+
+/*
+DigestMailer, sends the weekly plan to all subscribers
+*/
+type DigestMailer struct {
+	cfg         *smtpConfig
+	subscribers *SubscriberStore
+	menuModel   *MenuCache
+	//public url of the service without trailing slash, used for links in the mail
+	baseURL      string
+	htmlTemplate *htmlTemplate.Template
+	textTemplate *template.Template
+	//delivers msg to the recipient, replaced in tests
+	send     func(to string, msg []byte) error
+	errorLog *log.Logger
+	infoLog  *log.Logger
+}
+
+/*
+NewDigestMailer, creates a DigestMailer sending via the smtp server in cfg
+*/
+func NewDigestMailer(cfg *smtpConfig, subscribers *SubscriberStore, mc *MenuCache, baseURL string, errorLog, infoLog *log.Logger) (*DigestMailer, error) {
+	htmlTmpl, err := htmlTemplate.New("digest.html.tmpl").Funcs(digestFuncs).ParseFS(uiFiles, "ui/templates/email/digest.html.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("NewDigestMailer: %v", err)
+	}
+	textTmpl, err := template.New("digest.txt.tmpl").Funcs(digestFuncs).ParseFS(uiFiles, "ui/templates/email/digest.txt.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("NewDigestMailer: %v", err)
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("NewDigestMailer: public url is required for unsubscribe links")
+	}
+	m := &DigestMailer{
+		cfg:          cfg,
+		subscribers:  subscribers,
+		menuModel:    mc,
+		baseURL:      baseURL,
+		htmlTemplate: htmlTmpl,
+		textTemplate: textTmpl,
+		errorLog:     errorLog,
+		infoLog:      infoLog,
+	}
+	m.send = func(to string, msg []byte) error {
+		var auth smtp.Auth
+		if cfg.username != "" {
+			auth = smtp.PlainAuth("", cfg.username, cfg.password, cfg.host)
+		}
+		return smtp.SendMail(net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port)), auth, cfg.from, []string{to}, msg)
+	}
+	return m, nil
+}
+
+/*
+buildMessage, renders the digest for sub as multipart/alternative mail with a html and a plain text part
+*/
+func (m *DigestMailer) buildMessage(sub *Subscriber, plan *WeekPlan, now time.Time) ([]byte, error) {
+	dishes := plan.Dishes
+	if sub.VegetarianOnly {
+		dishes = vegetarianDishes(dishes)
+	}
+	data := &digestData{
+		Year:           plan.Year,
+		Week:           plan.Week,
+		Days:           groupByDay(dishes),
+		VegetarianOnly: sub.VegetarianOnly,
+		PlanURL:        m.baseURL + "/plan/" + formatISOWeek(plan.Year, plan.Week),
+		ManageURL:      m.baseURL + "/subscription/" + sub.Token,
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	parts := []struct {
+		contentType string
+		execute     func(w *quotedprintable.Writer) error
+	}{
+		{"text/plain; charset=utf-8", func(w *quotedprintable.Writer) error { return m.textTemplate.Execute(w, data) }},
+		{"text/html; charset=utf-8", func(w *quotedprintable.Writer) error { return m.htmlTemplate.Execute(w, data) }},
+	}
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("buildMessage: %v", err)
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if err := p.execute(qw); err != nil {
+			return nil, fmt.Errorf("buildMessage: %v", err)
+		}
+		if err := qw.Close(); err != nil {
+			return nil, fmt.Errorf("buildMessage: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("buildMessage: %v", err)
+	}
+
+	msg := new(bytes.Buffer)
+	headers := [][2]string{
+		{"From", m.cfg.from},
+		{"To", sub.Email},
+		{"Subject", mime.QEncoding.Encode("utf-8", fmt.Sprintf("UKSH Bistro Lübeck: menu for week %v", plan.Week))},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+		{"List-Unsubscribe", "<" + data.ManageURL + "/unsubscribe>"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(msg, "%v: %v\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+/*
+SendAll, sends the plan of the current iso week to all subscribers. Weeks without plan are skipped
+*/
+func (m *DigestMailer) SendAll() {
+	year, week := time.Now().In(time.Local).ISOWeek()
+	plan, err := m.menuModel.GetWeek(year, week)
+	if err != nil {
+		m.errorLog.Printf("DigestMailer: no plan for this week, skipping digest: %v\n", err)
+		return
+	}
+	sent := 0
+	for _, sub := range m.subscribers.List() {
+		msg, err := m.buildMessage(sub, plan, time.Now())
+		if err != nil {
+			m.errorLog.Printf("DigestMailer: %v\n", err)
+			continue
+		}
+		if err := m.send(sub.Email, msg); err != nil {
+			m.errorLog.Printf("DigestMailer: failed to send digest to subscriber %v: %v\n", sub.ID, err)
+			continue
+		}
+		sent++
+	}
+	m.infoLog.Printf("Sent weekly digest to %v subscribers\n", sent)
+}
+
+/*
+SendText, sends a plain text mail with subject to the recipient, e.g. for alerts
+*/
+func (m *DigestMailer) SendText(to, subject, text string) error {
+	msg := new(bytes.Buffer)
+	headers := [][2]string{
+		{"From", m.cfg.from},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(msg, "%v: %v\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	qw := quotedprintable.NewWriter(msg)
+	if _, err := qw.Write([]byte(text)); err != nil {
+		return fmt.Errorf("SendText: %v", err)
+	}
+	if err := qw.Close(); err != nil {
+		return fmt.Errorf("SendText: %v", err)
+	}
+	if err := m.send(to, msg.Bytes()); err != nil {
+		return fmt.Errorf("SendText: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestDigestMailer_buildMessage(t *testing.T) {
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	plan := &WeekPlan{Year: 2020, Week: 47, Dishes: []*parser.Dish{
+		{Title: "Pasta-Pfanne", Type: "Wok Station", Date: monday},
+		{Title: "Gemüse-Curry", Type: vegetarianType, Date: monday},
+	}}
+	m, err := NewDigestMailer(&smtpConfig{from: "menu@example.org"}, nil, nil, "https://menu.example.org",
+		log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name           string
+		vegetarianOnly bool
+		expContent     []string
+		unexpContent   []string
+	}
+
+	tests := []*testCase{
+		{name: "All dishes", expContent: []string{"Pasta-Pfanne", "Gemüse-Curry"}},
+		{name: "Vegetarian only", vegetarianOnly: true, expContent: []string{"Gemüse-Curry"}, unexpContent: []string{"Pasta-Pfanne"}},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				sub := &Subscriber{ID: "1", Email: "jane@example.org", Token: "secret", VegetarianOnly: tc.vegetarianOnly}
+				raw, err := m.buildMessage(sub, plan, monday)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+				if err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if got, exp := msg.Header.Get("List-Unsubscribe"), "<https://menu.example.org/subscription/secret/unsubscribe>"; got != exp {
+					t.Errorf("Expected List-Unsubscribe %v got %v\n", exp, got)
+				}
+				mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+				if err != nil || mediaType != "multipart/alternative" {
+					t.Fatalf("Unexpected content type %v: %v\n", mediaType, err)
+				}
+
+				//multipart.Reader decodes quoted-printable parts
+				parts := multipart.NewReader(msg.Body, params["boundary"])
+				types := make([]string, 0)
+				for {
+					p, err := parts.NextPart()
+					if err != nil {
+						break
+					}
+					body, err := ioutil.ReadAll(p)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v\n", err)
+					}
+					types = append(types, strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0])
+					for _, c := range tc.expContent {
+						if !strings.Contains(string(body), c) {
+							t.Errorf("Expected %v in %v part\n", c, p.Header.Get("Content-Type"))
+						}
+					}
+					for _, c := range tc.unexpContent {
+						if strings.Contains(string(body), c) {
+							t.Errorf("Did not expect %v in %v part\n", c, p.Header.Get("Content-Type"))
+						}
+					}
+				}
+				if len(types) != 2 || types[0] != "text/plain" || types[1] != "text/html" {
+					t.Errorf("Expected plain text and html part got %v\n", types)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestSubscriptionPages(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "subscribers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	subscribers, err := NewSubscriberStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := subscribers.Add("Jane <jane@example.org>", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subscribers.Add("jane@example.org", true); err == nil {
+		t.Errorf("Expected error for duplicate subscription\n")
+	}
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		infoLog:       log.New(ioutil.Discard, "", 0),
+		errorLog:      log.New(ioutil.Discard, "", 0),
+		templateCache: templateCache,
+		subscribers:   subscribers,
+	}
+	srv := app.routes()
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/subscription/"+sub.Token, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "jane@example.org") {
+		t.Errorf("Unexpected response %v: %v\n", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/subscription/"+sub.Token, strings.NewReader("action=save&vegetarianOnly=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+
+	//filters are persisted
+	reloaded, err := NewSubscriberStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reloaded.ByToken(sub.Token); err != nil || !got.VegetarianOnly {
+		t.Errorf("Expected persisted vegetarian filter got %+v: %v\n", got, err)
+	}
+
+	//one-click unsubscribe as sent by mail clients
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/subscription/"+sub.Token+"/unsubscribe", strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+	if len(subscribers.List()) != 0 {
+		t.Errorf("Expected no subscribers after unsubscribe\n")
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/subscription/"+sub.Token, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v got %v\n", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+unknownFormatError is returned when a client requests a format we cannot encode
+*/
+var unknownFormatError = errors.New("unsupported format")
+
+/*
+dishEncoder, renders dishes in a single output format
+*/
+type dishEncoder struct {
+	//value of the "format" query parameter selecting this encoder
+	name string
+	//media types selecting this encoder via the Accept header. The first one is used as Content-Type
+	mediaTypes []string
+	encode     func(w io.Writer, dishes []*parser.Dish) error
+}
+
+/*
+dishEncoders, is the registry of all formats supported by the endpoints returning dishes. The first entry is
+the default
+*/
+var dishEncoders = []*dishEncoder{
+	{name: "json", mediaTypes: []string{"application/json"}, encode: encodeJSON},
+	{name: "csv", mediaTypes: []string{"text/csv"}, encode: encodeCSV},
+	{name: "text", mediaTypes: []string{"text/plain"}, encode: encodeText},
+	{name: "markdown", mediaTypes: []string{"text/markdown"}, encode: encodeMarkdown},
+	{name: "xml", mediaTypes: []string{"application/xml", "text/xml"}, encode: encodeXML},
+}
+
+/*
+encodeJSON, writes the same bytes as json.Marshal, so that bodies and ETags of /menu stay as before content
+negotiation
+*/
+func encodeJSON(w io.Writer, dishes []*parser.Dish) error {
+	response, err := json.Marshal(dishes)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(response)
+	return err
+}
+
+func encodeCSV(w io.Writer, dishes []*parser.Dish) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Date", "Type", "Title", "Description", "Price", "Kcal"}); err != nil {
+		return err
+	}
+	for _, d := range sortedDishes(dishes) {
+		record := []string{d.Date.Format("2006-01-02"), d.Type, d.Title, d.Description, strings.TrimSpace(d.Price), d.Kcal}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func encodeText(w io.Writer, dishes []*parser.Dish) error {
+	_, err := io.WriteString(w, dishesSummary(dishes))
+	return err
+}
+
+func encodeMarkdown(w io.Writer, dishes []*parser.Dish) error {
+	var b strings.Builder
+	for i, day := range groupByDay(dishes) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "**%v, %v**\n\n", weekdayNames[day.Date.Weekday()], day.Date.Format("02.01.2006"))
+		for _, d := range day.Dishes {
+			fmt.Fprintf(&b, "- **%v**: %v\n", d.Type, formatDish(d))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type xmlDishes struct {
+	XMLName xml.Name       `xml:"dishes"`
+	Dishes  []*parser.Dish `xml:"dish"`
+}
+
+func encodeXML(w io.Writer, dishes []*parser.Dish) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(xmlDishes{Dishes: dishes})
+}
+
+/*
+acceptedType, is a single media range from an Accept header
+*/
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+/*
+parseAccept, returns the media ranges of the Accept header value sorted by descending quality
+*/
+func parseAccept(header string) []acceptedType {
+	res := make([]acceptedType, 0)
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			res = append(res, acceptedType{mediaType: mediaType, q: q})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].q > res[j].q
+	})
+	return res
+}
+
+/*
+supportedFormats, returns the names of all dishEncoders
+*/
+func supportedFormats() string {
+	names := make([]string, 0, len(dishEncoders))
+	for _, v := range dishEncoders {
+		names = append(names, v.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+/*
+negotiateEncoder, selects the dishEncoder for r. The "format" query parameter takes precedence over the
+Accept header. Headers accepting any media type select json unless a supported format is among the most
+preferred ranges. Returns an error wrapping unknownFormatError if no supported format is acceptable
+*/
+func negotiateEncoder(r *http.Request) (*dishEncoder, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		for _, enc := range dishEncoders {
+			if enc.name == format {
+				return enc, nil
+			}
+		}
+		return nil, fmt.Errorf("negotiateEncoder: %w: format %q, supported formats are %v", unknownFormatError, format, supportedFormats())
+	}
+
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return dishEncoders[0], nil
+	}
+	ranges := parseAccept(header)
+	wildcard := false
+	for _, accepted := range ranges {
+		wildcard = wildcard || accepted.mediaType == "*/*"
+	}
+	for _, accepted := range ranges {
+		//clients accepting anything, e.g. browsers preferring html over application/xml, get the default unless
+		//they list a supported format among their most preferred ones
+		if accepted.mediaType == "*/*" || (wildcard && accepted.q < ranges[0].q) {
+			return dishEncoders[0], nil
+		}
+		partial := strings.HasSuffix(accepted.mediaType, "/*")
+		for _, enc := range dishEncoders {
+			for _, mediaType := range enc.mediaTypes {
+				if accepted.mediaType == mediaType ||
+					(partial && !wildcard && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted.mediaType, "*"))) {
+					return enc, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("negotiateEncoder: %w: accept %q, supported formats are %v", unknownFormatError, header, supportedFormats())
+}
+
+/*
+serveDishes, serves the dishes returned by get in the format negotiated with the client. Responses are cached
+per version of the menu cache, see serveVersioned
+*/
+func (app *application) serveDishes(w http.ResponseWriter, r *http.Request, get func() ([]*parser.Dish, error)) {
+	app.serveNegotiated(w, r, func(enc *dishEncoder) ([]byte, error) {
+		dishes, err := get()
+		if err != nil {
+			return nil, err
+		}
+		return encodeDishes(enc, dishes)
+	})
+}
+
+/*
+serveNegotiated, serves the body returned by render for the dishEncoder negotiated with the client. Responses
+are cached per version of the menu cache and format, see serveVersioned
+*/
+func (app *application) serveNegotiated(w http.ResponseWriter, r *http.Request, render func(enc *dishEncoder) ([]byte, error)) {
+	w.Header().Add("Vary", "Accept")
+	enc, err := negotiateEncoder(r)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+
+	app.serveVersioned(w, r, enc.name, func() (string, []byte, error) {
+		body, err := render(enc)
+		if err != nil {
+			return "", nil, err
+		}
+		return enc.mediaTypes[0] + "; charset=utf-8", body, nil
+	})
+}
+
+/*
+encodeDishes, returns dishes encoded with enc
+*/
+func encodeDishes(enc *dishEncoder, dishes []*parser.Dish) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := enc.encode(buf, dishes); err != nil {
+		return nil, fmt.Errorf("encodeDishes: failed to encode dishes as %v: %v", enc.name, err)
+	}
+	return buf.Bytes(), nil
+}
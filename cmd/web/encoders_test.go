@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestNegotiateEncoder(t *testing.T) {
+	type testCase struct {
+		name       string
+		url        string
+		accept     string
+		exp        string
+		shouldFail bool
+	}
+
+	tests := []*testCase{
+		{name: "No preference", url: "/menu/2020-11-16", exp: "json"},
+		{name: "Wildcard", url: "/menu/2020-11-16", accept: "*/*", exp: "json"},
+		{name: "Curl", url: "/menu/2020-11-16", accept: "text/plain", exp: "text"},
+		{name: "Quality", url: "/menu/2020-11-16", accept: "text/csv;q=0.5, text/markdown", exp: "markdown"},
+		{name: "Partial wildcard", url: "/menu/2020-11-16", accept: "image/png, text/*;q=0.1", exp: "csv"},
+		{name: "Browser", url: "/menu/2020-11-16", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8", exp: "json"},
+		{name: "Preferred over wildcard", url: "/menu/2020-11-16", accept: "text/csv, */*;q=0.1", exp: "csv"},
+		{name: "Partial wildcard with wildcard", url: "/menu/2020-11-16", accept: "text/*, */*;q=0.1", exp: "json"},
+		{name: "Text xml", url: "/menu/2020-11-16", accept: "text/xml", exp: "xml"},
+		{name: "Query beats header", url: "/menu/2020-11-16?format=csv", accept: "application/json", exp: "csv"},
+		{name: "Unknown query", url: "/menu/2020-11-16?format=pdf", shouldFail: true},
+		{name: "Unacceptable", url: "/menu/2020-11-16", accept: "image/png", shouldFail: true},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				r := httptest.NewRequest("GET", tc.url, nil)
+				if tc.accept != "" {
+					r.Header.Set("Accept", tc.accept)
+				}
+				got, err := negotiateEncoder(r)
+				if err != nil {
+					if !tc.shouldFail {
+						t.Errorf("Unexpected error: %v\n", err)
+					} else if !errors.Is(err, unknownFormatError) {
+						t.Errorf("Expected %v error but got %v\n", unknownFormatError, err)
+					}
+					return
+				}
+				if tc.shouldFail {
+					t.Errorf("Did not encounter expected error\n")
+				} else if got.name != tc.exp {
+					t.Errorf("Expected %v got %v\n", tc.exp, got.name)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	dishes := []*parser.Dish{{Title: "Pasta & Soße <vegan>", Type: "Wok Station", Date: time.Date(2020, 11, 16, 0, 0, 0, 0, time.UTC)}}
+	exp, err := json.Marshal(dishes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeJSON(buf, dishes); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Expected the bytes of json.Marshal %q got %q\n", exp, buf.Bytes())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+streamingUnsupportedError is returned if the response writer cannot flush partial responses
+*/
+var streamingUnsupportedError = errors.New("streaming unsupported")
+
+/*
+eventKeepAlive, interval of the comments that keep idle event streams open through proxies
+*/
+const eventKeepAlive = 25 * time.Second
+
+/*
+eventRetry, time in milliseconds after which browsers reconnect a closed event stream
+*/
+const eventRetry = 1000
+
+/*
+menuEvent, returns the id and the data of the menu event for date. The id changes with the version of the menu
+cache and the date, so that reconnecting clients only receive the menu if they missed a change
+*/
+func (app *application) menuEvent(date time.Time) (string, []byte, error) {
+	//never triggers a refresh, the stream must not wait for the UKSH website
+	dishes, _ := app.menuModel.CachedMenu(date)
+	data, err := json.Marshal(v1Day{Date: date.Format("2006-01-02"), Dishes: newV1Dishes(dishes, app.menuModel.DishInfo)})
+	if err != nil {
+		return "", nil, fmt.Errorf("menuEvent: %v", err)
+	}
+	return fmt.Sprintf("%x-%v", app.menuModel.Modified().UnixNano(), date.Format("2006-01-02")), data, nil
+}
+
+/*
+eventsHandler, streams today's menu as server-sent events. A "menu" event with the dishes in the format of
+/v1/menu/yyyy-mm-dd is sent on connect, after every change of the menu cache and at midnight. The stream ends
+after server.streamTimeout, browsers reconnect automatically and only receive the menu again if it changed
+*/
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.writeProblem(w, r, fmt.Errorf("eventsHandler: %w", streamingUnsupportedError))
+		return
+	}
+	//the stream outlives server.writeTimeout, which still bounds the last write
+	streamTimeout := app.config().Server.StreamTimeout.Duration
+	setWriteDeadline(w, streamTimeout+app.config().Server.WriteTimeout.Duration)
+
+	//watch before reading the menu, so that no change is missed
+	changes, stop := app.menuModel.Watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	//disables response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	lastID := r.Header.Get("Last-Event-ID")
+	send := func(date time.Time) error {
+		id, data, err := app.menuEvent(date)
+		if err != nil {
+			return err
+		}
+		if id == lastID {
+			return nil
+		}
+		lastID = id
+		if _, err := fmt.Fprintf(w, "id: %v\nevent: menu\ndata: %s\n\n", id, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(w, "retry: %v\n\n", eventRetry); err != nil {
+		return
+	}
+	today := roundToDay(time.Now().In(time.Local))
+	if err := send(today); err != nil {
+		app.errorLog.Printf("eventsHandler: %v\n", err)
+		return
+	}
+	flusher.Flush()
+
+	end := time.NewTimer(streamTimeout)
+	defer end.Stop()
+	midnight := time.NewTimer(time.Until(today.AddDate(0, 0, 1)))
+	defer midnight.Stop()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end.C:
+			return
+		case <-changes:
+			err = send(today)
+		case <-midnight.C:
+			today = today.AddDate(0, 0, 1)
+			midnight.Reset(time.Until(today.AddDate(0, 0, 1)))
+			err = send(today)
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err == nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			app.errorLog.Printf("eventsHandler: %v\n", err)
+			return
+		}
+	}
+}
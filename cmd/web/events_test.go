@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestEventsHandler(t *testing.T) {
+	today := roundToDay(time.Now().In(time.Local))
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{{Title: "Pasta-Pfanne", Type: "Wok Station", Date: today}}, nil, time.Now())
+	year, week := today.ISOWeek()
+	mc.cacheWeek(year, week, mc.plans[weekKey{year: year, week: week}].Dishes)
+	cfg := defaultConfig()
+	cfg.Server.WriteTimeout = duration{100 * time.Millisecond}
+	cfg.Server.StreamTimeout = duration{time.Second}
+	app := &application{
+		cfg:       cfg,
+		logger:    newStructuredLogger(ioutil.Discard, levelInfo),
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+	}
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	type event struct {
+		id, name string
+		day      v1Day
+	}
+	//reads events until the stream ends
+	stream := func(lastID string, events chan<- *event) {
+		defer close(events)
+		r, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/events", nil)
+		if err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+			return
+		}
+		if lastID != "" {
+			r.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+			return
+		}
+		defer res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Unexpected content type %v\n", ct)
+		}
+		ev := &event{}
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &ev.day); err != nil {
+					t.Errorf("Unexpected error: %v\n", err)
+				}
+			case line == "" && ev.name != "":
+				events <- ev
+				ev = &event{}
+			}
+		}
+	}
+
+	events := make(chan *event)
+	go stream("", events)
+	first := <-events
+	if first == nil || first.name != "menu" || first.day.Date != today.Format("2006-01-02") || len(first.day.Dishes) != 1 {
+		t.Fatalf("Unexpected first event %+v\n", first)
+	}
+	//the stream is not limited by the write timeout
+	time.Sleep(2 * cfg.Server.WriteTimeout.Duration)
+	mc.ApplyCorrections()
+	second := <-events
+	if second == nil || second.id == first.id || len(second.day.Dishes) != 1 {
+		t.Fatalf("Expected event for the change got %+v\n", second)
+	}
+	if ev, ok := <-events; ok {
+		t.Errorf("Expected end of stream got %+v\n", ev)
+	}
+
+	//a reconnecting client that has seen the current version gets no event
+	events = make(chan *event)
+	go stream(second.id, events)
+	if ev, ok := <-events; ok {
+		t.Errorf("Expected no event got %+v\n", ev)
+	}
+}
+
+func TestMenuEventDuringRefresh(t *testing.T) {
+	mc, finish := newRefreshingCache(t)
+	app := &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+	}
+	//new subscribers get the cached menu without waiting for the parser
+	notBlocked(t, func() {
+		if _, _, err := app.menuEvent(time.Now()); err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+	})
+	if err := finish(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+}
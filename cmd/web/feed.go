@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+const feedTitle = "UKSH Bistro Lübeck menu"
+
+/*
+weekdayNames, german names of the weekdays as used in the menu PDFs, indexed by time.Weekday
+*/
+var weekdayNames = [...]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"}
+
+/*
+baseURL, returns the url under which the service is reachable without trailing slash. Uses the configured
+public url if set and otherwise derives it from r
+*/
+func (app *application) baseURL(r *http.Request) string {
+	if u := app.config().PublicURL; u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+/*
+weekURL, returns the url of the week endpoint for plan
+*/
+func weekURL(base string, plan *WeekPlan) string {
+	return base + "/week/" + formatISOWeek(plan.Year, plan.Week)
+}
+
+/*
+formatDish, renders d as a single line of text
+*/
+func formatDish(d *parser.Dish) string {
+	var b strings.Builder
+	b.WriteString(d.Title)
+	if d.Description != "" {
+		b.WriteString(" ")
+		b.WriteString(d.Description)
+	}
+	if d.Price != "" {
+		fmt.Fprintf(&b, " (%v)", strings.TrimSpace(d.Price))
+	}
+	return b.String()
+}
+
+/*
+planTitle, returns a short human readable title for plan
+*/
+func planTitle(u *PlanUpdate) string {
+	if u.Changed {
+		return fmt.Sprintf("Changed menu for week %v/%v", u.Plan.Week, u.Plan.Year)
+	}
+	return fmt.Sprintf("Menu for week %v/%v", u.Plan.Week, u.Plan.Year)
+}
+
+/*
+dishesSummary, renders dishes as plain text grouped by day
+*/
+func dishesSummary(dishes []*parser.Dish) string {
+	var b strings.Builder
+	for i, day := range groupByDay(dishes) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%v, %v\n", weekdayNames[day.Date.Weekday()], day.Date.Format("02.01.2006"))
+		for _, d := range day.Dishes {
+			fmt.Fprintf(&b, "%v: %v\n", d.Type, formatDish(d))
+		}
+	}
+	return b.String()
+}
+
+/*
+sortedDishes, returns a copy of dishes sorted by date and column
+*/
+func sortedDishes(dishes []*parser.Dish) []*parser.Dish {
+	res := make([]*parser.Dish, len(dishes))
+	copy(res, dishes)
+	sort.SliceStable(res, func(i, j int) bool {
+		if !res[i].Date.Equal(res[j].Date) {
+			return res[i].Date.Before(res[j].Date)
+		}
+		return res[i].ColID() < res[j].ColID()
+	})
+	return res
+}
+
+/*
+entryID, returns a stable id for u that changes whenever the plan's PDF changes
+*/
+func entryID(u *PlanUpdate) string {
+	return "urn:uksh-menu:" + formatISOWeek(u.Plan.Year, u.Plan.Week) + ":" + u.Plan.Hash
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Updated   string   `xml:"updated"`
+	Published string   `xml:"published"`
+	Link      atomLink `xml:"link"`
+	Summary   atomText `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+/*
+feedModified, returns the newest Updated of the plans in updates or the zero time if updates is empty
+*/
+func feedModified(updates []*PlanUpdate) time.Time {
+	var res time.Time
+	for _, u := range updates {
+		if u.Plan.Updated.After(res) {
+			res = u.Plan.Updated
+		}
+	}
+	return res
+}
+
+/*
+feedNotModified, sets Last-Modified for the feed with updates and answers r with 304 if the feed did not change
+since If-Modified-Since. Returns true if r was answered
+*/
+func feedNotModified(w http.ResponseWriter, r *http.Request, updates []*PlanUpdate) bool {
+	modified := feedModified(updates)
+	if modified.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+/*
+atomFeedHandler, returns an atom feed with one entry per new or changed plan
+*/
+func (app *application) atomFeedHandler(w http.ResponseWriter, r *http.Request) {
+	base := app.baseURL(r)
+	updates := app.menuModel.PlanUpdates()
+	if feedNotModified(w, r, updates) {
+		return
+	}
+
+	feed := atomFeed{
+		Title:   feedTitle,
+		ID:      base + "/feed.atom",
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Author:  "uksh-menu-parser",
+		Links: []atomLink{
+			{Href: base + "/feed.atom", Rel: "self", Type: "application/atom+xml"},
+		},
+		Entries: make([]atomEntry, 0, len(updates)),
+	}
+	if len(updates) > 0 {
+		feed.Updated = feedModified(updates).UTC().Format(time.RFC3339)
+	}
+	for _, u := range updates {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     planTitle(u),
+			ID:        entryID(u),
+			Updated:   u.Plan.Updated.UTC().Format(time.RFC3339),
+			Published: u.Plan.Published.UTC().Format(time.RFC3339),
+			Link:      atomLink{Href: weekURL(base, u.Plan), Rel: "alternate", Type: "application/json"},
+			Summary:   atomText{Type: "text", Body: dishesSummary(u.Plan.Dishes)},
+		})
+	}
+
+	app.writeXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssFeed struct {
+	XMLName     xml.Name  `xml:"rss"`
+	Version     string    `xml:"version,attr"`
+	Title       string    `xml:"channel>title"`
+	Link        string    `xml:"channel>link"`
+	Description string    `xml:"channel>description"`
+	Items       []rssItem `xml:"channel>item"`
+}
+
+/*
+rssFeedHandler, returns a rss 2.0 feed with one item per new or changed plan
+*/
+func (app *application) rssFeedHandler(w http.ResponseWriter, r *http.Request) {
+	base := app.baseURL(r)
+	updates := app.menuModel.PlanUpdates()
+	if feedNotModified(w, r, updates) {
+		return
+	}
+
+	feed := rssFeed{
+		Version:     "2.0",
+		Title:       feedTitle,
+		Link:        base + "/feed.rss",
+		Description: "Newly published or changed weekly menu plans",
+		Items:       make([]rssItem, 0, len(updates)),
+	}
+	for _, u := range updates {
+		feed.Items = append(feed.Items, rssItem{
+			Title:       planTitle(u),
+			Link:        weekURL(base, u.Plan),
+			GUID:        rssGUID{IsPermaLink: false, Value: entryID(u)},
+			PubDate:     u.Plan.Updated.Format(time.RFC1123Z),
+			Description: dishesSummary(u.Plan.Dishes),
+		})
+	}
+
+	app.writeXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+/*
+writeXML, marshals v and writes it with the xml header to w
+*/
+func (app *application) writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	response, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		app.errorLog.Printf("Failed to marshal xml: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		app.errorLog.Printf("Failed to write xml response: %v\n", err)
+		return
+	}
+	if _, err := w.Write(response); err != nil {
+		app.errorLog.Printf("Failed to write xml response: %v\n", err)
+	}
+}
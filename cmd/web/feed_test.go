@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+newFeedTestApp, returns an application whose cache found the plan of week 47, then the plan of week 48 and then
+a changed plan of week 47, one hour apart starting at start
+*/
+func newFeedTestApp(start time.Time) *application {
+	week47 := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	week48 := week47.AddDate(0, 0, 7)
+	mc := &MenuCache{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf47"), MenuBaseURL, []*parser.Dish{
+		{Title: "Pasta-Pfanne", Price: "€ 4,80 / € 6,00", Type: "Wok Station", Date: week47},
+	}, nil, start)
+	mc.recordPlan([]byte("pdf48"), MenuBaseURL, []*parser.Dish{
+		{Title: "Rumpsteak", Type: "Gericht 2", Date: week48},
+	}, nil, start.Add(time.Hour))
+	mc.recordPlan([]byte("pdf47 changed"), MenuBaseURL, []*parser.Dish{
+		{Title: "Gemüsecurry", Type: "Wok Station", Date: week47},
+	}, nil, start.Add(2*time.Hour))
+	return &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+	}
+}
+
+func TestAtomFeedHandler(t *testing.T) {
+	start := time.Date(2020, 11, 13, 10, 0, 0, 0, time.UTC)
+	app := newFeedTestApp(start)
+
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://menu.example/feed.atom", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != start.Add(2*time.Hour).Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified of the newest plan got %q\n", got)
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if feed.Updated != "2020-11-13T12:00:00Z" || len(feed.Entries) != 3 {
+		t.Fatalf("Expected 3 entries updated at the newest plan got %v entries updated %v\n", len(feed.Entries), feed.Updated)
+	}
+
+	type expEntry struct {
+		title     string
+		idSuffix  string
+		updated   string
+		published string
+		link      string
+		summary   []string
+	}
+	exp := []expEntry{
+		{
+			title:     "Changed menu for week 47/2020",
+			idSuffix:  "2020-W47:" + pdfHash([]byte("pdf47 changed")),
+			updated:   "2020-11-13T12:00:00Z",
+			published: "2020-11-13T10:00:00Z",
+			link:      "http://menu.example/week/2020-W47",
+			summary:   []string{"Montag, 16.11.2020", "Wok Station: Gemüsecurry"},
+		},
+		{
+			title:     "Menu for week 48/2020",
+			idSuffix:  "2020-W48:" + pdfHash([]byte("pdf48")),
+			updated:   "2020-11-13T11:00:00Z",
+			published: "2020-11-13T11:00:00Z",
+			link:      "http://menu.example/week/2020-W48",
+			summary:   []string{"Montag, 23.11.2020", "Gericht 2: Rumpsteak"},
+		},
+		{
+			title:     "Menu for week 47/2020",
+			idSuffix:  "2020-W47:" + pdfHash([]byte("pdf47")),
+			updated:   "2020-11-13T10:00:00Z",
+			published: "2020-11-13T10:00:00Z",
+			link:      "http://menu.example/week/2020-W47",
+			summary:   []string{"Wok Station: Pasta-Pfanne (€ 4,80 / € 6,00)"},
+		},
+	}
+	for i, e := range exp {
+		got := feed.Entries[i]
+		if got.Title != e.title || !strings.HasPrefix(got.ID, "urn:uksh-menu:") || !strings.HasSuffix(got.ID, e.idSuffix) {
+			t.Errorf("Entry %v: expected title %q and id ending in %q got %q %q\n", i, e.title, e.idSuffix, got.Title, got.ID)
+		}
+		if got.Updated != e.updated || got.Published != e.published {
+			t.Errorf("Entry %v: expected updated %v published %v got %v %v\n", i, e.updated, e.published, got.Updated, got.Published)
+		}
+		if got.Link.Href != e.link {
+			t.Errorf("Entry %v: expected link %v got %v\n", i, e.link, got.Link.Href)
+		}
+		for _, v := range e.summary {
+			if !strings.Contains(got.Summary.Body, v) {
+				t.Errorf("Entry %v: expected %q in summary %q\n", i, v, got.Summary.Body)
+			}
+		}
+	}
+}
+
+func TestFeedHandlers(t *testing.T) {
+	start := time.Date(2020, 11, 13, 10, 0, 0, 0, time.UTC)
+	newest := start.Add(2 * time.Hour)
+	empty := &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: &MenuCache{infoLog: log.New(ioutil.Discard, "", 0), errorLog: log.New(ioutil.Discard, "", 0)},
+	}
+
+	type testCase struct {
+		name            string
+		app             *application
+		url             string
+		ifModifiedSince time.Time
+		expStatus       int
+		expLastModified bool
+		expBody         []string
+		notExpBody      []string
+	}
+
+	tests := []*testCase{
+		{
+			name:            "Rss",
+			app:             newFeedTestApp(start),
+			url:             "/feed.rss",
+			expStatus:       http.StatusOK,
+			expLastModified: true,
+			expBody: []string{`<rss version="2.0">`, "<title>Changed menu for week 47/2020</title>",
+				`<guid isPermaLink="false">urn:uksh-menu:2020-W48:` + pdfHash([]byte("pdf48")) + "</guid>",
+				"<pubDate>Fri, 13 Nov 2020 12:00:00 +0000</pubDate>"},
+		},
+		{
+			name:            "Atom not modified",
+			app:             newFeedTestApp(start),
+			url:             "/feed.atom",
+			ifModifiedSince: newest,
+			expStatus:       http.StatusNotModified,
+			expLastModified: true,
+		},
+		{
+			name:            "Rss not modified",
+			app:             newFeedTestApp(start),
+			url:             "/feed.rss",
+			ifModifiedSince: newest.Add(time.Minute),
+			expStatus:       http.StatusNotModified,
+			expLastModified: true,
+		},
+		{
+			name:            "Atom modified since",
+			app:             newFeedTestApp(start),
+			url:             "/feed.atom",
+			ifModifiedSince: newest.Add(-time.Second),
+			expStatus:       http.StatusOK,
+			expLastModified: true,
+			expBody:         []string{"<entry>"},
+		},
+		{
+			name:       "Empty atom",
+			app:        empty,
+			url:        "/feed.atom",
+			expStatus:  http.StatusOK,
+			expBody:    []string{"<updated>1970-01-01T00:00:00Z</updated>"},
+			notExpBody: []string{"<entry>"},
+		},
+		{
+			name:            "Empty rss ignores If-Modified-Since",
+			app:             empty,
+			url:             "/feed.rss",
+			ifModifiedSince: newest,
+			expStatus:       http.StatusOK,
+			expBody:         []string{"<channel>"},
+			notExpBody:      []string{"<item>"},
+		},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+				if !tc.ifModifiedSince.IsZero() {
+					r.Header.Set("If-Modified-Since", tc.ifModifiedSince.Format(http.TimeFormat))
+				}
+				rec := httptest.NewRecorder()
+				tc.app.routes().ServeHTTP(rec, r)
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v\n", tc.expStatus, rec.Code)
+				}
+				if got := rec.Header().Get("Last-Modified") != ""; got != tc.expLastModified {
+					t.Errorf("Expected Last-Modified set %v got %q\n", tc.expLastModified, rec.Header().Get("Last-Modified"))
+				}
+				if tc.expStatus == http.StatusNotModified && rec.Body.Len() != 0 {
+					t.Errorf("Expected empty body got %v\n", rec.Body.String())
+				}
+				for _, v := range tc.expBody {
+					if !strings.Contains(rec.Body.String(), v) {
+						t.Errorf("Expected %q in %v\n", v, rec.Body.String())
+					}
+				}
+				for _, v := range tc.notExpBody {
+					if strings.Contains(rec.Body.String(), v) {
+						t.Errorf("Unexpected %q in %v\n", v, rec.Body.String())
+					}
+				}
+			})
+		}(v)
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
 )
 
 /*
@@ -21,41 +21,74 @@ func (app *application) aliveHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 /*
-menuHandler returns all dishes for the day specified in the url as json
+parseDate, parses s in the format yyyy-mm-dd in the local timezone
 */
-func (app *application) menuHandler(w http.ResponseWriter, r *http.Request) {
-
-	date, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get(":date"), time.Local)
+func parseDate(s string) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", s, time.Local)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("Pass date as yyyy-mm-dd\n")); err != nil {
-			app.errorLog.Printf("Failed to write error response\n")
-		}
-
-		return
+		return time.Time{}, fmt.Errorf("parseDate: %w: pass date as yyyy-mm-dd", badRequestError)
 	}
+	return date, nil
+}
 
-	dishes, err := app.menuModel.GetMenu(date)
+/*
+menuHandler returns all dishes for the day specified in the url in the format negotiated by serveDishes
+*/
+func (app *application) menuHandler(w http.ResponseWriter, r *http.Request) {
+	date, err := parseDate(r.URL.Query().Get(":date"))
 	if err != nil {
-		if errors.Is(err, invDateError) {
-			w.WriteHeader(http.StatusBadRequest)
-			if _, err := w.Write([]byte("Date either to far in the past or to far in the future\n")); err != nil {
-				app.errorLog.Printf("Failed to write error response\n")
-			}
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
+		app.writeProblem(w, r, err)
 		return
 	}
 
-	response, err := json.Marshal(dishes)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	app.serveDishes(w, r, func() ([]*parser.Dish, error) {
+		return app.menuModel.GetMenu(date)
+	})
+}
+
+/*
+isoWeekRegexp, matches iso weeks in the format yyyy-Www
+*/
+var isoWeekRegexp = regexp.MustCompile(`^([0-9]{4})-W([0-9]{2})$`)
+
+/*
+parseISOWeek, parses s in the format yyyy-Www, e.g. 2020-W47
+*/
+func parseISOWeek(s string) (year, week int, err error) {
+	match := isoWeekRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return 0, 0, fmt.Errorf("parseISOWeek: %w: pass week as yyyy-Www", badRequestError)
 	}
-	if _, err := io.Copy(w, bytes.NewReader(response)); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	year, _ = strconv.Atoi(match[1])
+	week, _ = strconv.Atoi(match[2])
+	if week < 1 || week > 53 {
+		return 0, 0, fmt.Errorf("parseISOWeek: %w: %v is not a valid week number", badRequestError, week)
+	}
+	return year, week, nil
+}
+
+/*
+formatISOWeek, is the inverse of parseISOWeek
+*/
+func formatISOWeek(year, week int) string {
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+/*
+weekHandler returns all dishes of the iso week specified in the url in the format negotiated by serveDishes
+*/
+func (app *application) weekHandler(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.writeProblem(w, r, err)
 		return
 	}
 
+	app.serveDishes(w, r, func() ([]*parser.Dish, error) {
+		plan, err := app.menuModel.GetWeek(year, week)
+		if err != nil {
+			return nil, err
+		}
+		return plan.Dishes, nil
+	})
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+maxRefreshAge, the service is degraded if no refresh succeeded for this long. Refreshes run daily
+*/
+const maxRefreshAge = 48 * time.Hour
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+)
+
+/*
+toolStatus, is the result of checking a single external program
+*/
+type toolStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+/*
+healthReport, is the body of /healthz and /readyz
+*/
+type healthReport struct {
+	//one of healthOK, healthDegraded or healthFailing
+	Status           string     `json:"status"`
+	LastRefresh      *time.Time `json:"lastRefresh"`
+	LastRefreshError string     `json:"lastRefreshError,omitempty"`
+	//informational, there is no menu on weekends and holidays
+	LastSuccessfulRefresh *time.Time    `json:"lastSuccessfulRefresh"`
+	CachedDays            int           `json:"cachedDays"`
+	TodayAvailable        bool          `json:"todayAvailable"`
+	Tools                 []*toolStatus `json:"tools"`
+}
+
+/*
+toolChecker, caches the result of parser.CheckTools as the check spawns several processes
+*/
+type toolChecker struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	checked time.Time
+	status  []*toolStatus
+	//replaced in tests
+	check func() map[string]error
+}
+
+func newToolChecker() *toolChecker {
+	return &toolChecker{ttl: time.Minute, check: parser.CheckTools}
+}
+
+/*
+Status, returns the cached tool status sorted by name and refreshes it if it is older than c.ttl
+*/
+func (c *toolChecker) Status() []*toolStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.status != nil && time.Since(c.checked) < c.ttl {
+		return c.status
+	}
+	status := make([]*toolStatus, 0)
+	for name, err := range c.check() {
+		s := &toolStatus{Name: name, OK: err == nil}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	c.status = status
+	c.checked = time.Now()
+	return status
+}
+
+/*
+newHealthReport, collects the state of the cache and the external programs. The service is failing if a tool
+is unusable or nothing is cached and degraded if the last refresh failed or no refresh succeeded for maxRefreshAge.
+A missing menu for today is only reported, the UKSH publishes none for weekends and holidays
+*/
+func (app *application) newHealthReport() *healthReport {
+	rep := &healthReport{
+		Status:     healthOK,
+		CachedDays: app.menuModel.CachedDays(),
+		Tools:      app.tools.Status(),
+	}
+	lastRefresh, lastSuccess, err := app.menuModel.RefreshStatus()
+	if !lastRefresh.IsZero() {
+		rep.LastRefresh = &lastRefresh
+	}
+	if !lastSuccess.IsZero() {
+		rep.LastSuccessfulRefresh = &lastSuccess
+	}
+	if err != nil {
+		rep.LastRefreshError = err.Error()
+	}
+	_, rep.TodayAvailable = app.menuModel.CachedMenu(time.Now().In(time.Local))
+
+	if err != nil || time.Since(lastSuccess) > maxRefreshAge {
+		rep.Status = healthDegraded
+	}
+	if rep.CachedDays == 0 {
+		rep.Status = healthFailing
+	}
+	for _, t := range rep.Tools {
+		if !t.OK {
+			rep.Status = healthFailing
+		}
+	}
+	return rep
+}
+
+/*
+healthzHandler, reports the detailed health of the service. Answers 503 unless everything is ok, e.g. also if
+the last refresh failed, but not if there is no menu for today
+*/
+func (app *application) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	rep := app.newHealthReport()
+	status := http.StatusOK
+	if rep.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	app.writeJSON(w, status, rep)
+}
+
+/*
+readyzHandler, answers 200 only if the service can answer requests from the cache and parse new plans.
+A degraded service is still ready
+*/
+func (app *application) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	rep := app.newHealthReport()
+	status := http.StatusOK
+	if rep.Status == healthFailing {
+		status = http.StatusServiceUnavailable
+	}
+	app.writeJSON(w, status, rep)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	today := roundToDay(time.Now().In(time.Local))
+
+	type testCase struct {
+		name         string
+		cached       map[time.Time][]*parser.Dish
+		refreshError error
+		//age of the last successful refresh
+		refreshAge time.Duration
+		toolError  error
+		expStatus  string
+		expHealthz int
+		expReadyz  int
+	}
+
+	tests := []*testCase{
+		{name: "Healthy", cached: map[time.Time][]*parser.Dish{today: {{Title: "Pasta-Pfanne", Date: today}}},
+			expStatus: healthOK, expHealthz: http.StatusOK, expReadyz: http.StatusOK},
+		{name: "Refresh failed", cached: map[time.Time][]*parser.Dish{today: {{Title: "Pasta-Pfanne", Date: today}}},
+			refreshError: upstreamError, expStatus: healthDegraded, expHealthz: http.StatusServiceUnavailable, expReadyz: http.StatusOK},
+		{name: "Tesseract missing", cached: map[time.Time][]*parser.Dish{today: {{Title: "Pasta-Pfanne", Date: today}}},
+			toolError: errors.New("not found"), expStatus: healthFailing, expHealthz: http.StatusServiceUnavailable, expReadyz: http.StatusServiceUnavailable},
+		{name: "No menu today", cached: map[time.Time][]*parser.Dish{today.AddDate(0, 0, -1): {{Title: "Pasta-Pfanne", Date: today.AddDate(0, 0, -1)}}},
+			expStatus: healthOK, expHealthz: http.StatusOK, expReadyz: http.StatusOK},
+		{name: "Stale refresh", cached: map[time.Time][]*parser.Dish{today: {{Title: "Pasta-Pfanne", Date: today}}},
+			refreshAge: 3 * 24 * time.Hour, expStatus: healthDegraded, expHealthz: http.StatusServiceUnavailable, expReadyz: http.StatusOK},
+		{name: "Empty cache", cached: map[time.Time][]*parser.Dish{},
+			expStatus: healthFailing, expHealthz: http.StatusServiceUnavailable, expReadyz: http.StatusServiceUnavailable},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				app := &application{
+					infoLog:  log.New(ioutil.Discard, "", 0),
+					errorLog: log.New(ioutil.Discard, "", 0),
+					menuModel: &MenuCache{
+						dateToDishes:          tc.cached,
+						lastRefresh:           time.Now(),
+						lastRefreshError:      tc.refreshError,
+						lastSuccessfulRefresh: time.Now().Add(-tc.refreshAge),
+					},
+					tools: &toolChecker{ttl: time.Minute, check: func() map[string]error {
+						return map[string]error{"pdftoppm": nil, "pdftotext": nil, "tesseract": tc.toolError}
+					}},
+				}
+				srv := app.routes()
+				for url, expCode := range map[string]int{"/healthz": tc.expHealthz, "/readyz": tc.expReadyz} {
+					rec := httptest.NewRecorder()
+					srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+					if rec.Code != expCode {
+						t.Errorf("%v: expected status %v got %v\n", url, expCode, rec.Code)
+					}
+					var rep healthReport
+					if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+						t.Fatalf("Unexpected error: %v\n", err)
+					}
+					if rep.Status != tc.expStatus || len(rep.Tools) != 3 {
+						t.Errorf("%v: unexpected report %v\n", url, rec.Body.String())
+					}
+				}
+			})
+		}(v)
+	}
+}
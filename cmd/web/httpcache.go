@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+/*
+maxCachedResponses, bounds the number of rendered responses kept by responseCache
+*/
+const maxCachedResponses = 512
+
+/*
+minCompressSize, responses smaller than this are not worth compressing
+*/
+const minCompressSize = 256
+
+/*
+cachedResponse, is a rendered response for a version of the menu cache. Compressed bodies are added on demand
+*/
+type cachedResponse struct {
+	modified    time.Time
+	contentType string
+	body        []byte
+	//content coding to compressed body
+	encoded map[string][]byte
+}
+
+/*
+responseCache, keeps rendered responses so that they are only encoded and compressed once per version of the menu
+cache. The zero value is ready to use
+*/
+type responseCache struct {
+	lock    sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+/*
+get, returns the response stored for key if it was rendered for the version modified
+*/
+func (c *responseCache) get(key string, modified time.Time) (*cachedResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res, ok := c.entries[key]
+	if !ok || !res.modified.Equal(modified) {
+		return nil, false
+	}
+	return res, true
+}
+
+/*
+put, stores body as response for key rendered for the version modified. Responses of older versions are dropped
+once the cache is full
+*/
+func (c *responseCache) put(key string, modified time.Time, contentType string, body []byte) *cachedResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cachedResponse)
+	}
+	if len(c.entries) >= maxCachedResponses {
+		for k, v := range c.entries {
+			if !v.modified.Equal(modified) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedResponses {
+			c.entries = make(map[string]*cachedResponse)
+		}
+	}
+	res := &cachedResponse{modified: modified, contentType: contentType, body: body, encoded: make(map[string][]byte)}
+	c.entries[key] = res
+	return res
+}
+
+/*
+encode, returns the body of res compressed with coding, which may be empty for no compression
+*/
+func (c *responseCache) encode(res *cachedResponse, coding string) ([]byte, error) {
+	if coding == "" {
+		return res.body, nil
+	}
+	c.lock.Lock()
+	encoded, ok := res.encoded[coding]
+	c.lock.Unlock()
+	if ok {
+		return encoded, nil
+	}
+
+	buf := new(bytes.Buffer)
+	enc := newCompressor(coding, buf)
+	if _, err := enc.Write(res.body); err != nil {
+		return nil, fmt.Errorf("encode: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("encode: %v", err)
+	}
+	c.lock.Lock()
+	res.encoded[coding] = buf.Bytes()
+	c.lock.Unlock()
+	return buf.Bytes(), nil
+}
+
+/*
+compressor, is implemented by the gzip and brotli writers
+*/
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+/*
+newCompressor, returns a writer compressing with coding into w
+*/
+func newCompressor(coding string, w io.Writer) compressor {
+	if coding == "br" {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+	return gzip.NewWriter(w)
+}
+
+/*
+negotiateContentCoding, returns the preferred content coding accepted by r, "br" or "gzip", or the empty string
+if the response should not be compressed. Quality values other than 0 are treated as equal
+*/
+func negotiateContentCoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		rejected := false
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				rejected = err == nil && q == 0
+			}
+		}
+		accepted[coding] = !rejected
+	}
+	for _, coding := range []string{"br", "gzip"} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+/*
+compressible, returns true if responses of contentType benefit from compression
+*/
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml") || strings.Contains(contentType, "javascript")
+}
+
+/*
+addVary, adds value to the Vary header of h unless it is already listed
+*/
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+/*
+nextRefresh, returns the next time after now at which the menu is refreshed daily at refreshTime (hh:mm)
+*/
+func nextRefresh(now time.Time, refreshTime string) time.Time {
+	t, err := time.Parse("15:04", refreshTime)
+	if err != nil {
+		//validated by loadConfig
+		return now.Add(24 * time.Hour)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+/*
+maxCacheAge, caps the lifetime of menu responses in client caches. Corrections and uploads change the menu between
+the scheduled refreshes and should show up within this time
+*/
+const maxCacheAge = 10 * time.Minute
+
+/*
+cacheMaxAge, returns the max-age in seconds for responses sent at now: the time until the next refresh at
+refreshTime, but at most maxCacheAge
+*/
+func cacheMaxAge(now time.Time, refreshTime string) int {
+	age := nextRefresh(now, refreshTime).Sub(now)
+	if age > maxCacheAge {
+		age = maxCacheAge
+	}
+	return int(age.Seconds())
+}
+
+/*
+notModified, returns true if the conditional request r already has the response with etag or last modified at
+modified
+*/
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			//weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		return !modified.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+/*
+serveVersioned, serves the response returned by render for the current version of the menu cache. variant
+distinguishes the representations of the url, e.g. the negotiated format. Responses are rendered once per
+version and answered with 304 for conditional requests. They may be cached by clients until the next refresh, but
+at most for maxCacheAge
+*/
+func (app *application) serveVersioned(w http.ResponseWriter, r *http.Request, variant string, render func() (contentType string, body []byte, err error)) {
+	modified := app.menuModel.Modified()
+	etag := fmt.Sprintf(`W/"%x-%v"`, modified.UnixNano(), variant)
+	setCachingHeaders := func() {
+		now := time.Now()
+		w.Header().Set("ETag", etag)
+		//nothing cached yet
+		if !modified.IsZero() {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cacheMaxAge(now, app.config().Menu.RefreshTime)))
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	if notModified(r, etag, modified) {
+		setCachingHeaders()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	key := r.URL.Path + " " + variant
+	res, ok := app.responses.get(key, modified)
+	if !ok {
+		contentType, body, err := render()
+		if err != nil {
+			app.writeProblem(w, r, err)
+			return
+		}
+		res = app.responses.put(key, modified, contentType, body)
+	}
+
+	coding := negotiateContentCoding(r)
+	if len(res.body) < minCompressSize {
+		coding = ""
+	}
+	body, err := app.responses.encode(res, coding)
+	if err != nil {
+		app.errorLog.Printf("serveVersioned: %v\n", err)
+		coding, body = "", res.body
+	}
+	setCachingHeaders()
+	w.Header().Set("Content-Type", res.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if coding != "" {
+		w.Header().Set("Content-Encoding", coding)
+	}
+	if _, err := w.Write(body); err != nil {
+		app.errorLog.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+/*
+compressWriter, compresses the response if its content type is compressible and the handler did not compress it
+itself
+*/
+type compressWriter struct {
+	http.ResponseWriter
+	coding  string
+	enc     compressor
+	decided bool
+}
+
+func (cw *compressWriter) decide(status int) {
+	cw.decided = true
+	h := cw.Header()
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+	addVary(h, "Accept-Encoding")
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minCompressSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.coding)
+	cw.enc = newCompressor(cw.coding, cw.ResponseWriter)
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if !cw.decided {
+		cw.decide(status)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+/*
+Flush, sends the data compressed so far to the client
+*/
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+/*
+Unwrap, returns the wrapped writer, so that http.ResponseController can set its write deadline
+*/
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+/*
+close, finishes the compressed stream
+*/
+func (cw *compressWriter) close() error {
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+/*
+compress, gzip or brotli compresses responses with compressible content types if the client accepts it
+*/
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		coding := negotiateContentCoding(r)
+		if coding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, coding: coding}
+		defer func() {
+			if err := cw.close(); err != nil {
+				app.errorLog.Printf("compress: %v\n", err)
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
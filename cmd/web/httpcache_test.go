@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/andybalholm/brotli"
+)
+
+func TestServeVersioned(t *testing.T) {
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{
+		{Title: "Pasta-Pfanne", Description: "mit Gemüse und Erdnusssauce", Price: "€ 4,80 / € 6,00", Kcal: "kcal 528 / kJ 2212", Type: "Wok Station", Date: monday},
+		{Title: "Rumpsteak", Description: "mit Kräuterbutter und Pommes frites", Price: "€ 5,90 / € 7,40", Kcal: "kcal 879 / kJ 3683", Type: "Gericht 2", Date: monday},
+	}, nil, time.Now())
+	app := &application{
+		infoLog:   log.New(ioutil.Discard, "", 0),
+		errorLog:  log.New(ioutil.Discard, "", 0),
+		menuModel: mc,
+	}
+	srv := app.routes()
+
+	get := func(url string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		return rec
+	}
+
+	plain := get("/v1/week/2020-W47", nil)
+	if plain.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v: %v\n", http.StatusOK, plain.Code, plain.Body.String())
+	}
+	etag := plain.Header().Get("ETag")
+	lastModified := plain.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" || plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Unexpected headers %v\n", plain.Header())
+	}
+
+	type testCase struct {
+		name       string
+		url        string
+		header     http.Header
+		expStatus  int
+		expCoding  string
+		expVariant bool
+	}
+
+	tests := []*testCase{
+		{name: "Gzip", url: "/v1/week/2020-W47", header: http.Header{"Accept-Encoding": {"gzip, deflate"}}, expStatus: http.StatusOK, expCoding: "gzip"},
+		{name: "Brotli preferred", url: "/v1/week/2020-W47", header: http.Header{"Accept-Encoding": {"gzip, br"}}, expStatus: http.StatusOK, expCoding: "br"},
+		{name: "Brotli rejected", url: "/v1/week/2020-W47", header: http.Header{"Accept-Encoding": {"gzip, br;q=0"}}, expStatus: http.StatusOK, expCoding: "gzip"},
+		{name: "If-None-Match", url: "/v1/week/2020-W47", header: http.Header{"If-None-Match": {etag}}, expStatus: http.StatusNotModified},
+		{name: "If-None-Match list", url: "/v1/week/2020-W47", header: http.Header{"If-None-Match": {`"other", ` + etag}}, expStatus: http.StatusNotModified},
+		{name: "If-None-Match other", url: "/v1/week/2020-W47", header: http.Header{"If-None-Match": {`W/"other"`}}, expStatus: http.StatusOK},
+		{name: "If-Modified-Since", url: "/v1/week/2020-W47", header: http.Header{"If-Modified-Since": {lastModified}}, expStatus: http.StatusNotModified},
+		{name: "Other format", url: "/week/2020-W47?format=csv", header: http.Header{"If-None-Match": {etag}}, expStatus: http.StatusOK, expVariant: true},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := get(tc.url, tc.header)
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+				if !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public, max-age=") {
+					t.Errorf("Expected Cache-Control header with max-age got %q\n", rec.Header().Get("Cache-Control"))
+				}
+				if tc.expStatus == http.StatusNotModified {
+					if rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+						t.Errorf("Unexpected not modified response %v %q\n", rec.Header(), rec.Body.String())
+					}
+					return
+				}
+				if tc.expVariant {
+					if rec.Header().Get("ETag") == etag {
+						t.Errorf("Expected different etag for other representation\n")
+					}
+					return
+				}
+				if got := rec.Header().Get("Content-Encoding"); got != tc.expCoding {
+					t.Fatalf("Expected coding %q got %q\n", tc.expCoding, got)
+				}
+				var body io.Reader = rec.Body
+				switch tc.expCoding {
+				case "gzip":
+					zr, err := gzip.NewReader(rec.Body)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v\n", err)
+					}
+					body = zr
+				case "br":
+					body = brotli.NewReader(rec.Body)
+				}
+				got, err := ioutil.ReadAll(body)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if !bytes.Equal(got, plain.Body.Bytes()) {
+					t.Errorf("Expected %q got %q\n", plain.Body.String(), got)
+				}
+			})
+		}(v)
+	}
+
+	//a new version invalidates the etag
+	mc.ApplyCorrections()
+	if rec := get("/v1/week/2020-W47", http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("Expected new version got %v %v\n", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestCompress(t *testing.T) {
+	app := &application{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	large := bytes.Repeat([]byte("Pasta-Pfanne "), 100)
+
+	type testCase struct {
+		name        string
+		contentType string
+		body        []byte
+		expCoding   string
+	}
+
+	tests := []*testCase{
+		{name: "Html", contentType: "text/html; charset=utf-8", body: large, expCoding: "gzip"},
+		{name: "Detected", body: large, expCoding: "gzip"},
+		{name: "Png", contentType: "image/png", body: large},
+		{name: "Small", contentType: "text/html; charset=utf-8", body: []byte("Pasta")},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				h := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if tc.contentType != "" {
+						w.Header().Set("Content-Type", tc.contentType)
+					}
+					if len(tc.body) < minCompressSize {
+						w.Header().Set("Content-Length", "5")
+					}
+					_, _ = w.Write(tc.body)
+				}))
+				r := httptest.NewRequest(http.MethodGet, "/plan/2020-W47", nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				if got := rec.Header().Get("Content-Encoding"); got != tc.expCoding {
+					t.Fatalf("Expected coding %q got %q\n", tc.expCoding, got)
+				}
+				if tc.expCoding == "" {
+					if !bytes.Equal(rec.Body.Bytes(), tc.body) {
+						t.Errorf("Expected uncompressed body\n")
+					}
+					return
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, tc.body) {
+					t.Errorf("Expected %q got %q, %v\n", tc.body, got, err)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestNextRefresh(t *testing.T) {
+	type testCase struct {
+		name        string
+		now         time.Time
+		refreshTime string
+		exp         time.Time
+	}
+
+	tests := []*testCase{
+		{name: "Later today", now: time.Date(2020, 11, 16, 5, 0, 0, 0, time.UTC), refreshTime: "06:30", exp: time.Date(2020, 11, 16, 6, 30, 0, 0, time.UTC)},
+		{name: "Tomorrow", now: time.Date(2020, 11, 16, 7, 0, 0, 0, time.UTC), refreshTime: "06:30", exp: time.Date(2020, 11, 17, 6, 30, 0, 0, time.UTC)},
+		{name: "Exactly now", now: time.Date(2020, 11, 16, 6, 30, 0, 0, time.UTC), refreshTime: "06:30", exp: time.Date(2020, 11, 17, 6, 30, 0, 0, time.UTC)},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				if got := nextRefresh(tc.now, tc.refreshTime); !got.Equal(tc.exp) {
+					t.Errorf("Expected %v got %v\n", tc.exp, got)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	type testCase struct {
+		name string
+		now  time.Time
+		exp  int
+	}
+
+	tests := []*testCase{
+		{name: "Refresh soon", now: time.Date(2020, 11, 16, 6, 25, 0, 0, time.UTC), exp: 300},
+		{name: "Refresh tomorrow", now: time.Date(2020, 11, 16, 7, 0, 0, 0, time.UTC), exp: int(maxCacheAge.Seconds())},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				if got := cacheMaxAge(tc.now, "06:30"); got != tc.exp {
+					t.Errorf("Expected %v got %v\n", tc.exp, got)
+				}
+			})
+		}(v)
+	}
+}
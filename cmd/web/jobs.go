@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+unknownJobError is returned when a job id does not exist or the job expired
+*/
+var unknownJobError = errors.New("job not found")
+
+/*
+jobRetention, finished jobs can be queried for this long
+*/
+const jobRetention = time.Hour
+
+/*
+maxJobs, bounds the number of jobs kept by jobStore. The oldest finished jobs are dropped first
+*/
+const maxJobs = 100
+
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+/*
+job, is a long running operation like a refresh or a parse. Its result is queried via the url returned when it
+was started
+*/
+type job struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Status   string      `json:"status"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	//set on query if the job failed
+	Problem *problem `json:"problem,omitempty"`
+	err     error
+}
+
+/*
+jobStore, runs operations that take longer than server.writeTimeout in the background and keeps their results.
+The zero value is ready to use
+*/
+type jobStore struct {
+	lock sync.Mutex
+	jobs map[string]*job
+}
+
+/*
+add, registers a running job of kind. Caller must hold s.lock
+*/
+func (s *jobStore) add(kind string, now time.Time) (*job, error) {
+	if s.jobs == nil {
+		s.jobs = make(map[string]*job)
+	}
+	var oldest *job
+	for id, j := range s.jobs {
+		if j.Finished == nil {
+			continue
+		}
+		if now.Sub(*j.Finished) > jobRetention {
+			delete(s.jobs, id)
+		} else if oldest == nil || j.Finished.Before(*oldest.Finished) {
+			oldest = j
+		}
+	}
+	if len(s.jobs) >= maxJobs && oldest != nil {
+		delete(s.jobs, oldest.ID)
+	}
+	id, err := randomID(16)
+	if err != nil {
+		return nil, fmt.Errorf("add: %v", err)
+	}
+	j := &job{ID: id, Kind: kind, Status: jobRunning, Started: now}
+	s.jobs[id] = j
+	return j, nil
+}
+
+/*
+finish, stores the result of the job with id. Caller must hold s.lock
+*/
+func (s *jobStore) finish(id string, result interface{}, err error) {
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	j.Finished = &now
+	j.Status, j.Result, j.err = jobDone, result, err
+	if err != nil {
+		j.Status, j.Result = jobFailed, nil
+	}
+}
+
+/*
+get, returns a copy of the job with id if it is of one of kinds
+*/
+func (s *jobStore) get(id string, kinds ...string) (*job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		for _, k := range kinds {
+			if j.Kind == k {
+				res := *j
+				return &res, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("get: %w: %v", unknownJobError, id)
+}
+
+/*
+startJob, runs run in the background as job of kind. If exclusive is set and a job of kind is running, that job
+is returned instead
+*/
+func (app *application) startJob(kind string, exclusive bool, run func(ctx context.Context) (interface{}, error)) (*job, error) {
+	s := &app.jobs
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if exclusive {
+		for _, j := range s.jobs {
+			if j.Kind == kind && j.Status == jobRunning {
+				res := *j
+				return &res, nil
+			}
+		}
+	}
+	j, err := s.add(kind, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("startJob: %v", err)
+	}
+	res := *j
+
+	go func(id string) {
+		//not bound to the request, which ends when the job is started
+		result, err := run(context.Background())
+		if err != nil {
+			app.logger.Warn("job failed", "job", id, "kind", kind, "error", err)
+		} else {
+			app.logger.Info("job done", "job", id, "kind", kind, "durationMs", time.Since(res.Started).Milliseconds())
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.finish(id, result, err)
+	}(j.ID)
+	return &res, nil
+}
+
+/*
+writeJobStarted, answers r with 202, the job and its url in the Location header
+*/
+func (app *application) writeJobStarted(w http.ResponseWriter, j *job, url string) {
+	w.Header().Set("Location", url)
+	app.writeJSON(w, http.StatusAccepted, j)
+}
+
+/*
+writeJob, answers r with the job whose id is passed in the url if it is of one of kinds. A failed job contains
+the problem that would have been returned if the operation ran synchronously
+*/
+func (app *application) writeJob(w http.ResponseWriter, r *http.Request, kinds ...string) {
+	j, err := app.jobs.get(r.URL.Query().Get(":id"), kinds...)
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	if j.err != nil {
+		j.Problem = newProblem(r, j.err)
+	}
+	if j.Status == jobRunning {
+		w.Header().Set("Retry-After", "2")
+	}
+	app.writeJSON(w, http.StatusOK, j)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+jobResponse, is a job as returned by writeJob with the result kept raw for decoding by the test
+*/
+type jobResponse struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"`
+	Status  string          `json:"status"`
+	Result  json.RawMessage `json:"result"`
+	Problem *problem        `json:"problem"`
+}
+
+/*
+waitForJob, checks that started is a 202 response with a job url and polls that url with header until the job
+finished
+*/
+func waitForJob(t *testing.T, srv http.Handler, started *httptest.ResponseRecorder, header http.Header) *jobResponse {
+	t.Helper()
+	if started.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %v got %v: %v\n", http.StatusAccepted, started.Code, started.Body.String())
+	}
+	url := started.Header().Get("Location")
+	if url == "" {
+		t.Fatalf("Expected Location header\n")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %v got %v: %v\n", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		res := &jobResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if res.Status != jobRunning {
+			return res
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Job %v did not finish\n", url)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartJob(t *testing.T) {
+	app := &application{}
+	release := make(chan struct{})
+	block := func(context.Context) (interface{}, error) {
+		<-release
+		return "done", nil
+	}
+
+	first, err := app.startJob("refresh", true, block)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	second, err := app.startJob("refresh", true, block)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("Expected running exclusive job to be reused\n")
+	}
+	failed, err := app.startJob("upload", false, func(context.Context) (interface{}, error) {
+		return nil, badRequestError
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	close(release)
+
+	wait := func(id string) *job {
+		for i := 0; i < 500; i++ {
+			j, err := app.jobs.get(id, "refresh", "upload")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v\n", err)
+			}
+			if j.Status != jobRunning {
+				return j
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Job %v did not finish\n", id)
+		return nil
+	}
+	if j := wait(first.ID); j.Status != jobDone || j.Result != "done" || j.Finished == nil {
+		t.Errorf("Unexpected job %+v\n", j)
+	}
+	if j := wait(failed.ID); j.Status != jobFailed || !errors.Is(j.err, badRequestError) {
+		t.Errorf("Unexpected job %+v\n", j)
+	}
+	if _, err := app.jobs.get(first.ID, "upload"); !errors.Is(err, unknownJobError) {
+		t.Errorf("Expected %v for other kind got %v\n", unknownJobError, err)
+	}
+
+	//expired jobs are dropped when a new one is added
+	app.jobs.lock.Lock()
+	if _, err := app.jobs.add("upload", time.Now().Add(2*jobRetention)); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	l := len(app.jobs.jobs)
+	app.jobs.lock.Unlock()
+	if l != 1 {
+		t.Errorf("Expected expired jobs to be dropped got %v jobs\n", l)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+systemdListenAddr, is the listen address that uses all sockets passed by systemd socket activation
+*/
+const systemdListenAddr = "systemd"
+
+/*
+parseListenAddr, splits a listen address into network and address. Supported are "tcp://host:port" (ipv4 and ipv6),
+"tcp4://host:port", "tcp6://host:port", "unix:/path/to/socket" and "systemd". An address without scheme is
+tcp4 for compatibility with older configurations
+*/
+func parseListenAddr(addr string) (network, address string, err error) {
+	if addr == systemdListenAddr {
+		return systemdListenAddr, "", nil
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+		if path == "" {
+			return "", "", fmt.Errorf("parseListenAddr: %q has no socket path", addr)
+		}
+		return "unix", path, nil
+	}
+	network, address = "tcp4", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, address = addr[:i], addr[i+3:]
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return "", "", fmt.Errorf("parseListenAddr: unsupported network %q in %q", network, addr)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("parseListenAddr: %v", err)
+	}
+	return network, address, nil
+}
+
+/*
+systemdListeners, returns the sockets passed by systemd socket activation, see sd_listen_fds(3)
+*/
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("systemdListeners: no sockets passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("systemdListeners: no sockets passed by systemd")
+	}
+	//not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	//passed file descriptors start after stdin, stdout and stderr
+	const firstFD = 3
+	listeners := make([]net.Listener, 0, count)
+	for fd := firstFD; fd < firstFD+count; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-%d", fd))
+		//FileListener works on a duplicate of the file descriptor
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("systemdListeners: fd %v: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+/*
+listenUnix, listens on the unix socket at path. A stale socket left behind by a previous run is removed
+*/
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+/*
+openListeners, opens a listener for every address, see parseListenAddr for the format. Either all listeners are
+opened or none
+*/
+func openListeners(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		network, address, err := parseListenAddr(addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("openListeners: %v", err)
+		}
+		switch network {
+		case systemdListenAddr:
+			l, err := systemdListeners()
+			if err != nil {
+				closeListeners(listeners)
+				return nil, fmt.Errorf("openListeners: %v", err)
+			}
+			listeners = append(listeners, l...)
+		case "unix":
+			l, err := listenUnix(address)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, fmt.Errorf("openListeners: %v", err)
+			}
+			listeners = append(listeners, l)
+		default:
+			l, err := net.Listen(network, address)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, fmt.Errorf("openListeners: %v", err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+/*
+redirectToHTTPS, redirects every request to the same url using https. The target host is taken from the
+configured public url or from the request
+*/
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimRight(app.config().PublicURL, "/")
+	if target == "" || !strings.HasPrefix(target, "https://") {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+		target = "https://" + host
+	}
+	w.Header().Set("Connection", "close")
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
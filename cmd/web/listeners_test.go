@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	type testCase struct {
+		name       string
+		in         string
+		expNetwork string
+		expAddress string
+		wantErr    bool
+	}
+
+	tests := []*testCase{
+		{name: "Legacy", in: ":8080", expNetwork: "tcp4", expAddress: ":8080"},
+		{name: "Dual stack", in: "tcp://:8080", expNetwork: "tcp", expAddress: ":8080"},
+		{name: "IPv6", in: "tcp6://[::1]:8443", expNetwork: "tcp6", expAddress: "[::1]:8443"},
+		{name: "Unix", in: "unix:/run/menu.sock", expNetwork: "unix", expAddress: "/run/menu.sock"},
+		{name: "Unix url", in: "unix:///run/menu.sock", expNetwork: "unix", expAddress: "/run/menu.sock"},
+		{name: "Systemd", in: "systemd", expNetwork: "systemd"},
+		{name: "Missing port", in: "localhost", wantErr: true},
+		{name: "Unsupported network", in: "udp://:53", wantErr: true},
+		{name: "Missing socket path", in: "unix:", wantErr: true},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				network, address, err := parseListenAddr(tc.in)
+				if (err != nil) != tc.wantErr {
+					t.Fatalf("wantErr %v got %v\n", tc.wantErr, err)
+				}
+				if network != tc.expNetwork || address != tc.expAddress {
+					t.Errorf("Expected %v %v got %v %v\n", tc.expNetwork, tc.expAddress, network, address)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "menu.sock")
+	listeners, err := openListeners([]string{"127.0.0.1:0", "unix:" + socket})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(listeners) != 2 || listeners[0].Addr().Network() != "tcp" || listeners[1].Addr().Network() != "unix" {
+		t.Fatalf("Unexpected listeners %v\n", listeners)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })}
+	for _, l := range listeners {
+		go srv.Serve(l)
+	}
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{Dial: func(_, _ string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}}}
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("Unexpected body %q\n", body)
+	}
+
+	//no listener may stay open if one address fails
+	if _, err := openListeners([]string{"127.0.0.1:0", "systemd"}); err == nil {
+		t.Errorf("Expected error without systemd sockets\n")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	type testCase struct {
+		name      string
+		publicURL string
+		host      string
+		expTarget string
+	}
+
+	tests := []*testCase{
+		{name: "From request", host: "menu.example.org", expTarget: "https://menu.example.org/api/v1/menu?date=2020-11-16"},
+		{name: "Strip port", host: "menu.example.org:80", expTarget: "https://menu.example.org/api/v1/menu?date=2020-11-16"},
+		{name: "IPv6", host: "[::1]:80", expTarget: "https://[::1]/api/v1/menu?date=2020-11-16"},
+		{name: "Public url", publicURL: "https://menu.example.org:8443/", host: "10.0.0.1", expTarget: "https://menu.example.org:8443/api/v1/menu?date=2020-11-16"},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				cfg := defaultConfig()
+				cfg.PublicURL = tc.publicURL
+				app := &application{cfg: cfg}
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/menu?date=2020-11-16", nil)
+				r.Host = tc.host
+				rec := httptest.NewRecorder()
+				app.redirectToHTTPS(rec, r)
+				if rec.Code != http.StatusMovedPermanently {
+					t.Fatalf("Expected status %v got %v\n", http.StatusMovedPermanently, rec.Code)
+				}
+				if got := rec.Header().Get("Location"); got != tc.expTarget {
+					t.Errorf("Expected %v got %v\n", tc.expTarget, got)
+				}
+			})
+		}(v)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+logLevel, orders log entries by severity
+*/
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+/*
+parseLogLevel, parses one of "debug", "info", "warn" or "error"
+*/
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("parseLogLevel: unknown log level %q", s)
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+/*
+structuredLogger, writes one json object per entry. All methods are safe to call on a nil logger, which discards
+every entry
+*/
+type structuredLogger struct {
+	lock sync.Mutex
+	out  io.Writer
+	//entries below level are discarded, accessed atomically so that it can be changed at runtime
+	level int32
+}
+
+func newStructuredLogger(out io.Writer, level logLevel) *structuredLogger {
+	return &structuredLogger{out: out, level: int32(level)}
+}
+
+/*
+SetLevel, changes the minimal level of logged entries
+*/
+func (l *structuredLogger) SetLevel(level logLevel) {
+	if l == nil {
+		return
+	}
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+/*
+Log, writes msg with level and the key value pairs in fields, e.g. Log(levelInfo, "refresh done", "week", "2020-W47")
+*/
+func (l *structuredLogger) Log(level logLevel, msg string, fields ...interface{}) {
+	if l == nil || int32(level) < atomic.LoadInt32(&l.level) {
+		return
+	}
+	entry := make(map[string]interface{}, 3+len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if err, ok := fields[i+1].(error); ok {
+			entry[key] = err.Error()
+		} else {
+			entry[key] = fields[i+1]
+		}
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(entry); err != nil {
+		buf.Reset()
+		fmt.Fprintf(buf, "{\"level\":\"error\",\"msg\":\"failed to encode log entry: %v\"}\n", err)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func (l *structuredLogger) Debug(msg string, fields ...interface{}) {
+	l.Log(levelDebug, msg, fields...)
+}
+
+func (l *structuredLogger) Info(msg string, fields ...interface{}) {
+	l.Log(levelInfo, msg, fields...)
+}
+
+func (l *structuredLogger) Warn(msg string, fields ...interface{}) {
+	l.Log(levelWarn, msg, fields...)
+}
+
+func (l *structuredLogger) Error(msg string, fields ...interface{}) {
+	l.Log(levelError, msg, fields...)
+}
+
+/*
+logWriter, turns every line written by a log.Logger into an entry of the structuredLogger
+*/
+type logWriter struct {
+	logger *structuredLogger
+	level  logLevel
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Log(w.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+/*
+Writer, returns a writer for log.New that logs every line with level
+*/
+func (l *structuredLogger) Writer(level logLevel) io.Writer {
+	return &logWriter{logger: l, level: level}
+}
+
+type contextKey string
+
+const requestIDKey = contextKey("requestID")
+
+const apiKeyKey = contextKey("apiKey")
+
+/*
+requestID, returns the id assigned to the request by the requestID middleware or an empty string
+*/
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := newStructuredLogger(buf, levelInfo)
+	logger.Debug("discarded")
+	logger.Info("parsed pdf", "week", "2020-W47", "dishes", 20)
+	logger.Error("refresh failed", "error", errors.New("boom"))
+	log.New(logger.Writer(levelWarn), "", 0).Printf("legacy %v\n", "line")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries got %v\n", lines)
+	}
+	entries := make([]map[string]interface{}, 0, len(lines))
+	for _, l := range lines {
+		e := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		entries = append(entries, e)
+	}
+	if entries[0]["level"] != "info" || entries[0]["week"] != "2020-W47" || entries[0]["dishes"] != float64(20) {
+		t.Errorf("Unexpected entry %v\n", lines[0])
+	}
+	if entries[1]["level"] != "error" || entries[1]["error"] != "boom" {
+		t.Errorf("Unexpected entry %v\n", lines[1])
+	}
+	if entries[2]["level"] != "warn" || entries[2]["msg"] != "legacy line" {
+		t.Errorf("Unexpected entry %v\n", lines[2])
+	}
+
+	buf.Reset()
+	logger.SetLevel(levelError)
+	logger.Info("discarded")
+	if buf.Len() != 0 {
+		t.Errorf("Expected no output below level got %v\n", buf.String())
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	buf := new(bytes.Buffer)
+	app := &application{
+		logger:   newStructuredLogger(buf, levelInfo),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	srv := app.routes()
+
+	type testCase struct {
+		name       string
+		requestID  string
+		expGivenID bool
+	}
+
+	tests := []*testCase{
+		{name: "Generated id"},
+		{name: "Client id", requestID: "abc-123", expGivenID: true},
+		{name: "Invalid client id", requestID: "evil\nid"},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				buf.Reset()
+				req := httptest.NewRequest(http.MethodGet, "/alive", nil)
+				if tc.requestID != "" {
+					req.Header.Set("X-Request-ID", tc.requestID)
+				}
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, req)
+
+				id := rec.Header().Get("X-Request-ID")
+				if id == "" || (id == tc.requestID) != tc.expGivenID {
+					t.Errorf("Unexpected request id %q\n", id)
+				}
+				var entry struct {
+					RequestID string `json:"requestId"`
+					Status    int    `json:"status"`
+					Size      int    `json:"size"`
+				}
+				if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if entry.RequestID != id || entry.Status != http.StatusOK || entry.Size != rec.Body.Len() {
+					t.Errorf("Unexpected log entry %v\n", buf.String())
+				}
+			})
+		}(v)
+	}
+}
@@ -2,87 +2,463 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
 	"github.com/go-co-op/gocron"
 )
 
 const (
 	/*
-		ENV_SERVER_LISTEN, configures where the server should listen. E.g. use :80 to listen on port 80 on all interfaces
+		ENV_CONFIG_FILE, path of the yaml config file. Every setting of the config file can be overridden by the
+		environment variables below. If empty, only the environment variables are used
+	*/
+	ENV_CONFIG_FILE = "CONFIG_FILE"
+	/*
+		ENV_SERVER_LISTEN, comma separated list of addresses the server listens on. E.g. use :80 to listen on port 80
+		on all ipv4 interfaces, see parseListenAddr for ipv6, unix sockets and systemd socket activation
 	*/
 	ENV_SERVER_LISTEN = "SERVER_LISTEN"
 	/*
-		ENV_USE_SSL, control whether ssl should be used. If set to "true" we expect a "cert.pem" and a "privkey.pem"
-		file in the "private" subfolder
+		ENV_REDIRECT_LISTEN, comma separated list of addresses on which plain http requests are redirected to https.
+		Requires ENV_USE_SSL
+	*/
+	ENV_REDIRECT_LISTEN = "REDIRECT_LISTEN"
+	/*
+		ENV_LOG_LEVEL, minimal level of the json logs. One of debug, info, warn and error. Defaults to info
+	*/
+	ENV_LOG_LEVEL = "LOG_LEVEL"
+	/*
+		ENV_TRACING_EXPORTER, "otlp" exports trace spans to ENV_OTLP_ENDPOINT, "stdout" prints them. If empty
+		tracing is disabled
+	*/
+	ENV_TRACING_EXPORTER = "TRACING_EXPORTER"
+	/*
+		ENV_OTLP_ENDPOINT, host:port of the OTLP/HTTP collector. Defaults to localhost:4318
+	*/
+	ENV_OTLP_ENDPOINT = "OTLP_ENDPOINT"
+	/*
+		ENV_OTLP_INSECURE, if set to "true" the collector is contacted via http instead of https
+	*/
+	ENV_OTLP_INSECURE = "OTLP_INSECURE"
+	/*
+		ENV_USE_SSL, control whether ssl should be used. If set to "true" the certificate and private key are read
+		from ENV_SSL_CERT_PATH and ENV_SSL_PRIVKEY_PATH. Changed files are picked up without restart
 	*/
 	ENV_USE_SSL          = "USE_SSL"
 	ENV_SSL_CERT_PATH    = "SSL_CERT_PATH"
 	ENV_SSL_PRIVKEY_PATH = "SSL_PRIVKEY_PATH"
+	/*
+		ENV_PUBLIC_URL, the url under which clients reach the service, e.g. https://menu.example.org. Used for
+		absolute links. If empty the url is derived from the request
+	*/
+	ENV_PUBLIC_URL = "PUBLIC_URL"
+	/*
+		ENV_DATA_DIR, directory for persistent state like registered webhooks. Defaults to "data"
+	*/
+	ENV_DATA_DIR = "DATA_DIR"
+	/*
+		ENV_ADMIN_TOKEN, bearer token for the /admin api. If empty the admin api is disabled
+	*/
+	ENV_ADMIN_TOKEN = "ADMIN_TOKEN"
+	/*
+		ENV_MENU_SOURCE_URL, page linking the menu PDFs. Defaults to MenuBaseURL
+	*/
+	ENV_MENU_SOURCE_URL = "MENU_SOURCE_URL"
+	/*
+		ENV_REFRESH_TIME, time of day in the format hh:mm at which the menu is refreshed. Defaults to 01:00
+	*/
+	ENV_REFRESH_TIME = "REFRESH_TIME"
+	/*
+		ENV_DAYS_AHEAD, requests for uncached dates at most this many days ahead trigger a refresh. Defaults to 7
+	*/
+	ENV_DAYS_AHEAD = "DAYS_AHEAD"
+	/*
+		ENV_WEBHOOK_URLS, comma separated list of urls that are notified about new or changed plans
+	*/
+	ENV_WEBHOOK_URLS = "WEBHOOK_URLS"
+	/*
+		ENV_WEBHOOK_SECRET, secret for signing the payloads sent to ENV_WEBHOOK_URLS
+	*/
+	ENV_WEBHOOK_SECRET = "WEBHOOK_SECRET"
+	/*
+		ENV_SLASH_COMMAND_TOKEN, token Slack/Mattermost send with the /lunch slash command. If empty the slash
+		command endpoint is disabled
+	*/
+	ENV_SLASH_COMMAND_TOKEN = "SLASH_COMMAND_TOKEN"
+	/*
+		ENV_CHAT_WEBHOOK_URL, Slack/Mattermost incoming webhook that receives today's menu every day
+	*/
+	ENV_CHAT_WEBHOOK_URL = "CHAT_WEBHOOK_URL"
+	/*
+		ENV_CHAT_POST_TIME, time of day in the format hh:mm at which ENV_CHAT_WEBHOOK_URL receives today's menu.
+		Defaults to 11:00
+	*/
+	ENV_CHAT_POST_TIME = "CHAT_POST_TIME"
+	/*
+		ENV_MQTT_BROKER, url of the MQTT broker that receives today's and tomorrow's menu, e.g. tcp://localhost:1883
+		or ssl://broker:8883 for tls. If empty, nothing is published
+	*/
+	ENV_MQTT_BROKER         = "MQTT_BROKER"
+	ENV_MQTT_USERNAME       = "MQTT_USERNAME"
+	ENV_MQTT_PASSWORD       = "MQTT_PASSWORD"
+	ENV_MQTT_CA_FILE        = "MQTT_CA_FILE"
+	ENV_MQTT_TOPIC_TODAY    = "MQTT_TOPIC_TODAY"
+	ENV_MQTT_TOPIC_TOMORROW = "MQTT_TOPIC_TOMORROW"
+	/*
+		ENV_MQTT_HA_DISCOVERY, if set to "false" no Home Assistant discovery payloads are published
+	*/
+	ENV_MQTT_HA_DISCOVERY = "MQTT_HA_DISCOVERY"
+	/*
+		ENV_SMTP_HOST, mail server used to send the weekly digest to the subscribers. If empty no digest is sent.
+		Requires ENV_PUBLIC_URL for the unsubscribe links
+	*/
+	ENV_SMTP_HOST = "SMTP_HOST"
+	/*
+		ENV_SMTP_PORT, port of ENV_SMTP_HOST. Defaults to 587
+	*/
+	ENV_SMTP_PORT     = "SMTP_PORT"
+	ENV_SMTP_USERNAME = "SMTP_USERNAME"
+	ENV_SMTP_PASSWORD = "SMTP_PASSWORD"
+	/*
+		ENV_SMTP_FROM, sender address of the digest
+	*/
+	ENV_SMTP_FROM = "SMTP_FROM"
+	/*
+		ENV_DIGEST_TIME, time of day in the format hh:mm at which the digest is sent every Monday. Defaults to 07:00
+	*/
+	ENV_DIGEST_TIME = "DIGEST_TIME"
 )
 
 type application struct {
+	//Structured json logs, concurrency safe. errorLog and infoLog write to it
+	logger *structuredLogger
 	//Concurrency safe
 	errorLog *log.Logger
 	//Concurrency safe
 	infoLog *log.Logger
-	//Run jobs at specific times ar after a certain amount of time
+	//Protects cfg, which is replaced on reload
+	cfgLock sync.RWMutex
+	cfg     *Config
+	//Config file reloaded on SIGHUP, may be empty
+	cfgPath string
+	//Run jobs at specific times ar after a certain amount of time. Replaced by scheduleJobs
 	scheduler *gocron.Scheduler
 	//Data Model for served Dishes
 	menuModel *MenuCache
+	//Parsed html templates by page name
+	templateCache map[string]*template.Template
+	//Notifies webhooks about new or changed plans
+	webhooks *WebhookNotifier
+	//Recipients of the weekly email digest
+	subscribers *SubscriberStore
+	//Notifies about dishes matching user defined keywords
+	alerts *AlertNotifier
+	//Manual corrections of parsed dishes, applied by menuModel
+	corrections *CorrectionStore
+	//Errors in the menu reported by users
+	reports *ReportStore
+	//The original PDFs of all plans
+	archive *PlanArchive
+	//Rendered responses of the current version of menuModel, see serveVersioned
+	responses responseCache
+	//Request rate per api key or client ip, see limitRequests
+	limiter rateLimiter
+	//Requests per api key and day, see limitRequests
+	quotas quotaCounter
+	//Background refreshes, uploads and parses that outlive their request
+	jobs jobStore
+	//Parses the PDFs passed to POST /parse
+	parsePDF adHocParser
+	//Limits the concurrent calls of parsePDF, nil if POST /parse is disabled
+	parseSlots chan struct{}
+	//Checks the external programs used by the parser for the health endpoints
+	tools *toolChecker
+	//Publishes the menu to MQTT, nil if disabled
+	mqtt *MQTTPublisher
+	//Sends the weekly digest, nil if disabled
+	mailer *DigestMailer
+	//Provides the tls certificate, nil if ssl is disabled
+	certs *certReloader
+}
+
+/*
+scheduleJobs, replaces the running scheduler with one running the jobs configured in cfg
+*/
+func (app *application) scheduleJobs(cfg *Config) error {
+	scheduler, err := app.newScheduler(cfg)
+	if err != nil {
+		return fmt.Errorf("scheduleJobs: %v", err)
+	}
+	app.startScheduler(scheduler)
+	return nil
+}
+
+/*
+newScheduler, returns a scheduler with the jobs configured in cfg without starting it
+*/
+func (app *application) newScheduler(cfg *Config) (*gocron.Scheduler, error) {
+	scheduler := gocron.NewScheduler(time.Local)
+
+	//refresh daily to reduce risk of long query due to refresh
+	_, err := scheduler.Every(1).Day().At(cfg.Menu.RefreshTime).Do(func() {
+		err := app.menuModel.Refresh()
+		if err != nil {
+			app.errorLog.Printf("Peridic menuModel.Refresh call failed\n")
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newScheduler: failed to schedule refresh: %v", err)
+	}
+	app.infoLog.Printf("Registered periodic call to menuModel.Refresh at %v\n", cfg.Menu.RefreshTime)
+
+	if cfg.Chat.WebhookURL != "" {
+		if _, err := scheduler.Every(1).Day().At(cfg.Chat.PostTime).Do(app.postDailyMenu, cfg.Chat.WebhookURL); err != nil {
+			return nil, fmt.Errorf("newScheduler: failed to schedule daily chat post: %v", err)
+		}
+		app.infoLog.Printf("Registered daily chat post at %v\n", cfg.Chat.PostTime)
+	}
+
+	if app.mqtt != nil {
+		//tomorrow becomes today at midnight
+		if _, err := scheduler.Every(1).Day().At("00:00").Do(app.mqtt.Publish); err != nil {
+			return nil, fmt.Errorf("newScheduler: failed to schedule mqtt publish: %v", err)
+		}
+	}
+
+	if app.mailer != nil {
+		if _, err := scheduler.Every(1).Monday().At(cfg.SMTP.DigestTime).Do(app.mailer.SendAll); err != nil {
+			return nil, fmt.Errorf("newScheduler: failed to schedule weekly digest: %v", err)
+		}
+		app.infoLog.Printf("Registered weekly digest on Monday at %v\n", cfg.SMTP.DigestTime)
+	}
+
+	return scheduler, nil
+}
+
+/*
+startScheduler, stops the running scheduler and starts scheduler instead
+*/
+func (app *application) startScheduler(scheduler *gocron.Scheduler) {
+	if app.scheduler != nil {
+		app.scheduler.Stop()
+	}
+	app.scheduler = scheduler
+	app.scheduler.StartAsync()
 }
 
 func main() {
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	cfgPath := os.Getenv(ENV_CONFIG_FILE)
+	cfg, err := loadConfig(cfgPath, os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	//validated by loadConfig
+	level, _ := parseLogLevel(cfg.LogLevel)
+	logger := newStructuredLogger(os.Stdout, level)
+	infoLog := log.New(logger.Writer(levelInfo), "", 0)
+	errorLog := log.New(logger.Writer(levelError), "", log.Lshortfile)
+
+	parser.CommandTimeout = cfg.Parser.CommandTimeout.Duration
+
+	shutdownTracing, err := setupTracing(&tracingConfig{
+		exporter: cfg.Tracing.Exporter,
+		endpoint: cfg.Tracing.Endpoint,
+		insecure: cfg.Tracing.Insecure,
+	})
+	if err != nil {
+		errorLog.Fatalf("setupTracing: %v", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			errorLog.Printf("Failed to flush trace spans: %v\n", err)
+		}
+	}()
+
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		errorLog.Fatalf("newTemplateCache: %v", err)
+	}
+
+	webhooks, err := NewWebhookNotifier(cfg.DataDir, cfg.Webhooks.URLs, cfg.Webhooks.Secret, cfg.PublicURL, errorLog, infoLog)
+	if err != nil {
+		errorLog.Fatalf("NewWebhookNotifier: %v", err)
+	}
+
+	subscribers, err := NewSubscriberStore(cfg.DataDir)
+	if err != nil {
+		errorLog.Fatalf("NewSubscriberStore: %v", err)
+	}
+
+	corrections, err := NewCorrectionStore(cfg.DataDir)
+	if err != nil {
+		errorLog.Fatalf("NewCorrectionStore: %v", err)
+	}
+
+	reports, err := NewReportStore(cfg.DataDir)
+	if err != nil {
+		errorLog.Fatalf("NewReportStore: %v", err)
+	}
+
+	archive, err := NewPlanArchive(cfg.DataDir, parser.PDFToPngContext)
+	if err != nil {
+		errorLog.Fatalf("NewPlanArchive: %v", err)
+	}
 
-	addr := os.Getenv(ENV_SERVER_LISTEN)
-	if addr == "" {
-		addr = ":8080"
+	history, err := loadPlanHashes(filepath.Join(cfg.DataDir, "plan-history.json"))
+	if err != nil {
+		errorLog.Fatalf("loadPlanHashes: %v", err)
 	}
 
-	mc, err := NewMenuCache(errorLog, infoLog)
+	mc, err := NewMenuCache(cfg.Menu.SourceURL, cfg.Menu.DaysAhead, corrections, archive, history, logger, errorLog, infoLog)
 	if err != nil {
 		errorLog.Fatalf("NewMenuCache: %v", err)
 	}
+	registerMenuMetrics(mc)
+	mc.Subscribe(webhooks.Notify)
+	//the initial refresh ran before Notify was subscribed
+	if err := webhooks.NotifyMissed(mc.CachedWeeks()); err != nil {
+		errorLog.Printf("%v\n", err)
+	}
 
 	app := &application{
-		errorLog:  errorLog,
-		infoLog:   infoLog,
-		scheduler: gocron.NewScheduler(time.Local),
-		menuModel: mc,
+		logger:        logger,
+		errorLog:      errorLog,
+		infoLog:       infoLog,
+		cfg:           cfg,
+		cfgPath:       cfgPath,
+		menuModel:     mc,
+		templateCache: templateCache,
+		webhooks:      webhooks,
+		subscribers:   subscribers,
+		corrections:   corrections,
+		reports:       reports,
+		archive:       archive,
+		tools:         newToolChecker(),
+		parsePDF:      parser.PDFToDishesInYearContext,
+	}
+	if cfg.Parser.AdHocConcurrency > 0 {
+		app.parseSlots = make(chan struct{}, cfg.Parser.AdHocConcurrency)
 	}
 
-	//refresh daily to reduce risk of long query due to refresh
-	_, err = app.scheduler.Every(1).Day().At("01:00").Do(func() {
-		err := app.menuModel.Refresh()
-		if err != nil {
-			app.errorLog.Printf("Peridic menuModel.Refresh call failed\n")
+	if cfg.SMTP.Host != "" {
+		smtpCfg := &smtpConfig{
+			host:     cfg.SMTP.Host,
+			port:     cfg.SMTP.Port,
+			username: cfg.SMTP.Username,
+			password: cfg.SMTP.Password,
+			from:     cfg.SMTP.From,
+		}
+		if app.mailer, err = NewDigestMailer(smtpCfg, subscribers, mc, cfg.PublicURL, errorLog, infoLog); err != nil {
+			errorLog.Fatalf("NewDigestMailer: %v", err)
 		}
-	})
-	if err != nil {
-		app.errorLog.Fatalf("Failed to scheule refresh job: %v", err)
 	}
-	app.scheduler.StartAsync()
-	app.infoLog.Printf("Registered periodic call to menuModel.Refresh\n")
 
-	// Set the server's TLSConfig field to use the tlsConfig variable we just
-	// created.
+	chatClient := &http.Client{Timeout: 10 * time.Second}
+	chatAlerts := func(_ *Alert, text string) error {
+		//the chat webhook may change on reload
+		chatWebhookURL := app.config().Chat.WebhookURL
+		if chatWebhookURL == "" {
+			return nil
+		}
+		return postToChat(chatClient, chatWebhookURL, "Menu alert: "+text)
+	}
+	var mailAlerts alertChannel
+	if app.mailer != nil {
+		mailAlerts = func(a *Alert, text string) error {
+			return app.mailer.SendText(a.Email, "UKSH Bistro Lübeck: menu alert", alertMailText(app.mailer.baseURL, a, text))
+		}
+	}
+	if app.alerts, err = NewAlertNotifier(cfg.DataDir, chatAlerts, mailAlerts, errorLog, infoLog); err != nil {
+		errorLog.Fatalf("NewAlertNotifier: %v", err)
+	}
+	mc.Subscribe(app.alerts.Notify)
+	//the initial refresh ran before Notify was subscribed
+	if err := app.alerts.NotifyMissed(mc.CachedWeeks()); err != nil {
+		errorLog.Printf("%v\n", err)
+	}
+
+	if cfg.MQTT.Broker != "" {
+		mqttCfg := &mqttConfig{
+			broker:        cfg.MQTT.Broker,
+			username:      cfg.MQTT.Username,
+			password:      cfg.MQTT.Password,
+			caFile:        cfg.MQTT.CAFile,
+			todayTopic:    cfg.MQTT.TopicToday,
+			tomorrowTopic: cfg.MQTT.TopicTomorrow,
+		}
+		if cfg.MQTT.HADiscovery {
+			mqttCfg.discoveryPrefix = "homeassistant"
+		}
+		if app.mqtt, err = NewMQTTPublisher(mqttCfg, mc, errorLog, infoLog); err != nil {
+			errorLog.Fatalf("NewMQTTPublisher: %v", err)
+		}
+		stopMQTT := app.mqtt.Watch()
+		defer stopMQTT()
+		go app.mqtt.Publish()
+		app.infoLog.Printf("Publishing menu to MQTT broker %v\n", cfg.MQTT.Broker)
+	}
+
+	if err := app.scheduleJobs(cfg); err != nil {
+		app.errorLog.Fatalf("%v", err)
+	}
+
+	//the write timeout is set per request by limitWriteTime, so that /v1/events can stream for longer
 	srv := &http.Server{
-		Addr:         addr,
-		Handler:      app.routes(),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  time.Minute,
-		ErrorLog:     errorLog,
+		Handler:     app.routes(),
+		ReadTimeout: cfg.Server.ReadTimeout.Duration,
+		IdleTimeout: cfg.Server.IdleTimeout.Duration,
+		ErrorLog:    errorLog,
+	}
+	if cfg.Server.UseSSL {
+		if app.certs, err = newCertReloader(cfg.Server.CertPath, cfg.Server.PrivKeyPath, logger); err != nil {
+			errorLog.Fatalf("%v", err)
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: app.certs.GetCertificate}
+	}
+	servers := []*http.Server{srv}
+	if len(cfg.Server.RedirectListen) > 0 {
+		servers = append(servers, &http.Server{
+			Handler:      http.HandlerFunc(app.redirectToHTTPS),
+			ReadTimeout:  cfg.Server.ReadTimeout.Duration,
+			WriteTimeout: cfg.Server.WriteTimeout.Duration,
+			IdleTimeout:  cfg.Server.IdleTimeout.Duration,
+			ErrorLog:     errorLog,
+		})
+	}
+
+	listeners, err := openListeners(cfg.Server.Listen)
+	if err != nil {
+		errorLog.Fatalf("%v", err)
+	}
+	redirectListeners, err := openListeners(cfg.Server.RedirectListen)
+	if err != nil {
+		errorLog.Fatalf("%v", err)
 	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			app.infoLog.Printf("Got reload signal")
+			if err := app.reload(); err != nil {
+				app.errorLog.Printf("Keeping old config: %v\n", err)
+			}
+		}
+	}()
+
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, os.Interrupt)
 	var wg sync.WaitGroup
@@ -93,25 +469,40 @@ func main() {
 		app.infoLog.Printf("Got terminate signal")
 		shutdownCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
 		defer cancel()
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			app.errorLog.Printf("Clean shutdown failed: %v\n", err)
-		} else {
+		clean := true
+		for _, s := range servers {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				app.errorLog.Printf("Clean shutdown failed: %v\n", err)
+				clean = false
+			}
+		}
+		if clean {
 			app.infoLog.Printf("Clean Shutdown done\n")
 		}
 	}()
 
-	listener, err := net.Listen("tcp4", addr)
-	if err != nil {
-		app.errorLog.Fatalf("Failed to listen on tcp4 %v: %v\n", addr, err)
+	serveErrs := make(chan error, len(listeners)+len(redirectListeners))
+	for _, l := range listeners {
+		infoLog.Printf("Starting server on %v %v", l.Addr().Network(), l.Addr())
+		go func(l net.Listener) {
+			if cfg.Server.UseSSL {
+				//the certificate is provided by srv.TLSConfig
+				serveErrs <- srv.ServeTLS(l, "", "")
+			} else {
+				serveErrs <- srv.Serve(l)
+			}
+		}(l)
 	}
-	infoLog.Printf("Starting server on %s", addr)
-	if os.Getenv(ENV_USE_SSL) == "true" {
-		err = srv.ServeTLS(listener, os.Getenv(ENV_SSL_CERT_PATH), os.Getenv(ENV_SSL_PRIVKEY_PATH))
-	} else {
-		err = srv.Serve(listener)
+	for _, l := range redirectListeners {
+		infoLog.Printf("Redirecting to https on %v %v", l.Addr().Network(), l.Addr())
+		go func(l net.Listener) {
+			serveErrs <- servers[1].Serve(l)
+		}(l)
 	}
-	if err != nil && err != http.ErrServerClosed {
-		errorLog.Fatal(err)
+	for i := 0; i < cap(serveErrs); i++ {
+		if err := <-serveErrs; err != nil && err != http.ErrServerClosed {
+			errorLog.Fatal(err)
+		}
 	}
 	wg.Wait()
 }
@@ -3,16 +3,23 @@ package main
 //go:generate mockgen -source menuCache.go -destination ../../mocks/cmd/web/menuCache.go
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const MenuBaseURL = "https://www.uksh.de/servicesternnord/Unser+Speisenangebot/Speisepl%C3%A4ne+L%C3%BCbeck/UKSH_Bistro+L%C3%BCbeck-p-346.html"
@@ -22,6 +29,31 @@ invDateError is returned when MenuCache deems a date to far in the future or to
 */
 var invDateError = errors.New("date in invalid range")
 
+/*
+unknownWeekError is returned when MenuCache has no plan for the requested iso week
+*/
+var unknownWeekError = errors.New("week not available")
+
+/*
+upstreamError is returned when the UKSH website or the PDFs cannot be downloaded
+*/
+var upstreamError = errors.New("upstream unavailable")
+
+/*
+notPublishedError is returned when the date is in the valid range but the UKSH did not publish a plan for it yet
+*/
+var notPublishedError = errors.New("menu not published yet")
+
+/*
+uploadSource is the WeekPlan.Source of plans uploaded via the admin api
+*/
+const uploadSource = "upload"
+
+/*
+maxPlanUpdates is the amount of PlanUpdate values MenuCache remembers
+*/
+const maxPlanUpdates = 20
+
 /*
 roundToDay helper function that truncates time from t
 */
@@ -29,27 +61,139 @@ func roundToDay(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 }
 
+/*
+WeekPlan is the parsed content of a single menu PDF
+*/
+type WeekPlan struct {
+	Year int
+	Week int
+	//hex encoded sha256 of the source PDF
+	Hash string
+	//url the PDF was downloaded from or uploadSource
+	Source string
+	//parser output with the corrections applied
+	Dishes []*parser.Dish
+	//parser output, kept to reapply changed corrections
+	parsed []*parser.Dish
+	//names of the manually corrected fields by parser.Dish.ID
+	edited map[string][]string
+	//png of the cell of the plan the price was read from via OCR by parser.Dish.ID
+	tiles map[string][]byte
+	//dishes that look incomplete, usually due to OCR glitches
+	Warnings []string
+	//time the plan was first seen
+	Published time.Time
+	//time the plan was last seen with a different Hash
+	Updated time.Time
+}
+
+/*
+dishInfo, is what is known about a dish of a WeekPlan besides the parser.Dish itself
+*/
+type dishInfo struct {
+	//names of the fields corrected manually after parsing
+	edited []string
+	//nil for dishes not parsed from a plan
+	tile []byte
+}
+
+/*
+dishInfo, returns the dishInfo of d. A nil WeekPlan returns the zero value
+*/
+func (p *WeekPlan) dishInfo(d *parser.Dish) dishInfo {
+	if p == nil {
+		return dishInfo{}
+	}
+	return dishInfo{edited: p.edited[d.ID()], tile: p.tiles[d.ID()]}
+}
+
+/*
+PlanUpdate records that Refresh found a new or changed WeekPlan
+*/
+type PlanUpdate struct {
+	Plan    *WeekPlan
+	Changed bool
+	//days whose dishes differ from the previous plan. Contains all days of new plans
+	ChangedDays []time.Time
+}
+
+/*
+PlanListener is called with every PlanUpdate found by MenuCache.Refresh. It is called without holding any lock
+of the MenuCache and must not block for long
+*/
+type PlanListener func(u *PlanUpdate)
+
+/*
+RefreshListener is called after every call to MenuCache.Refresh with its result. Same rules as for PlanListener
+apply
+*/
+type RefreshListener func(err error)
+
+type weekKey struct {
+	year int
+	week int
+}
+
 /*
 MenuCache is a cached Data Model for parser.Dish values served on a day
 */
 type MenuCache struct {
-	lock         sync.RWMutex
+	lock sync.RWMutex
+	//serializes refreshes, which download and parse without holding lock
+	refreshLock  sync.Mutex
 	dateToDishes map[time.Time][]*parser.Dish
-	download     Downloader
-	parse        parser.UKSHParserI
-	errorLog     *log.Logger
-	infoLog      *log.Logger
+	//plans survive Refresh calls, so that we can detect new or changed plans
+	plans map[weekKey]*WeekPlan
+	//newest first, at most maxPlanUpdates entries
+	updates   []*PlanUpdate
+	listeners []PlanListener
+	//called after every refresh
+	refreshListeners []RefreshListener
+	//time and result of the last refresh
+	lastRefresh      time.Time
+	lastRefreshError error
+	//time of the last refresh that succeeded
+	lastSuccessfulRefresh time.Time
+	download              Downloader
+	parse                 parser.UKSHParserI
+	//page linking the PDFs, MenuBaseURL if empty
+	sourceURL string
+	//dates at most this many days ahead trigger a refresh if uncached, 7 if zero
+	daysAhead int
+	//manual corrections applied on top of the parser output, may be nil
+	corrections *CorrectionStore
+	//keeps the PDFs of new or changed plans, may be nil
+	archive *PlanArchive
+	//keeps Published and Updated of the plans across restarts, may be nil
+	history *planHashes
+	//time of the last change of the cached dishes or plans, the version of the cache
+	modified time.Time
+	//signaled by touch, see Watch
+	watchers map[chan struct{}]bool
+	//id of the current or last refresh, logged with every refresh event
+	run      string
+	logger   *structuredLogger
+	errorLog *log.Logger
+	infoLog  *log.Logger
 }
 
 /*
-NewMenuCache creates and fills a new MenuCache.
+NewMenuCache creates and fills a new MenuCache. The PDFs are linked on sourceURL, see Configure for daysAhead.
+corrections, archive and history may be nil
 */
-func NewMenuCache(errorLog, infoLog *log.Logger) (*MenuCache, error) {
+func NewMenuCache(sourceURL string, daysAhead int, corrections *CorrectionStore, archive *PlanArchive, history *planHashes, logger *structuredLogger, errorLog, infoLog *log.Logger) (*MenuCache, error) {
 	mc := &MenuCache{
 		lock:         sync.RWMutex{},
 		dateToDishes: nil,
+		plans:        make(map[weekKey]*WeekPlan),
 		download:     &realDownloader{},
 		parse:        &parser.UKSHParser{},
+		sourceURL:    sourceURL,
+		daysAhead:    daysAhead,
+		corrections:  corrections,
+		archive:      archive,
+		history:      history,
+		logger:       logger,
 		errorLog:     errorLog,
 		infoLog:      infoLog,
 	}
@@ -59,17 +203,122 @@ func NewMenuCache(errorLog, infoLog *log.Logger) (*MenuCache, error) {
 	return mc, nil
 }
 
+/*
+Configure, sets the page linking the PDFs and how many days ahead a request for an uncached date triggers a
+refresh. Takes effect with the next refresh
+*/
+func (mc *MenuCache) Configure(sourceURL string, daysAhead int) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.sourceURL = sourceURL
+	mc.daysAhead = daysAhead
+}
+
+/*
+Subscribe, registers l to be called for every new or changed plan found by Refresh
+*/
+func (mc *MenuCache) Subscribe(l PlanListener) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.listeners = append(mc.listeners, l)
+}
+
+/*
+SubscribeRefresh, registers l to be called after every Refresh
+*/
+func (mc *MenuCache) SubscribeRefresh(l RefreshListener) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.refreshListeners = append(mc.refreshListeners, l)
+}
+
 /*
 Refresh, fetches the current menuHandler, parses it and completely rebuilds the cache. Calling function may not
-hold mc.lock.RLock() as we call mc.lock.Lock()
+hold mc.lock.RLock() as we call mc.lock.Lock(). Readers are not blocked while the PDFs are downloaded and parsed. Listeners are notified about new or changed plans and about
+the refresh after the lock has been released
 */
 func (mc *MenuCache) Refresh() error {
-	mc.infoLog.Println("Executing MenuCache.Refresh")
+	_, err := mc.RefreshWithUpdates()
+	return err
+}
+
+/*
+RefreshWithUpdates, is Refresh but additionally returns the new or changed plans
+*/
+func (mc *MenuCache) RefreshWithUpdates() ([]*PlanUpdate, error) {
+	ctx, span := tracer.Start(context.Background(), "MenuCache.Refresh")
+	start := time.Now()
+	updates, err := mc.refresh(ctx)
+	observeRefresh(time.Since(start), err)
+	span.SetAttributes(attribute.Int("menu.updates", len(updates)))
+	endSpan(span, err)
+
 	mc.lock.Lock()
-	defer mc.lock.Unlock()
-	pdfs, err := extractPDFsFromMenuSite(mc.download)
+	mc.lastRefresh = start
+	mc.lastRefreshError = err
+	if err == nil {
+		mc.lastSuccessfulRefresh = start
+	}
+	mc.logger.Info("refresh finished", "run", mc.run, "updates", len(updates), "durationMs", time.Since(start).Milliseconds(), "error", err)
+	refreshListeners := make([]RefreshListener, len(mc.refreshListeners))
+	copy(refreshListeners, mc.refreshListeners)
+	mc.lock.Unlock()
+
+	mc.notify(updates)
+	for _, l := range refreshListeners {
+		l(err)
+	}
+	return updates, err
+}
+
+/*
+notify, calls the PlanListener values for every update. Calling function may not hold mc.lock
+*/
+func (mc *MenuCache) notify(updates []*PlanUpdate) {
+	mc.lock.RLock()
+	listeners := make([]PlanListener, len(mc.listeners))
+	copy(listeners, mc.listeners)
+	mc.lock.RUnlock()
+
+	for _, u := range updates {
+		for _, l := range listeners {
+			l(u)
+		}
+	}
+}
+
+/*
+parsedPDF, is a PDF downloaded and parsed by refresh before it is recorded
+*/
+type parsedPDF struct {
+	pdf    []byte
+	source string
+	dishes []*parser.Dish
+	tiles  map[string][]byte
+}
+
+/*
+refresh, downloads and parses the PDFs without holding mc.lock, so that readers are only blocked while the parsed
+plans replace the cached ones. The cache is kept if any PDF fails
+*/
+func (mc *MenuCache) refresh(ctx context.Context) ([]*PlanUpdate, error) {
+	mc.refreshLock.Lock()
+	defer mc.refreshLock.Unlock()
+	run, err := randomID(4)
+	if err != nil {
+		return nil, err
+	}
+	mc.lock.Lock()
+	mc.run = run
+	sourceURL := mc.sourceURL
+	mc.lock.Unlock()
+	mc.logger.Debug("refresh started", "run", run)
+	if sourceURL == "" {
+		sourceURL = MenuBaseURL
+	}
+	pdfs, links, err := extractPDFsFromMenuSite(ctx, mc.download, sourceURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(pdfs) == 0 {
@@ -78,29 +327,478 @@ func (mc *MenuCache) Refresh() error {
 		mc.infoLog.Printf("Got %v PDFs, unusual high amount", len(pdfs))
 	}
 
-	//clear cache
-	mc.dateToDishes = make(map[time.Time][]*parser.Dish)
-
-	//rebuild cache
+	parsed := make([]*parsedPDF, 0, len(pdfs))
 	for i := range pdfs {
-		dishes, err := mc.parse.PDFToDishes(pdfs[i])
+		start := time.Now()
+		dishes, tiles, err := mc.parsePDF(ctx, pdfs[i])
 		if err != nil {
-			return err
+			mc.logger.Error("failed to parse pdf", "run", run, "pdfHash", pdfHash(pdfs[i]), "error", err)
+			return nil, err
+		}
+		fields := []interface{}{"run", run, "pdfHash", pdfHash(pdfs[i]), "dishes", len(dishes), "durationMs", time.Since(start).Milliseconds()}
+		if len(dishes) > 0 {
+			fields = append(fields, "week", formatISOWeek(dishes[0].Date.ISOWeek()))
 		}
+		mc.logger.Info("parsed pdf", fields...)
+		parsed = append(parsed, &parsedPDF{pdf: pdfs[i], source: links[i], dishes: dishes, tiles: tiles})
+	}
 
-		for j := range dishes {
-			list, ok := mc.dateToDishes[roundToDay(dishes[j].Date)]
-			if !ok {
-				mc.dateToDishes[roundToDay(dishes[j].Date)] = []*parser.Dish{dishes[j]}
-			} else {
-				list = append(list, dishes[j])
-				mc.dateToDishes[roundToDay(dishes[j].Date)] = list
+	//rebuild cache
+	mc.lock.Lock()
+	previous := mc.dateToDishes
+	mc.dateToDishes = make(map[time.Time][]*parser.Dish)
+	//uploaded plans stay cached until they are evicted or the UKSH publishes the same week
+	for _, plan := range mc.plans {
+		if plan.Source == uploadSource {
+			mc.cacheWeek(plan.Year, plan.Week, plan.Dishes)
+		}
+	}
+	now := time.Now()
+	updates := make([]*PlanUpdate, 0)
+	updatedPDFs := make([][]byte, 0)
+	for _, p := range parsed {
+		if u := mc.recordPlan(p.pdf, p.source, p.dishes, p.tiles, now); u != nil {
+			updates = append(updates, u)
+			updatedPDFs = append(updatedPDFs, p.pdf)
+		}
+		if len(p.dishes) > 0 {
+			year, week := p.dishes[0].Date.ISOWeek()
+			mc.cacheWeek(year, week, mc.plans[weekKey{year: year, week: week}].Dishes)
+		}
+	}
+	if !sameDishes(previous, mc.dateToDishes) {
+		mc.touch()
+	}
+	mc.lock.Unlock()
+
+	for i, u := range updates {
+		mc.storePlan(updatedPDFs[i], u.Plan)
+	}
+	return updates, nil
+}
+
+/*
+sameDishes, returns true if a and b cache the same dishes for the same dates
+*/
+func sameDishes(a, b map[time.Time][]*parser.Dish) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for date, dishesA := range a {
+		dishesB, ok := b[date]
+		if !ok || len(dishesA) != len(dishesB) {
+			return false
+		}
+		for i := range dishesA {
+			if dishesA[i] != dishesB[i] {
+				return false
 			}
 		}
 	}
+	return true
+}
+
+/*
+touch, records that the cached dishes or plans changed. Caller must hold mc.lock.Lock()
+*/
+func (mc *MenuCache) touch() {
+	now := time.Now()
+	//strictly increasing, as it is used as version
+	if !now.After(mc.modified) {
+		now = mc.modified.Add(time.Nanosecond)
+	}
+	mc.modified = now
+	for c := range mc.watchers {
+		//a pending signal already tells about this change
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Watch, returns a channel that receives a value after the cached dishes or plans changed, see Modified. Changes
+that happen before the value is received are coalesced. The returned function stops watching
+*/
+func (mc *MenuCache) Watch() (<-chan struct{}, func()) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if mc.watchers == nil {
+		mc.watchers = make(map[chan struct{}]bool)
+	}
+	c := make(chan struct{}, 1)
+	mc.watchers[c] = true
+	return c, func() {
+		mc.lock.Lock()
+		defer mc.lock.Unlock()
+		delete(mc.watchers, c)
+	}
+}
+
+/*
+Modified, returns the time of the last change of the cached dishes or plans. Changes whenever a response
+derived from the cache may change
+*/
+func (mc *MenuCache) Modified() time.Time {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	return mc.modified
+}
+
+/*
+cacheWeek, replaces the cached dishes of the given iso week with dishes. Caller must hold mc.lock.Lock()
+*/
+func (mc *MenuCache) cacheWeek(year, week int, dishes []*parser.Dish) {
+	mc.evictDates(year, week)
+	for j := range dishes {
+		date := roundToDay(dishes[j].Date)
+		mc.dateToDishes[date] = append(mc.dateToDishes[date], dishes[j])
+	}
+}
+
+/*
+evictDates, removes the cached dishes of the given iso week and returns the number of removed days. Caller must
+hold mc.lock.Lock()
+*/
+func (mc *MenuCache) evictDates(year, week int) int {
+	removed := 0
+	for date := range mc.dateToDishes {
+		if y, w := date.ISOWeek(); y == year && w == week {
+			delete(mc.dateToDishes, date)
+			removed++
+		}
+	}
+	return removed
+}
+
+/*
+parsePDF, parses pdf and returns the dishes and their tiles by parser.Dish.ID
+*/
+func (mc *MenuCache) parsePDF(ctx context.Context, pdf []byte) ([]*parser.Dish, map[string][]byte, error) {
+	var lock sync.Mutex
+	tiles := make(map[string][]byte)
+	ctx = parser.WithTileObserver(ctx, func(d *parser.Dish, tile []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		tiles[d.ID()] = tile
+	})
+	dishes, err := mc.parse.PDFToDishesContext(ctx, pdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dishes, tiles, nil
+}
+
+/*
+AddPDF, parses pdf and caches its dishes, replacing the cached dishes of the same week. The plan is kept across
+refreshes until it is evicted or the UKSH publishes the same week. Listeners are notified if the plan is new
+or changed
+*/
+func (mc *MenuCache) AddPDF(ctx context.Context, pdf []byte) (*WeekPlan, error) {
+	dishes, tiles, err := mc.parsePDF(ctx, pdf)
+	if err != nil {
+		return nil, fmt.Errorf("AddPDF: %w", err)
+	}
+	if len(dishes) == 0 {
+		return nil, fmt.Errorf("AddPDF: %w: pdf contains no dishes", badRequestError)
+	}
+	year, week := dishes[0].Date.ISOWeek()
+
+	mc.lock.Lock()
+	u := mc.recordPlan(pdf, uploadSource, dishes, tiles, time.Now())
+	plan := mc.plans[weekKey{year: year, week: week}]
+	if mc.dateToDishes == nil {
+		mc.dateToDishes = make(map[time.Time][]*parser.Dish)
+	}
+	mc.cacheWeek(year, week, plan.Dishes)
+	mc.touch()
+	mc.lock.Unlock()
+
+	if u != nil {
+		mc.storePlan(pdf, u.Plan)
+		mc.notify([]*PlanUpdate{u})
+	}
+	return plan, nil
+}
+
+/*
+ApplyCorrections, reapplies the corrections to all plans and cached dishes. Call after changing the corrections
+*/
+func (mc *MenuCache) ApplyCorrections() {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.touch()
+	for key, plan := range mc.plans {
+		//plans are shared with listeners, so replace instead of modify
+		corrected := *plan
+		corrected.Dishes, corrected.edited = mc.corrections.Apply(plan.parsed)
+		corrected.Warnings = planWarnings(corrected.Dishes)
+		mc.plans[key] = &corrected
+		if mc.evictDates(plan.Year, plan.Week) > 0 {
+			mc.cacheWeek(plan.Year, plan.Week, corrected.Dishes)
+		}
+	}
+}
+
+/*
+EvictWeek, removes the dishes of the given iso week from the cache. Uploaded plans are dropped, downloaded ones
+are cached again by the next refresh
+*/
+func (mc *MenuCache) EvictWeek(year, week int) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	key := weekKey{year: year, week: week}
+	removed := mc.evictDates(year, week)
+	if plan, ok := mc.plans[key]; ok && plan.Source == uploadSource {
+		delete(mc.plans, key)
+		removed++
+	}
+	if removed == 0 {
+		return fmt.Errorf("EvictWeek: %w: %v", unknownWeekError, formatISOWeek(year, week))
+	}
+	mc.touch()
+	mc.logger.Info("evicted week", "week", formatISOWeek(year, week))
 	return nil
 }
 
+/*
+CachedWeeks, returns the plans of all weeks with cached dishes, oldest first
+*/
+func (mc *MenuCache) CachedWeeks() []*WeekPlan {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	seen := make(map[weekKey]bool)
+	res := make([]*WeekPlan, 0)
+	for date := range mc.dateToDishes {
+		year, week := date.ISOWeek()
+		key := weekKey{year: year, week: week}
+		if plan, ok := mc.plans[key]; ok && !seen[key] {
+			seen[key] = true
+			res = append(res, plan)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Year != res[j].Year {
+			return res[i].Year < res[j].Year
+		}
+		return res[i].Week < res[j].Week
+	})
+	return res
+}
+
+/*
+planWarnings, returns a warning for every dish that lacks a title, price or calories
+*/
+func planWarnings(dishes []*parser.Dish) []string {
+	warnings := make([]string, 0)
+	for _, d := range dishes {
+		missing := make([]string, 0, 3)
+		for _, f := range []struct{ name, value string }{{"title", d.Title}, {"price", d.Price}, {"kcal", d.Kcal}} {
+			if strings.TrimSpace(f.value) == "" {
+				missing = append(missing, f.name)
+			}
+		}
+		if len(missing) > 0 {
+			warnings = append(warnings, fmt.Sprintf("%v %v: no %v", d.Date.Format("2006-01-02"), d.Type, strings.Join(missing, ", ")))
+		}
+	}
+	return warnings
+}
+
+/*
+recordPlan, stores dishes and their tiles parsed from pdf, which was obtained from source, as a WeekPlan and
+records and returns
+a PlanUpdate if the plan is new or its pdf changed. Returns nil otherwise. Caller must hold mc.lock.Lock() and
+persist new or changed plans with storePlan after releasing it
+*/
+func (mc *MenuCache) recordPlan(pdf []byte, source string, dishes []*parser.Dish, tiles map[string][]byte, now time.Time) *PlanUpdate {
+	if len(dishes) == 0 {
+		mc.infoLog.Printf("PDF without dishes, cannot determine its week")
+		return nil
+	}
+	if mc.plans == nil {
+		mc.plans = make(map[weekKey]*WeekPlan)
+	}
+	hash := pdfHash(pdf)
+	year, week := dishes[0].Date.ISOWeek()
+	key := weekKey{year: year, week: week}
+
+	old, ok := mc.plans[key]
+	if ok && old.Hash == hash {
+		return nil
+	}
+	corrected, edited := mc.corrections.Apply(dishes)
+	plan := &WeekPlan{
+		Year:      year,
+		Week:      week,
+		Hash:      hash,
+		Source:    source,
+		Dishes:    corrected,
+		parsed:    dishes,
+		edited:    edited,
+		tiles:     tiles,
+		Warnings:  planWarnings(corrected),
+		Published: now,
+		Updated:   now,
+	}
+	update := &PlanUpdate{Plan: plan, Changed: ok}
+	if ok {
+		plan.Published = old.Published
+		update.ChangedDays = changedDays(old.Dishes, corrected)
+		mc.logger.Info("plan changed", "run", mc.run, "pdfHash", hash, "week", formatISOWeek(year, week), "changedDays", len(update.ChangedDays))
+	} else {
+		update.ChangedDays = changedDays(nil, corrected)
+		mc.logger.Info("found new plan", "run", mc.run, "pdfHash", hash, "week", formatISOWeek(year, week))
+	}
+	//not cached but seen before the last restart
+	if rec, known := mc.historyRecord(year, week); !ok && known {
+		plan.Published = rec.Published
+		update.Changed = rec.Hash != hash
+		if !update.Changed {
+			plan.Updated = rec.Updated
+		}
+	}
+	mc.plans[key] = plan
+	mc.touch()
+
+	mc.updates = append([]*PlanUpdate{update}, mc.updates...)
+	if len(mc.updates) > maxPlanUpdates {
+		mc.updates = mc.updates[:maxPlanUpdates]
+	}
+	return update
+}
+
+/*
+historyRecord, returns the record of the given iso week stored before the last restart
+*/
+func (mc *MenuCache) historyRecord(year, week int) (planRecord, bool) {
+	if mc.history == nil {
+		return planRecord{}, false
+	}
+	return mc.history.get(year, week)
+}
+
+/*
+storePlan, archives pdf of the new or changed plan and records its times in the history. Writes to disk, so the
+caller must not hold mc.lock
+*/
+func (mc *MenuCache) storePlan(pdf []byte, plan *WeekPlan) {
+	if err := mc.archive.Store(plan.Year, plan.Week, pdf); err != nil {
+		mc.errorLog.Printf("storePlan: failed to archive pdf of %v: %v\n", formatISOWeek(plan.Year, plan.Week), err)
+	}
+	if mc.history != nil {
+		if err := mc.history.record(plan); err != nil {
+			mc.errorLog.Printf("storePlan: failed to store history of %v: %v\n", formatISOWeek(plan.Year, plan.Week), err)
+		}
+	}
+}
+
+/*
+pdfHash, returns the hex encoded sha256 hash of pdf
+*/
+func pdfHash(pdf []byte) string {
+	hash := sha256.Sum256(pdf)
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+changedDays, returns the days on which the dishes in a and b differ, sorted ascending
+*/
+func changedDays(a, b []*parser.Dish) []time.Time {
+	render := func(dishes []*parser.Dish) map[time.Time]string {
+		res := make(map[time.Time]string)
+		for _, day := range groupByDay(dishes) {
+			var sb strings.Builder
+			for _, d := range day.Dishes {
+				fmt.Fprintf(&sb, "%v|%v|%v|%v|%v|%v\n", d.ColID(), d.Type, d.Title, d.Description, d.Price, d.Kcal)
+			}
+			res[day.Date] = sb.String()
+		}
+		return res
+	}
+	renderedA, renderedB := render(a), render(b)
+
+	days := make([]time.Time, 0)
+	for day, v := range renderedB {
+		if renderedA[day] != v {
+			days = append(days, day)
+		}
+	}
+	for day := range renderedA {
+		if _, ok := renderedB[day]; !ok {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+	return days
+}
+
+/*
+PlanUpdates, returns the most recent PlanUpdate values, newest first
+*/
+func (mc *MenuCache) PlanUpdates() []*PlanUpdate {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	res := make([]*PlanUpdate, len(mc.updates))
+	copy(res, mc.updates)
+	return res
+}
+
+/*
+DishInfo, returns the corrected fields and the tile of d, which must be a cached dish
+*/
+func (mc *MenuCache) DishInfo(d *parser.Dish) dishInfo {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	year, week := d.Date.ISOWeek()
+	return mc.plans[weekKey{year: year, week: week}].dishInfo(d)
+}
+
+/*
+GetWeek, returns the plan for the given iso week if it is cached
+*/
+func (mc *MenuCache) GetWeek(year, week int) (*WeekPlan, error) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	plan, ok := mc.plans[weekKey{year: year, week: week}]
+	if !ok {
+		return nil, fmt.Errorf("GetWeek: %w: %v-W%02d", unknownWeekError, year, week)
+	}
+	return plan, nil
+}
+
+/*
+CachedMenu, returns the dishes for date if they are cached. Unlike GetMenu it never triggers a refresh
+*/
+func (mc *MenuCache) CachedMenu(date time.Time) ([]*parser.Dish, bool) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	dishes, ok := mc.dateToDishes[roundToDay(date)]
+	return dishes, ok
+}
+
+/*
+RefreshStatus, returns the start time of the last refresh, of the last refresh that succeeded and the error of the
+last refresh
+*/
+func (mc *MenuCache) RefreshStatus() (time.Time, time.Time, error) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	return mc.lastRefresh, mc.lastSuccessfulRefresh, mc.lastRefreshError
+}
+
+/*
+CachedDays, returns the number of days for which dishes are cached
+*/
+func (mc *MenuCache) CachedDays() int {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	return len(mc.dateToDishes)
+}
+
 /*
 GetMenu, returns the dishes for date if they have been published yet
 */
@@ -109,24 +807,28 @@ func (mc *MenuCache) GetMenu(date time.Time) ([]*parser.Dish, error) {
 
 	mc.lock.RLock()
 	dishes, ok := mc.dateToDishes[date]
+	daysAhead := mc.daysAhead
 	mc.lock.RUnlock()
 	if !ok {
+		if daysAhead == 0 {
+			daysAhead = 7
+		}
 		//only refresh if date is in valid range
 		if date.Before(roundToDay(time.Now().In(time.Local))) {
 			return nil, fmt.Errorf("GetMenu: %w: %v is in the past", invDateError, date)
 		}
-		if date.After(roundToDay(time.Now()).Add(7 * 24 * time.Hour)) {
-			return nil, fmt.Errorf("GetMenu: %w: %v is more than 7 days in the future", invDateError, date)
+		if date.After(roundToDay(time.Now()).Add(time.Duration(daysAhead) * 24 * time.Hour)) {
+			return nil, fmt.Errorf("GetMenu: %w: %v is more than %v days in the future", invDateError, date, daysAhead)
 		}
 		//Refresh cache; if still not there return error
 		if err := mc.Refresh(); err != nil {
-			return nil, fmt.Errorf("GetMenu: failed to refresh: %v", err)
+			return nil, fmt.Errorf("GetMenu: failed to refresh: %w", err)
 		}
 		mc.lock.RLock()
 		dishes, ok := mc.dateToDishes[date]
 		mc.lock.RUnlock()
 		if !ok {
-			return nil, fmt.Errorf("GetMenu: failed to get dishes for %v", date)
+			return nil, fmt.Errorf("GetMenu: %w: no dishes for %v", notPublishedError, date)
 		}
 		return dishes, nil
 	}
@@ -151,6 +853,9 @@ func (d *realDownloader) Get(url string) ([]byte, error) {
 		return nil, fmt.Errorf("get for %v failed: %v", url, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get for %v failed: status %v", url, resp.Status)
+	}
 	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %v", err)
@@ -183,26 +888,37 @@ func extractLinks(site []byte) ([]string, error) {
 }
 
 /*
-extractPDFsFromMenuSite, downloads the lunch menuHandler PDFs from the UKSH website
+extractPDFsFromMenuSite, downloads the lunch menuHandler PDFs linked on the UKSH website at sourceURL and returns
+them together with their urls
 */
-func extractPDFsFromMenuSite(d Downloader) ([][]byte, error) {
-	site, err := d.Get(MenuBaseURL)
+func extractPDFsFromMenuSite(ctx context.Context, d Downloader, sourceURL string) (pdfs [][]byte, links []string, err error) {
+	ctx, span := tracer.Start(ctx, "extractPDFsFromMenuSite")
+	defer func() { endSpan(span, err) }()
+	download := func(url string) ([]byte, error) {
+		_, span := tracer.Start(ctx, "download", trace.WithAttributes(attribute.String("http.url", url)))
+		body, err := d.Get(url)
+		span.SetAttributes(attribute.Int("download.size", len(body)))
+		endSpan(span, err)
+		return body, err
+	}
+
+	site, err := download(sourceURL)
 	if err != nil {
-		return nil, fmt.Errorf("extractPDFsFromMenuSite: failed to fetch site: %v", err)
+		return nil, nil, fmt.Errorf("extractPDFsFromMenuSite: %w: failed to fetch site: %v", upstreamError, err)
 	}
-	links, err := extractLinks(site)
+	links, err = extractLinks(site)
 	if err != nil {
-		return nil, fmt.Errorf("extractPDFsFromMenuSite: failed to extract links: %v", err)
+		return nil, nil, fmt.Errorf("extractPDFsFromMenuSite: failed to extract links: %v", err)
 	}
 
-	pdfs := make([][]byte, 0, len(links))
+	pdfs = make([][]byte, 0, len(links))
 	for i := range links {
-		tmp, err := d.Get(links[i])
+		tmp, err := download(links[i])
 		if err != nil {
-			return nil, fmt.Errorf("extractPDFsFromMenuSite: failed to fetch pdf: %v", err)
+			return nil, nil, fmt.Errorf("extractPDFsFromMenuSite: %w: failed to fetch pdf: %v", upstreamError, err)
 		}
 		pdfs = append(pdfs, tmp)
 	}
 
-	return pdfs, nil
+	return pdfs, links, nil
 }
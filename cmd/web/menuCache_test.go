@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -166,7 +169,7 @@ func TestExtractPDFsFromMenuSite(t *testing.T) {
 		func(tc *testCase) {
 			t.Run(tc.name, func(t *testing.T) {
 
-				got, err := extractPDFsFromMenuSite(tc.in)
+				got, links, err := extractPDFsFromMenuSite(context.Background(), tc.in, MenuBaseURL)
 				if err != nil {
 					if !tc.shouldFail {
 						t.Errorf("Unexpected Error: %v\n", err)
@@ -178,6 +181,9 @@ func TestExtractPDFsFromMenuSite(t *testing.T) {
 				if l := len(got); l != len(tc.exp) {
 					t.Errorf("Expected %v PDFs got %v\n", len(tc.exp), l)
 				}
+				if l := len(links); l != len(tc.exp) {
+					t.Errorf("Expected %v links got %v\n", len(tc.exp), l)
+				}
 
 				if !reflect.DeepEqual(got, tc.exp) {
 					t.Errorf("Wrong PDFs returned\n")
@@ -209,8 +215,8 @@ func TestMenuCache_GetMenu(t *testing.T) {
 	}
 
 	parseMock := parserMock.NewMockUKSHParserI(ctrl)
-	parseMock.EXPECT().PDFToDishes(mockPDFs[0]).Return(uncachedDishes, nil)
-	parseMock.EXPECT().PDFToDishes(mockPDFs[1]).Return([]*parser.Dish{}, nil)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[0]).Return(uncachedDishes, nil)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[1]).Return([]*parser.Dish{}, nil)
 
 	mc := MenuCache{
 		dateToDishes: map[time.Time][]*parser.Dish{cachedDate: cachedDishes},
@@ -251,3 +257,199 @@ func TestMenuCache_GetMenu(t *testing.T) {
 	}
 
 }
+
+func TestMenuCache_recordPlan(t *testing.T) {
+	mc := MenuCache{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	dishes := []*parser.Dish{{Title: "Dummy", Date: monday}}
+	now := time.Now()
+
+	mc.recordPlan([]byte("pdf v1"), MenuBaseURL, dishes, nil, now)
+	mc.recordPlan([]byte("pdf v1"), MenuBaseURL, dishes, nil, now.Add(time.Hour))
+	if l := len(mc.PlanUpdates()); l != 1 {
+		t.Fatalf("Expected 1 update for unchanged pdf got %v\n", l)
+	}
+
+	mc.recordPlan([]byte("pdf v2"), MenuBaseURL, dishes, nil, now.Add(2*time.Hour))
+	updates := mc.PlanUpdates()
+	if l := len(updates); l != 2 {
+		t.Fatalf("Expected 2 updates after pdf changed got %v\n", l)
+	}
+	if !updates[0].Changed || updates[1].Changed {
+		t.Errorf("Expected newest update to be a change and oldest to be new\n")
+	}
+	if len(updates[0].ChangedDays) != 0 || len(updates[1].ChangedDays) != 1 {
+		t.Errorf("Expected no changed days for unchanged dishes and all days for new plans\n")
+	}
+	if !updates[0].Plan.Published.Equal(now) {
+		t.Errorf("Expected published time %v to be kept got %v\n", now, updates[0].Plan.Published)
+	}
+
+	plan, err := mc.GetWeek(2020, 47)
+	if err != nil {
+		t.Fatalf("Unexpected Error: %v", err)
+	}
+	if plan != updates[0].Plan {
+		t.Errorf("Expected GetWeek to return newest plan\n")
+	}
+	if _, err := mc.GetWeek(2020, 48); !errors.Is(err, unknownWeekError) {
+		t.Errorf("Expected %v error but got %v\n", unknownWeekError, err)
+	}
+}
+
+func TestMenuCache_recordPlanHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan-history.json")
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	dishes := []*parser.Dish{{Title: "Dummy", Date: monday}}
+	published := time.Date(2020, 11, 13, 10, 0, 0, 0, time.UTC)
+
+	//cache before and after a restart
+	newCache := func() *MenuCache {
+		history, err := loadPlanHashes(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		return &MenuCache{
+			history:  history,
+			infoLog:  log.New(ioutil.Discard, "", 0),
+			errorLog: log.New(ioutil.Discard, "", 0),
+		}
+	}
+	first := newCache()
+	first.storePlan([]byte("pdf v1"), first.recordPlan([]byte("pdf v1"), MenuBaseURL, dishes, nil, published).Plan)
+
+	restarted := newCache().recordPlan([]byte("pdf v1"), MenuBaseURL, dishes, nil, published.Add(24*time.Hour))
+	if !restarted.Plan.Published.Equal(published) || !restarted.Plan.Updated.Equal(published) || restarted.Changed {
+		t.Errorf("Expected unchanged plan to keep its times got published %v updated %v changed %v\n",
+			restarted.Plan.Published, restarted.Plan.Updated, restarted.Changed)
+	}
+
+	mc := newCache()
+	changed := mc.recordPlan([]byte("pdf v2"), MenuBaseURL, dishes, nil, published.Add(48*time.Hour))
+	mc.storePlan([]byte("pdf v2"), changed.Plan)
+	if rec, ok := newCache().historyRecord(2020, 47); !ok || rec.Hash != pdfHash([]byte("pdf v2")) {
+		t.Errorf("Expected changed plan to be stored got %+v\n", rec)
+	}
+	if !changed.Plan.Published.Equal(published) || !changed.Plan.Updated.Equal(published.Add(48*time.Hour)) || !changed.Changed {
+		t.Errorf("Expected changed plan to keep its published time got published %v updated %v changed %v\n",
+			changed.Plan.Published, changed.Plan.Updated, changed.Changed)
+	}
+}
+
+func TestMenuCache_uploadedPlanSurvivesRefresh(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	week47 := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	week48 := week47.AddDate(0, 0, 7)
+
+	downloadMock, mockPDFs, err := createDownloaderMock(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseMock := parserMock.NewMockUKSHParserI(ctrl)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), []byte("uploaded")).Return([]*parser.Dish{{Title: "Uploaded", Date: week47}}, nil)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[0]).Return([]*parser.Dish{{Title: "Downloaded", Date: week48}}, nil)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[1]).Return([]*parser.Dish{}, nil)
+
+	mc := MenuCache{
+		download: downloadMock,
+		parse:    parseMock,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	if _, err := mc.AddPDF(context.Background(), []byte("uploaded")); err != nil {
+		t.Fatalf("Unexpected Error: %v", err)
+	}
+	if err := mc.Refresh(); err != nil {
+		t.Fatalf("Unexpected Error: %v", err)
+	}
+
+	weeks := mc.CachedWeeks()
+	if len(weeks) != 2 || weeks[0].Source != uploadSource || weeks[1].Week != 48 {
+		t.Fatalf("Expected uploaded week 47 and downloaded week 48 got %v\n", weeks)
+	}
+	if !strings.HasSuffix(weeks[1].Source, "KW+47.pdf") {
+		t.Errorf("Expected source url of the downloaded pdf got %v\n", weeks[1].Source)
+	}
+	if dishes, ok := mc.CachedMenu(week47); !ok || dishes[0].Title != "Uploaded" {
+		t.Errorf("Expected uploaded dishes to be cached after refresh\n")
+	}
+}
+
+/*
+newRefreshingCache, returns a MenuCache whose refresh is blocked while parsing the first PDF. finish lets the
+refresh complete and returns its result
+*/
+func newRefreshingCache(t *testing.T) (mc *MenuCache, finish func() error) {
+	ctrl := gomock.NewController(t)
+	week48 := time.Date(2020, 11, 23, 0, 0, 0, 0, time.Local)
+
+	downloadMock, mockPDFs, err := createDownloaderMock(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsing := make(chan struct{})
+	release := make(chan struct{})
+	parseMock := parserMock.NewMockUKSHParserI(ctrl)
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[0]).DoAndReturn(func(_ context.Context, _ []byte) ([]*parser.Dish, error) {
+		close(parsing)
+		<-release
+		return []*parser.Dish{{Title: "Downloaded", Date: week48}}, nil
+	})
+	parseMock.EXPECT().PDFToDishesContext(gomock.Any(), mockPDFs[1]).Return([]*parser.Dish{}, nil)
+
+	mc = &MenuCache{
+		download: downloadMock,
+		parse:    parseMock,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- mc.Refresh()
+	}()
+	<-parsing
+	return mc, func() error {
+		close(release)
+		return <-refreshed
+	}
+}
+
+/*
+notBlocked, fails t if read does not return within a second
+*/
+func notBlocked(t *testing.T, read func()) {
+	done := make(chan struct{})
+	go func() {
+		read()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Reader blocked by the refresh\n")
+	}
+}
+
+func TestMenuCache_readDuringRefresh(t *testing.T) {
+	week48 := time.Date(2020, 11, 23, 0, 0, 0, 0, time.Local)
+	mc, finish := newRefreshingCache(t)
+
+	//probes must not wait for the parser
+	notBlocked(t, func() {
+		mc.CachedMenu(week48)
+		mc.CachedWeeks()
+		mc.CachedDays()
+		mc.RefreshStatus()
+	})
+
+	if err := finish(); err != nil {
+		t.Fatalf("Unexpected Error: %v", err)
+	}
+	if dishes, ok := mc.CachedMenu(week48); !ok || dishes[0].Title != "Downloaded" {
+		t.Errorf("Expected parsed dishes to be cached after refresh\n")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/bmizerany/pat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "menu_http_requests_total",
+		Help: "Number of handled http requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "menu_http_request_duration_seconds",
+		Help:    "Latency of http requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	refreshDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "menu_refresh_duration_seconds",
+		Help: "Duration of MenuCache refreshes including download and parsing.",
+		//parsing calls tesseract for every tile and takes tens of seconds
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+	})
+	refreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "menu_refreshes_total",
+		Help: "Number of MenuCache refreshes by outcome.",
+	}, []string{"outcome"})
+	lastRefreshSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "menu_refresh_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful refresh.",
+	})
+	upstreamErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "menu_upstream_errors_total",
+		Help: "Number of refreshes that failed to download the menu site or a PDF.",
+	})
+	parseStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "menu_parse_stage_duration_seconds",
+		Help:    "Runtime of the external programs used for parsing. tesseract is observed once per tile.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage"})
+	weekDishes = prometheus.NewDesc("menu_week_dishes",
+		"Number of dishes parsed for the cached iso week.", []string{"week"}, nil)
+	weekEmptyPrices = prometheus.NewDesc("menu_week_empty_prices",
+		"Number of dishes of the cached iso week for which OCR did not find a price.", []string{"week"}, nil)
+)
+
+func init() {
+	parser.ObserveStage = func(stage string, duration time.Duration) {
+		parseStageDuration.WithLabelValues(stage).Observe(duration.Seconds())
+	}
+}
+
+/*
+weekCollector, exports the number of dishes and empty prices of the weeks cached by mc. The values are read on
+every scrape, so they are set right after a restart and evicted weeks disappear
+*/
+type weekCollector struct {
+	mc *MenuCache
+}
+
+func (c *weekCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- weekDishes
+	ch <- weekEmptyPrices
+}
+
+func (c *weekCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, plan := range c.mc.CachedWeeks() {
+		week := formatISOWeek(plan.Year, plan.Week)
+		empty := 0
+		for _, d := range plan.Dishes {
+			if strings.TrimSpace(d.Price) == "" {
+				empty++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(weekDishes, prometheus.GaugeValue, float64(len(plan.Dishes)), week)
+		ch <- prometheus.MustNewConstMetric(weekEmptyPrices, prometheus.GaugeValue, float64(empty), week)
+	}
+}
+
+/*
+registerMenuMetrics, exports whether the plans of the current and the next iso week are cached and the dishes of
+the cached weeks, see weekCollector. Must only be called once
+*/
+func registerMenuMetrics(mc *MenuCache) {
+	published := func(offset int) func() float64 {
+		return func() float64 {
+			year, week := time.Now().In(time.Local).AddDate(0, 0, 7*offset).ISOWeek()
+			if _, err := mc.GetWeek(year, week); err != nil {
+				return 0
+			}
+			return 1
+		}
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "menu_current_week_published",
+		Help: "1 if the plan of the current iso week is cached, 0 otherwise.",
+	}, published(0))
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "menu_next_week_published",
+		Help: "1 if the plan of the next iso week is cached, 0 otherwise.",
+	}, published(1))
+	prometheus.MustRegister(&weekCollector{mc: mc})
+}
+
+/*
+observeRefresh, records the duration and outcome of a MenuCache refresh
+*/
+func observeRefresh(duration time.Duration, err error) {
+	refreshDuration.Observe(duration.Seconds())
+	if err != nil {
+		refreshes.WithLabelValues("error").Inc()
+		if errors.Is(err, upstreamError) {
+			upstreamErrors.Inc()
+		}
+		return
+	}
+	refreshes.WithLabelValues("success").Inc()
+	lastRefreshSuccess.SetToCurrentTime()
+}
+
+/*
+statusRecorder, remembers the status code and the body size written by a handler
+*/
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+/*
+Flush, passes flushes through to the wrapped writer, e.g. for the event stream
+*/
+func (r *statusRecorder) Flush() {
+	r.wroteHeader = true
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+/*
+Unwrap, returns the wrapped writer, so that http.ResponseController can set its write deadline
+*/
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+/*
+instrumentedMux, registers handlers with pat and records request metrics labeled with the route pattern, so that
+the label cardinality does not depend on the requested urls
+*/
+type instrumentedMux struct {
+	*pat.PatternServeMux
+}
+
+/*
+instrument, wraps h to record the request count and latency of route and to trace the request. The span
+continues the trace passed by the client in the traceparent header
+*/
+func instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPTargetKey.String(redactedURI(r)),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+func (m *instrumentedMux) Get(pattern string, h http.Handler) {
+	m.PatternServeMux.Get(pattern, instrument(pattern, h))
+}
+
+func (m *instrumentedMux) Post(pattern string, h http.Handler) {
+	m.PatternServeMux.Post(pattern, instrument(pattern, h))
+}
+
+func (m *instrumentedMux) Del(pattern string, h http.Handler) {
+	m.PatternServeMux.Del(pattern, instrument(pattern, h))
+}
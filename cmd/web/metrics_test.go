@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	app := &application{
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	srv := app.routes()
+	requests := httpRequests.WithLabelValues("/alive", http.MethodGet, "200")
+	before := testutil.ToFloat64(requests)
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/alive", nil))
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %v got %v\n", http.StatusOK, rec.Code)
+	}
+	if exp := `menu_http_requests_total{code="200",method="GET",route="/alive"}`; !strings.Contains(rec.Body.String(), exp) {
+		t.Errorf("Expected %v in metrics\n", exp)
+	}
+	if got := testutil.ToFloat64(requests); got != before+1 {
+		t.Errorf("Expected %v requests got %v\n", before+1, got)
+	}
+
+	//the week metrics are read from the cache, e.g. the one restored on startup
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		logger:       newStructuredLogger(ioutil.Discard, levelInfo),
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), uploadSource, []*parser.Dish{
+		{Title: "Pasta-Pfanne", Price: "€ 4,80 / € 6,00", Date: monday},
+		{Title: "Rumpsteak", Price: " ", Date: monday},
+	}, nil, time.Now())
+	mc.cacheWeek(2020, 47, mc.plans[weekKey{year: 2020, week: 47}].Dishes)
+	weeks := &weekCollector{mc: mc}
+	exp := `
+# HELP menu_week_dishes Number of dishes parsed for the cached iso week.
+# TYPE menu_week_dishes gauge
+menu_week_dishes{week="2020-W47"} 2
+# HELP menu_week_empty_prices Number of dishes of the cached iso week for which OCR did not find a price.
+# TYPE menu_week_empty_prices gauge
+menu_week_empty_prices{week="2020-W47"} 1
+`
+	if err := testutil.CollectAndCompare(weeks, strings.NewReader(exp)); err != nil {
+		t.Errorf("Unexpected week metrics: %v\n", err)
+	}
+	if err := mc.EvictWeek(2020, 47); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if n := testutil.CollectAndCount(weeks); n != 0 {
+		t.Errorf("Expected no metrics for evicted week got %v\n", n)
+	}
+
+	//scrapes must not wait for a running refresh
+	refreshing, finish := newRefreshingCache(t)
+	notBlocked(t, func() {
+		testutil.CollectAndCount(&weekCollector{mc: refreshing})
+	})
+	if err := finish(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	before = testutil.ToFloat64(upstreamErrors)
+	observeRefresh(time.Second, fmt.Errorf("refresh: %w", upstreamError))
+	if got := testutil.ToFloat64(upstreamErrors); got != before+1 {
+		t.Errorf("Expected %v upstream errors got %v\n", before+1, got)
+	}
+}
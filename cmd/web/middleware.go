@@ -1,11 +1,276 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
 
+/*
+validRequestID, limits the request ids accepted from clients, as they end up in our logs
+*/
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+/*
+assignRequestID, stores the id from the X-Request-ID request header or a random one in the request context and
+returns it in the X-Request-ID response header
+*/
+func (app *application) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = randomID(8); err != nil {
+				app.errorLog.Printf("assignRequestID: %v\n", err)
+			}
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+/*
+setWriteDeadline, sets the deadline for writing the response w to now plus d. For HTTP/2 the deadline only applies
+to the stream of the request, not to the whole connection
+*/
+func setWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+}
+
+/*
+limitWriteTime, limits the time for writing a response to server.writeTimeout. Replaces http.Server.WriteTimeout,
+which cannot be extended by handlers like eventsHandler that stream for a longer time
+*/
+func (app *application) limitWriteTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setWriteDeadline(w, app.config().Server.WriteTimeout.Duration)
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+logRequest, logs every request with its response status, size and duration
+*/
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		app.logger.Info("request",
+			"requestId", requestID(r.Context()),
+			"remoteAddr", r.RemoteAddr,
+			"proto", r.Proto,
+			"method", r.Method,
+			"uri", redactedURI(r),
+			"status", rec.status,
+			"size", rec.size,
+			"durationMs", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+/*
+requireAdmin, only passes requests to next that carry the configured admin token as bearer token.
+If no admin token is configured, the admin api is disabled
+*/
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := app.config().AdminToken
+		if token == "" {
+			app.writeProblem(w, r, fmt.Errorf("requireAdmin: %w: admin api is disabled", forbiddenError))
+			return
+		}
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			app.writeProblem(w, r, fmt.Errorf("requireAdmin: %w: missing or wrong admin token", unauthorizedError))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
+/*
+recoverPanic, answers requests whose handler panicked with a problem+json 500 instead of closing the connection.
+If the handler already started the response, the connection is aborted
+*/
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header().Clone()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler || rec.wroteHeader {
+				app.logger.Error("panic after response started", "requestId", requestID(r.Context()), "uri", redactedURI(r), "panic", fmt.Sprint(v))
+				panic(http.ErrAbortHandler)
+			}
+			//drop e.g. the content type or encoding set by the handler
+			for k := range w.Header() {
+				delete(w.Header(), k)
+			}
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			app.writeProblem(w, r, fmt.Errorf("recoverPanic: %v\n%s", v, debug.Stack()))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+/*
+cors, allows the browsers of the origins in api.cors.allowedOrigins to call all but the admin endpoints and answers
+their preflight requests
+*/
+func (app *application) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config().API.CORS
+		if len(cfg.AllowedOrigins) == 0 || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		addVary(h, "Origin")
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		for _, o := range cfg.AllowedOrigins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				allowed = o
+				break
+			}
+		}
+		if origin == "" || allowed == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed != "*" {
+			allowed = origin
+		}
+		h.Set("Access-Control-Allow-Origin", allowed)
+		h.Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Retry-After, X-Request-ID")
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		//preflight
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+		h.Set("Access-Control-Allow-Headers", "Accept, Content-Type, If-Modified-Since, If-None-Match, X-API-Key, X-Request-ID")
+		if cfg.MaxAge.Duration > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+/*
+requestAPIKey, returns the api key authenticated by authenticateKey or nil
+*/
+func requestAPIKey(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyKey).(*apiKey)
+	return k
+}
+
+/*
+apiKeyParam, is the query parameter for clients that cannot set the X-API-Key header
+*/
+const apiKeyParam = "apiKey"
+
+/*
+redactedURI, returns the request uri of r with the value of the apiKey query parameter replaced. Used wherever the
+uri is logged, traced or returned, so that keys do not leak into logs and problem responses
+*/
+func redactedURI(r *http.Request) string {
+	u := *r.URL
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		name := strings.SplitN(p, "=", 2)[0]
+		if n, err := url.QueryUnescape(name); err == nil && n == apiKeyParam {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u.RequestURI()
+}
+
+/*
+authenticateKey, stores the api key passed in the X-API-Key header or the apiKey query parameter in the request
+context. Unknown keys are rejected, requests without key only if api.requireKey is set
+*/
+func (app *application) authenticateKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config().API
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			//EventSource and img tags cannot set headers
+			key = r.URL.Query().Get(apiKeyParam)
+		}
+		if key == "" {
+			if cfg.RequireKey {
+				app.writeProblem(w, r, fmt.Errorf("authenticateKey: %w: missing api key", unauthorizedError))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		var found *apiKey
+		for i := range cfg.Keys {
+			//compare all keys, so that the timing does not tell which ones exist
+			if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.Keys[i].Key)) == 1 {
+				found = &cfg.Keys[i]
+			}
+		}
+		if found == nil {
+			app.writeProblem(w, r, fmt.Errorf("authenticateKey: %w: unknown api key", unauthorizedError))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey, found)))
+	})
+}
+
+/*
+limitRequests, rate limits requests per api key, see authenticateKey, or otherwise per client ip and enforces the
+daily quota of api keys. Rejected requests are answered with 429 and a Retry-After header
+*/
+func (app *application) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config().API
+		now := time.Now()
+		client, perMinute, burst := "ip "+clientIP(r, cfg.TrustForwardedFor), cfg.RateLimit, cfg.Burst
+		key := requestAPIKey(r.Context())
+		if key != nil {
+			client = "key " + key.Name
+			if key.RateLimit > 0 {
+				perMinute, burst = key.RateLimit, key.Burst
+			}
+		}
+		if perMinute > 0 {
+			if ok, wait := app.limiter.take(client, float64(perMinute)/60, burst, now); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				app.writeProblem(w, r, fmt.Errorf("limitRequests: %w: %v requests per minute", rateLimitedError, perMinute))
+				return
+			}
+		}
+		if key != nil && key.DailyQuota > 0 {
+			if ok, wait := app.quotas.take(key.Name, key.DailyQuota, now); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				app.writeProblem(w, r, fmt.Errorf("limitRequests: %w: %v requests per day", quotaExceededError, key.DailyQuota))
+				return
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
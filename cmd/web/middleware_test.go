@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.API.RateLimit = 60
+	cfg.API.Burst = 2
+	cfg.API.Keys = []apiKey{
+		{Name: "signage", Key: "0123456789abcdef", DailyQuota: 3, RateLimit: 600, Burst: 10},
+		{Name: "widget", Key: "fedcba9876543210"},
+	}
+	cfg.API.CORS.AllowedOrigins = stringList{"https://intranet.example.org"}
+	app := &application{
+		cfg:      cfg,
+		logger:   newStructuredLogger(ioutil.Discard, levelInfo),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	chain := app.authenticateKey(app.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if k := requestAPIKey(r.Context()); k != nil {
+			w.Header().Set("X-Key", k.Name)
+		}
+	})))
+	h := app.cors(chain)
+
+	type testCase struct {
+		name       string
+		method     string
+		remote     string
+		header     http.Header
+		query      string
+		requireKey bool
+		expStatus  int
+		expKey     string
+		expProblem string
+		expHeader  http.Header
+	}
+
+	tests := []*testCase{
+		{name: "Anonymous", remote: "192.0.2.1:1", expStatus: http.StatusOK},
+		{name: "Anonymous burst", remote: "192.0.2.1:2", expStatus: http.StatusOK},
+		{name: "Anonymous limited", remote: "192.0.2.1:3", expStatus: http.StatusTooManyRequests, expProblem: "urn:uksh-menu:problem:rate-limited", expHeader: http.Header{"Retry-After": {"1"}}},
+		{name: "Other ip", remote: "192.0.2.2:1", expStatus: http.StatusOK},
+		{name: "Key header", remote: "192.0.2.1:4", header: http.Header{"X-Api-Key": {"0123456789abcdef"}}, expStatus: http.StatusOK, expKey: "signage"},
+		{name: "Key query", remote: "192.0.2.1:5", query: "?apiKey=0123456789abcdef", expStatus: http.StatusOK, expKey: "signage"},
+		{name: "Key quota", remote: "192.0.2.3:1", header: http.Header{"X-Api-Key": {"0123456789abcdef"}}, expStatus: http.StatusOK, expKey: "signage"},
+		{name: "Key quota exceeded", remote: "192.0.2.3:2", header: http.Header{"X-Api-Key": {"0123456789abcdef"}}, expStatus: http.StatusTooManyRequests, expProblem: "urn:uksh-menu:problem:quota-exceeded"},
+		{name: "Key with default limits", remote: "192.0.2.1:6", header: http.Header{"X-Api-Key": {"fedcba9876543210"}}, expStatus: http.StatusOK, expKey: "widget"},
+		{name: "Unknown key", remote: "192.0.2.4:1", header: http.Header{"X-Api-Key": {"guessed"}}, expStatus: http.StatusUnauthorized, expProblem: "urn:uksh-menu:problem:unauthorized"},
+		{name: "Key required", remote: "192.0.2.5:1", requireKey: true, expStatus: http.StatusUnauthorized, expProblem: "urn:uksh-menu:problem:unauthorized"},
+		{
+			name: "CORS", remote: "192.0.2.6:1", header: http.Header{"Origin": {"https://intranet.example.org"}}, expStatus: http.StatusOK,
+			expHeader: http.Header{"Access-Control-Allow-Origin": {"https://intranet.example.org"}, "Vary": {"Origin"}},
+		},
+		{
+			name: "CORS other origin", remote: "192.0.2.6:2", header: http.Header{"Origin": {"https://evil.example.org"}}, expStatus: http.StatusOK,
+			expHeader: http.Header{"Access-Control-Allow-Origin": nil},
+		},
+		{
+			name: "CORS preflight", method: http.MethodOptions, remote: "192.0.2.6:3",
+			header:    http.Header{"Origin": {"https://intranet.example.org"}, "Access-Control-Request-Method": {"GET"}, "Access-Control-Request-Headers": {"x-api-key"}},
+			expStatus: http.StatusNoContent,
+			expHeader: http.Header{"Access-Control-Allow-Origin": {"https://intranet.example.org"}, "Access-Control-Max-Age": {"600"}},
+		},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				cfg.API.RequireKey = tc.requireKey
+				method := tc.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				r := httptest.NewRequest(method, "/v1/menu/2020-11-16"+tc.query, nil)
+				r.RemoteAddr = tc.remote
+				for k, v := range tc.header {
+					r.Header[k] = v
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+				if got := rec.Header().Get("X-Key"); got != tc.expKey {
+					t.Errorf("Expected key %q got %q\n", tc.expKey, got)
+				}
+				for k, v := range tc.expHeader {
+					if got := rec.Header().Get(k); (v == nil && got != "") || (v != nil && got != v[0]) {
+						t.Errorf("Expected header %v %v got %q\n", k, v, got)
+					}
+				}
+				if tc.expProblem == "" {
+					return
+				}
+				var p problem
+				if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || p.Type != tc.expProblem {
+					t.Errorf("Expected problem %v got %v, %v\n", tc.expProblem, rec.Body.String(), err)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	app := &application{
+		logger:   newStructuredLogger(ioutil.Discard, levelInfo),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	h := app.assignRequestID(app.recoverPanic(app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		var plan *WeekPlan
+		_ = plan.Year
+	}))))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("Expected problem 500 got %v %v\n", rec.Code, rec.Header())
+	}
+	if rec.Header().Get("Cache-Control") != "" || rec.Header().Get("X-Request-ID") == "" {
+		t.Errorf("Expected headers of the handler to be dropped but the request id kept got %v\n", rec.Header())
+	}
+	var p problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || p.Status != http.StatusInternalServerError || p.Detail != "" {
+		t.Errorf("Unexpected problem %v, %v\n", rec.Body.String(), err)
+	}
+
+	//a started response cannot be replaced
+	h = app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{"))
+		panic("failed")
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("Expected %v got %v\n", http.ErrAbortHandler, v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/week/2020-W47", nil))
+	t.Errorf("Expected abort\n")
+}
+
+func TestLimitWriteTime(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Server.WriteTimeout = duration{100 * time.Millisecond}
+	app := &application{
+		cfg:      cfg,
+		logger:   newStructuredLogger(ioutil.Discard, levelInfo),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	slow := func(d time.Duration) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			_, _ = w.Write([]byte("menu"))
+		})
+	}
+
+	type testCase struct {
+		name    string
+		handler http.Handler
+		http2   bool
+		expErr  bool
+	}
+
+	tests := []*testCase{
+		{name: "In time", handler: app.limitWriteTime(slow(0)), expErr: false},
+		{name: "Too slow", handler: app.limitWriteTime(slow(3 * cfg.Server.WriteTimeout.Duration)), expErr: true},
+		{name: "Http2 in time", handler: app.limitWriteTime(slow(0)), http2: true, expErr: false},
+		{name: "Http2 too slow", handler: app.limitWriteTime(slow(3 * cfg.Server.WriteTimeout.Duration)), http2: true, expErr: true},
+		{name: "Extended behind wrapped writer", http2: true, expErr: false,
+			handler: app.limitWriteTime(app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setWriteDeadline(w, 5*cfg.Server.WriteTimeout.Duration)
+				slow(3*cfg.Server.WriteTimeout.Duration).ServeHTTP(w, r)
+			})))},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				srv := httptest.NewUnstartedServer(tc.handler)
+				srv.EnableHTTP2 = tc.http2
+				srv.StartTLS()
+				defer srv.Close()
+
+				resp, err := srv.Client().Get(srv.URL)
+				var body []byte
+				if err == nil {
+					body, err = ioutil.ReadAll(resp.Body)
+					_ = resp.Body.Close()
+					if tc.http2 && resp.ProtoMajor != 2 {
+						t.Fatalf("Expected HTTP/2 got %v\n", resp.Proto)
+					}
+				}
+				if (err != nil) != tc.expErr {
+					t.Fatalf("Expected error %v got %v\n", tc.expErr, err)
+				}
+				if !tc.expErr && string(body) != "menu" {
+					t.Errorf("Expected menu got %q\n", body)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+	type testCase struct {
+		name   string
+		target string
+		exp    string
+	}
+
+	tests := []*testCase{
+		{name: "No query", target: "/v1/events", exp: "/v1/events"},
+		{name: "Key", target: "/v1/events?apiKey=0123456789abcdef", exp: "/v1/events?apiKey=REDACTED"},
+		{name: "Other params kept", target: "/week/2020-W47?format=csv&apiKey=0123456789abcdef&lang=de", exp: "/week/2020-W47?format=csv&apiKey=REDACTED&lang=de"},
+		{name: "Escaped name", target: "/v1/events?api%4Bey=0123456789abcdef", exp: "/v1/events?api%4Bey=REDACTED"},
+		{name: "Similar name", target: "/v1/events?apiKeys=1", exp: "/v1/events?apiKeys=1"},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				if got := redactedURI(httptest.NewRequest(http.MethodGet, tc.target, nil)); got != tc.exp {
+					t.Errorf("Expected %v got %v\n", tc.exp, got)
+				}
+			})
+		}(v)
+	}
+
+	//neither the request log nor the problem contain the key
+	logs := new(bytes.Buffer)
+	app := &application{
+		cfg:      defaultConfig(),
+		logger:   newStructuredLogger(logs, levelInfo),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+	}
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/menu/2020-11-16?apiKey=guessed-secret", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %v got %v\n", http.StatusUnauthorized, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "guessed-secret") || strings.Contains(logs.String(), "guessed-secret") {
+		t.Errorf("Key leaked into %v %v\n", rec.Body.String(), logs.String())
+	}
+	if !strings.Contains(logs.String(), "apiKey=REDACTED") {
+		t.Errorf("Expected redacted uri in log %v\n", logs.String())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+/*
+mqttTimeout, is the maximal time we wait for the broker to acknowledge a connect or publish
+*/
+const mqttTimeout = 10 * time.Second
+
+/*
+mqttConfig, configures MQTTPublisher
+*/
+type mqttConfig struct {
+	//e.g. tcp://localhost:1883 or ssl://broker.example.org:8883
+	broker   string
+	username string
+	password string
+	//optional pem file with the CA certificates used to verify the broker. Defaults to the system pool
+	caFile        string
+	todayTopic    string
+	tomorrowTopic string
+	//topic prefix for Home Assistant MQTT discovery, empty disables discovery
+	discoveryPrefix string
+}
+
+/*
+mqttMenu, is the retained json message published for a single day
+*/
+type mqttMenu struct {
+	Date      string `json:"date"`
+	Available bool   `json:"available"`
+	//one line per dish, used as state of the Home Assistant sensor
+	Summary string    `json:"summary"`
+	Dishes  []*v1Dish `json:"dishes"`
+}
+
+/*
+haDiscoveryConfig, is the Home Assistant MQTT discovery payload for a sensor
+*/
+type haDiscoveryConfig struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic"`
+	ValueTemplate       string   `json:"value_template"`
+	JSONAttributesTopic string   `json:"json_attributes_topic"`
+	Icon                string   `json:"icon"`
+	Device              haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+/*
+MQTTPublisher, publishes today's and tomorrow's menu as retained messages
+*/
+type MQTTPublisher struct {
+	//serializes Publish calls
+	lock      sync.Mutex
+	cfg       *mqttConfig
+	menuModel *MenuCache
+	//sends a retained message, replaced in tests
+	publish  func(topic string, payload []byte) error
+	errorLog *log.Logger
+	infoLog  *log.Logger
+}
+
+/*
+newMQTTTLSConfig, returns the tls config for the broker or nil if the broker does not use tls
+*/
+func newMQTTTLSConfig(cfg *mqttConfig) (*tls.Config, error) {
+	if !strings.HasPrefix(cfg.broker, "ssl://") && !strings.HasPrefix(cfg.broker, "tls://") {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.caFile != "" {
+		pem, err := ioutil.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("newMQTTTLSConfig: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("newMQTTTLSConfig: no certificates found in %v", cfg.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+/*
+NewMQTTPublisher, creates a MQTTPublisher for the broker in cfg. Connecting is deferred to the first publish,
+so that an unavailable broker does not prevent the service from starting
+*/
+func NewMQTTPublisher(cfg *mqttConfig, mc *MenuCache, errorLog, infoLog *log.Logger) (*MQTTPublisher, error) {
+	tlsConfig, err := newMQTTTLSConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("NewMQTTPublisher: %v", err)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.broker).
+		SetClientID("uksh-menu-parser").
+		SetUsername(cfg.username).
+		SetPassword(cfg.password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	client := mqtt.NewClient(opts)
+
+	p := &MQTTPublisher{
+		cfg:       cfg,
+		menuModel: mc,
+		errorLog:  errorLog,
+		infoLog:   infoLog,
+	}
+	p.publish = func(topic string, payload []byte) error {
+		if !client.IsConnected() {
+			token := client.Connect()
+			if !token.WaitTimeout(mqttTimeout) {
+				return fmt.Errorf("connect to %v timed out", cfg.broker)
+			}
+			if err := token.Error(); err != nil {
+				return fmt.Errorf("connect to %v failed: %v", cfg.broker, err)
+			}
+		}
+		token := client.Publish(topic, 1, true, payload)
+		if !token.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("publish to %v timed out", topic)
+		}
+		return token.Error()
+	}
+	return p, nil
+}
+
+/*
+newMQTTMenu, builds the message for date. Days without menu are published with Available set to false
+*/
+func (p *MQTTPublisher) newMQTTMenu(date time.Time) *mqttMenu {
+	m := &mqttMenu{Date: date.Format("2006-01-02"), Dishes: []*v1Dish{}}
+	dishes, ok := p.menuModel.CachedMenu(date)
+	if !ok {
+		return m
+	}
+	lines := make([]string, 0, len(dishes))
+	for _, d := range sortedDishes(dishes) {
+		lines = append(lines, d.Type+": "+d.Title)
+	}
+	m.Available = true
+	m.Summary = strings.Join(lines, "\n")
+	m.Dishes = newV1Dishes(dishes, p.menuModel.DishInfo)
+	return m
+}
+
+/*
+publishDiscovery, announces the today and tomorrow sensors to Home Assistant
+*/
+func (p *MQTTPublisher) publishDiscovery() error {
+	sensors := []struct{ id, name, topic string }{
+		{"uksh_menu_today", "UKSH menu today", p.cfg.todayTopic},
+		{"uksh_menu_tomorrow", "UKSH menu tomorrow", p.cfg.tomorrowTopic},
+	}
+	for _, s := range sensors {
+		payload, err := json.Marshal(haDiscoveryConfig{
+			Name:       s.name,
+			UniqueID:   s.id,
+			StateTopic: s.topic,
+			//Home Assistant states are limited to 255 characters
+			ValueTemplate:       "{{ value_json.summary[:255] if value_json.available else 'No menu' }}",
+			JSONAttributesTopic: s.topic,
+			Icon:                "mdi:silverware-fork-knife",
+			Device: haDevice{
+				Identifiers:  []string{"uksh_menu_parser"},
+				Name:         "UKSH Bistro Lübeck",
+				Manufacturer: "uksh-menu-parser",
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if err := p.publish(fmt.Sprintf("%v/sensor/%v/config", p.cfg.discoveryPrefix, s.id), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Publish, publishes today's and tomorrow's menu and, if enabled, the Home Assistant discovery payloads
+*/
+func (p *MQTTPublisher) Publish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cfg.discoveryPrefix != "" {
+		if err := p.publishDiscovery(); err != nil {
+			p.errorLog.Printf("MQTTPublisher: failed to publish discovery: %v\n", err)
+			return
+		}
+	}
+	today := roundToDay(time.Now().In(time.Local))
+	for _, v := range []struct {
+		topic string
+		date  time.Time
+	}{{p.cfg.todayTopic, today}, {p.cfg.tomorrowTopic, today.AddDate(0, 0, 1)}} {
+		payload, err := json.Marshal(p.newMQTTMenu(v.date))
+		if err != nil {
+			p.errorLog.Printf("MQTTPublisher: %v\n", err)
+			return
+		}
+		if err := p.publish(v.topic, payload); err != nil {
+			p.errorLog.Printf("MQTTPublisher: failed to publish %v: %v\n", v.topic, err)
+			return
+		}
+	}
+	p.infoLog.Printf("Published menu to MQTT\n")
+}
+
+/*
+Watch, publishes the menu after every change of the menu cache, i.e. after refreshes, uploads, corrections and
+evictions. Publishing happens in a goroutine of its own to not block the cache on the broker. The returned function
+stops watching
+*/
+func (p *MQTTPublisher) Watch() func() {
+	changes, stop := p.menuModel.Watch()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-changes:
+				p.Publish()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		stop()
+		close(done)
+	}
+}
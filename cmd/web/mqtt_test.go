@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestMQTTPublisher_Publish(t *testing.T) {
+	today := roundToDay(time.Now().In(time.Local))
+	mc := &MenuCache{
+		dateToDishes: map[time.Time][]*parser.Dish{today: {
+			{Title: "Pasta-Pfanne", Type: "Wok Station", Date: today},
+		}},
+	}
+	cfg := &mqttConfig{todayTopic: "menu/today", tomorrowTopic: "menu/tomorrow", discoveryPrefix: "homeassistant"}
+
+	published := make(map[string][]byte)
+	p := &MQTTPublisher{
+		cfg:       cfg,
+		menuModel: mc,
+		publish: func(topic string, payload []byte) error {
+			published[topic] = payload
+			return nil
+		},
+		errorLog: log.New(ioutil.Discard, "", 0),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+	}
+	p.Publish()
+
+	for _, topic := range []string{"homeassistant/sensor/uksh_menu_today/config", "homeassistant/sensor/uksh_menu_tomorrow/config", "menu/today", "menu/tomorrow"} {
+		if _, ok := published[topic]; !ok {
+			t.Errorf("Nothing published to %v\n", topic)
+		}
+	}
+
+	var todayMenu, tomorrowMenu mqttMenu
+	if err := json.Unmarshal(published["menu/today"], &todayMenu); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := json.Unmarshal(published["menu/tomorrow"], &tomorrowMenu); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !todayMenu.Available || todayMenu.Summary != "Wok Station: Pasta-Pfanne" || len(todayMenu.Dishes) != 1 {
+		t.Errorf("Unexpected message for today %+v\n", todayMenu)
+	}
+	if tomorrowMenu.Available {
+		t.Errorf("Expected tomorrow to be unavailable\n")
+	}
+}
+
+func TestMQTTPublisher_Watch(t *testing.T) {
+	today := roundToDay(time.Now().In(time.Local))
+	mc := &MenuCache{
+		dateToDishes: map[time.Time][]*parser.Dish{today: {
+			{Title: "Pasta-Pfanne", Type: "Wok Station", Date: today},
+		}},
+	}
+	published := make(chan []byte, 2)
+	p := &MQTTPublisher{
+		cfg:       &mqttConfig{todayTopic: "menu/today", tomorrowTopic: "menu/tomorrow"},
+		menuModel: mc,
+		publish: func(topic string, payload []byte) error {
+			if topic == "menu/today" {
+				published <- payload
+			}
+			return nil
+		},
+		errorLog: log.New(ioutil.Discard, "", 0),
+		infoLog:  log.New(ioutil.Discard, "", 0),
+	}
+	stop := p.Watch()
+	defer stop()
+
+	//an eviction is not a refresh but changes the menu of today
+	year, week := today.ISOWeek()
+	if err := mc.EvictWeek(year, week); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	select {
+	case payload := <-published:
+		var m mqttMenu
+		if err := json.Unmarshal(payload, &m); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if m.Available {
+			t.Errorf("Expected today to be unavailable after the eviction got %+v\n", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Nothing published after the eviction\n")
+	}
+}
+
+/*
+TestMQTTPublisher_Broker, publishes to the broker in MQTT_TEST_BROKER, e.g. a local mosquitto started with
+docker run -p 1883:1883 eclipse-mosquitto
+*/
+func TestMQTTPublisher_Broker(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_TEST_BROKER not set")
+	}
+	cfg := &mqttConfig{broker: broker, todayTopic: "uksh-menu-test/today", tomorrowTopic: "uksh-menu-test/tomorrow"}
+	p, err := NewMQTTPublisher(cfg, &MenuCache{}, log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.publish(cfg.todayTopic, []byte("{}")); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+	"github.com/snabb/isoweek"
+)
+
+/*
+groupByDay, sorts dishes and groups them by the day they are served on
+*/
+func groupByDay(dishes []*parser.Dish) []*dayView {
+	days := make([]*dayView, 0)
+	for _, d := range sortedDishes(dishes) {
+		day := roundToDay(d.Date)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(day) {
+			days = append(days, &dayView{Date: day})
+		}
+		days[len(days)-1].Dishes = append(days[len(days)-1].Dishes, d)
+	}
+	return days
+}
+
+/*
+notPublishedMessage, is shown for days without cached dishes, e.g. weekends or plans the UKSH did not publish yet
+*/
+const notPublishedMessage = "The menu for this day has not been published."
+
+/*
+todayPage, renders the dishes served today as html. Only cached dishes are shown, the page never waits for a
+refresh
+*/
+func (app *application) todayPage(w http.ResponseWriter, r *http.Request) {
+	//"/" matches all paths not matched by another route
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	today := roundToDay(time.Now().In(time.Local))
+	data := &templateData{
+		Title: "Today",
+		Day:   &dayView{Date: today},
+	}
+
+	if dishes, ok := app.menuModel.CachedMenu(today); ok {
+		data.Day.Dishes = sortedDishes(dishes)
+	} else {
+		data.Message = notPublishedMessage
+	}
+	app.render(w, http.StatusOK, "today.tmpl", data)
+}
+
+/*
+weekPage, renders all dishes of the iso week specified in the url as html
+*/
+func (app *application) weekPage(w http.ResponseWriter, r *http.Request) {
+	year, week, err := parseISOWeek(r.URL.Query().Get(":week"))
+	if err != nil {
+		app.render(w, http.StatusBadRequest, "week.tmpl", &templateData{
+			Title:   "Invalid week",
+			Message: "Pass week as yyyy-Www.",
+		})
+		return
+	}
+
+	start := isoweek.StartTime(year, week, time.Local)
+	data := &templateData{
+		Title:    "Week " + strconv.Itoa(week) + "/" + strconv.Itoa(year),
+		Year:     year,
+		Week:     week,
+		PrevWeek: formatISOWeek(start.AddDate(0, 0, -7).ISOWeek()),
+		NextWeek: formatISOWeek(start.AddDate(0, 0, 7).ISOWeek()),
+	}
+
+	plan, err := app.menuModel.GetWeek(year, week)
+	if err != nil {
+		if errors.Is(err, unknownWeekError) {
+			data.Message = "No plan has been published for this week."
+			app.render(w, http.StatusNotFound, "week.tmpl", data)
+			return
+		}
+		app.errorLog.Printf("weekPage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data.Days = groupByDay(plan.Dishes)
+	if r.URL.Query().Get("reported") == "true" {
+		data.Message = reportedMessage
+	}
+	app.render(w, http.StatusOK, "week.tmpl", data)
+}
+
+/*
+dishPage, renders a single cached dish identified by date and column in the url as html
+*/
+func (app *application) dishPage(w http.ResponseWriter, r *http.Request) {
+	notFound := func() {
+		app.render(w, http.StatusNotFound, "dish.tmpl", &templateData{
+			Title:   "Dish not found",
+			Message: "This dish does not exist.",
+		})
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get(":date"), time.Local)
+	if err != nil {
+		notFound()
+		return
+	}
+	col, err := strconv.Atoi(r.URL.Query().Get(":col"))
+	if err != nil {
+		notFound()
+		return
+	}
+
+	dishes, ok := app.menuModel.CachedMenu(date)
+	if !ok {
+		app.render(w, http.StatusNotFound, "dish.tmpl", &templateData{
+			Title:   "Menu not published",
+			Message: notPublishedMessage,
+		})
+		return
+	}
+	for _, d := range dishes {
+		if d.ColID() == col {
+			data := &templateData{Title: d.Title, Dish: d, HasTile: app.menuModel.DishInfo(d).tile != nil}
+			if r.URL.Query().Get("reported") == "true" {
+				data.Message = reportedMessage
+			}
+			app.render(w, http.StatusOK, "dish.tmpl", data)
+			return
+		}
+	}
+	notFound()
+}
+
+/*
+reportedMessage, is shown after a report has been submitted
+*/
+const reportedMessage = "Thank you, your report will be checked."
+
+/*
+reportDishPage, stores the error report submitted by the form on dishPage and redirects back to the dish
+*/
+func (app *application) reportDishPage(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	date, dateErr := parseDate(r.URL.Query().Get(":date"))
+	col, colErr := strconv.Atoi(r.URL.Query().Get(":col"))
+	if dateErr != nil || colErr != nil || r.ParseForm() != nil {
+		app.render(w, http.StatusBadRequest, "dish.tmpl", &templateData{Title: "Invalid request", Message: "Malformed form."})
+		return
+	}
+	if _, err := app.submitReport(date, col, r.PostForm.Get("kind"), r.PostForm.Get("suggestion"), r.PostForm.Get("comment")); err != nil {
+		app.renderReportError(w, "dish.tmpl", err)
+		return
+	}
+	http.Redirect(w, r, "/dish/"+date.Format("2006-01-02")+"/"+strconv.Itoa(col)+"?reported=true", http.StatusSeeOther)
+}
+
+/*
+reportMissingDishPage, stores the missing dish submitted by the form of a day on weekPage and redirects back to
+the week
+*/
+func (app *application) reportMissingDishPage(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	date, err := parseDate(r.URL.Query().Get(":date"))
+	if err != nil || r.ParseForm() != nil {
+		app.render(w, http.StatusBadRequest, "week.tmpl", &templateData{Title: "Invalid request", Message: "Malformed form."})
+		return
+	}
+	if _, err := app.submitReport(date, -1, "dish-missing", r.PostForm.Get("title"), r.PostForm.Get("comment")); err != nil {
+		app.renderReportError(w, "week.tmpl", err)
+		return
+	}
+	http.Redirect(w, r, "/plan/"+formatISOWeek(date.ISOWeek())+"?reported=true", http.StatusSeeOther)
+}
+
+/*
+renderReportError, renders page with a message explaining why the report err was rejected
+*/
+func (app *application) renderReportError(w http.ResponseWriter, page string, err error) {
+	switch {
+	case errors.Is(err, badRequestError):
+		app.render(w, http.StatusBadRequest, page, &templateData{Title: "Invalid report", Message: "Your report is incomplete or too long."})
+	case errors.Is(err, unknownDishError), errors.Is(err, invDateError), errors.Is(err, notPublishedError):
+		app.render(w, http.StatusNotFound, page, &templateData{Title: "Dish not found", Message: "This dish does not exist."})
+	case errors.Is(err, tooManyReportsError):
+		app.render(w, http.StatusServiceUnavailable, page, &templateData{Title: "Too many reports", Message: "Too many reports wait for review, please try again later."})
+	default:
+		app.errorLog.Printf("renderReportError: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+/*
+subscriptionPage, renders the page to change the filters of or unsubscribe the digest subscription identified by
+the token in the url
+*/
+func (app *application) subscriptionPage(w http.ResponseWriter, r *http.Request) {
+	sub, err := app.subscribers.ByToken(r.URL.Query().Get(":token"))
+	if err != nil {
+		app.render(w, http.StatusNotFound, "subscription.tmpl", &templateData{
+			Title:   "Subscription not found",
+			Message: "This subscription does not exist. Maybe you already unsubscribed?",
+		})
+		return
+	}
+	app.render(w, http.StatusOK, "subscription.tmpl", &templateData{Title: "Subscription", Subscriber: sub})
+}
+
+/*
+updateSubscriptionPage, saves the filters submitted by the form on subscriptionPage
+*/
+func (app *application) updateSubscriptionPage(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := r.ParseForm(); err != nil {
+		app.render(w, http.StatusBadRequest, "subscription.tmpl", &templateData{Title: "Invalid request", Message: "Malformed form."})
+		return
+	}
+	sub, err := app.subscribers.SetFilterToken(r.URL.Query().Get(":token"), r.PostForm.Get("vegetarianOnly") == "true")
+	if err != nil {
+		if errors.Is(err, unknownSubscriberError) {
+			app.render(w, http.StatusNotFound, "subscription.tmpl", &templateData{
+				Title:   "Subscription not found",
+				Message: "This subscription does not exist. Maybe you already unsubscribed?",
+			})
+			return
+		}
+		app.errorLog.Printf("updateSubscriptionPage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	app.render(w, http.StatusOK, "subscription.tmpl", &templateData{Title: "Subscription", Subscriber: sub, Message: "Your settings have been saved."})
+}
+
+/*
+unsubscribePage, removes the subscription identified by the token in the url. Also used for one-click
+unsubscribe (RFC 8058) via the List-Unsubscribe header of the digest
+*/
+func (app *application) unsubscribePage(w http.ResponseWriter, r *http.Request) {
+	err := app.subscribers.UnsubscribeToken(r.URL.Query().Get(":token"))
+	if err != nil && !errors.Is(err, unknownSubscriberError) {
+		app.errorLog.Printf("unsubscribePage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	//unsubscribing twice is not an error
+	app.render(w, http.StatusOK, "subscription.tmpl", &templateData{Title: "Unsubscribed", Message: "You will no longer receive the weekly menu."})
+}
+
+/*
+alertNotFoundMessage, is shown for unknown alert tokens
+*/
+const alertNotFoundMessage = "This alert does not exist. Maybe it was deleted or not confirmed in time?"
+
+/*
+alertsPage, renders the form to register a keyword alert. Only available if SMTP is configured, as the alerts are
+sent via email
+*/
+func (app *application) alertsPage(w http.ResponseWriter, r *http.Request) {
+	if app.mailer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	app.render(w, http.StatusOK, "alert.tmpl", &templateData{Title: "Menu alert", AlertForm: true})
+}
+
+/*
+registerAlertPage, registers the alert submitted by the form on alertsPage and sends the link to confirm it to
+the email address of the alert
+*/
+func (app *application) registerAlertPage(w http.ResponseWriter, r *http.Request) {
+	if app.mailer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := r.ParseForm(); err != nil {
+		app.render(w, http.StatusBadRequest, "alert.tmpl", &templateData{Title: "Invalid request", Message: "Malformed form.", AlertForm: true})
+		return
+	}
+	a, err := app.alerts.Register(r.PostForm.Get("pattern"), r.PostForm.Get("email"), time.Now())
+	if err != nil {
+		if errors.Is(err, badRequestError) {
+			app.render(w, http.StatusBadRequest, "alert.tmpl", &templateData{Title: "Invalid alert", Message: fmt.Sprintf("Please check the keyword and the email address. At most %v alerts are allowed per address.", maxAlertsPerEmail), AlertForm: true})
+			return
+		}
+		app.errorLog.Printf("registerAlertPage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := app.mailer.SendText(a.Email, "UKSH Bistro Lübeck: confirm your menu alert", alertConfirmText(app.mailer.baseURL, a)); err != nil {
+		app.errorLog.Printf("registerAlertPage: %v\n", err)
+		if err := app.alerts.RemoveToken(a.Token); err != nil {
+			app.errorLog.Printf("registerAlertPage: %v\n", err)
+		}
+		app.render(w, http.StatusServiceUnavailable, "alert.tmpl", &templateData{Title: "Email not sent", Message: "The confirmation email could not be sent, please try again later.", AlertForm: true})
+		return
+	}
+	app.render(w, http.StatusAccepted, "alert.tmpl", &templateData{Title: "Confirm your alert", Message: "We sent you an email with a link to confirm the alert."})
+}
+
+/*
+alertPage, renders the page to confirm or delete the alert identified by the token in the url. Confirming
+requires a POST, so that link scanners of mail providers do not confirm alerts
+*/
+func (app *application) alertPage(w http.ResponseWriter, r *http.Request) {
+	a, err := app.alerts.ByToken(r.URL.Query().Get(":token"))
+	if err != nil {
+		app.render(w, http.StatusNotFound, "alert.tmpl", &templateData{Title: "Alert not found", Message: alertNotFoundMessage})
+		return
+	}
+	app.render(w, http.StatusOK, "alert.tmpl", &templateData{Title: "Menu alert", Alert: a})
+}
+
+/*
+confirmAlertPage, confirms the alert identified by the token in the url
+*/
+func (app *application) confirmAlertPage(w http.ResponseWriter, r *http.Request) {
+	a, err := app.alerts.ConfirmToken(r.URL.Query().Get(":token"))
+	if err != nil {
+		if errors.Is(err, unknownAlertError) {
+			app.render(w, http.StatusNotFound, "alert.tmpl", &templateData{Title: "Alert not found", Message: alertNotFoundMessage})
+			return
+		}
+		app.errorLog.Printf("confirmAlertPage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	app.render(w, http.StatusOK, "alert.tmpl", &templateData{Title: "Menu alert", Alert: a, Message: "Your alert is active."})
+}
+
+/*
+removeAlertPage, removes the alert identified by the token in the url
+*/
+func (app *application) removeAlertPage(w http.ResponseWriter, r *http.Request) {
+	err := app.alerts.RemoveToken(r.URL.Query().Get(":token"))
+	if err != nil && !errors.Is(err, unknownAlertError) {
+		app.errorLog.Printf("removeAlertPage: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	//deleting twice is not an error
+	app.render(w, http.StatusOK, "alert.tmpl", &templateData{Title: "Alert deleted", Message: "You will no longer receive this alert."})
+}
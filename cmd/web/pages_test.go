@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestPages(t *testing.T) {
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	today := roundToDay(time.Now().In(time.Local))
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{
+		{Title: "Pasta-Pfanne", Description: "mit Hähnchenfleisch", Type: "Wok Station", Date: monday},
+	}, nil, time.Now())
+	mc.recordPlan([]byte("pdf of this week"), MenuBaseURL, []*parser.Dish{
+		{Title: "Rumpsteak", Type: "Gericht 2", Date: today},
+	}, nil, time.Now())
+	mc.cacheWeek(2020, 47, mc.plans[weekKey{year: 2020, week: 47}].Dishes)
+	year, week := today.ISOWeek()
+	mc.cacheWeek(year, week, mc.plans[weekKey{year: year, week: week}].Dishes)
+	//refreshes would download from the UKSH website
+	mc.download = nil
+
+	newApp := func(mc *MenuCache) *application {
+		return &application{
+			infoLog:       log.New(ioutil.Discard, "", 0),
+			errorLog:      log.New(ioutil.Discard, "", 0),
+			menuModel:     mc,
+			templateCache: templateCache,
+		}
+	}
+	srv := newApp(mc).routes()
+	emptySrv := newApp(&MenuCache{}).routes()
+
+	type testCase struct {
+		name       string
+		url        string
+		empty      bool
+		expStatus  int
+		expContent string
+	}
+
+	tests := []*testCase{
+		{name: "Today", url: "/", expStatus: http.StatusOK, expContent: "Rumpsteak"},
+		{name: "Today not published", url: "/", empty: true, expStatus: http.StatusOK, expContent: notPublishedMessage},
+		{name: "Dish", url: "/dish/2020-11-16/0", expStatus: http.StatusOK, expContent: "mit Hähnchenfleisch"},
+		{name: "Dish unknown column", url: "/dish/2020-11-16/3", expStatus: http.StatusNotFound, expContent: "does not exist"},
+		{name: "Dish not published", url: "/dish/" + today.Format("2006-01-02") + "/0", empty: true, expStatus: http.StatusNotFound, expContent: notPublishedMessage},
+		{name: "Dish malformed date", url: "/dish/16.11.2020/0", expStatus: http.StatusNotFound, expContent: "does not exist"},
+		{name: "Week", url: "/plan/2020-W47", expStatus: http.StatusOK, expContent: "Pasta-Pfanne"},
+		{name: "Week navigation", url: "/plan/2020-W53", expStatus: http.StatusNotFound, expContent: "/plan/2021-W01"},
+		{name: "Malformed week", url: "/plan/2020-47", expStatus: http.StatusBadRequest, expContent: "yyyy-Www"},
+		{name: "Static", url: "/static/style.css", expStatus: http.StatusOK, expContent: "body"},
+		{name: "Unknown path", url: "/does/not/exist", expStatus: http.StatusNotFound},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				if tc.empty {
+					emptySrv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				} else {
+					srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				}
+				if rec.Code != tc.expStatus {
+					t.Errorf("Expected status %v got %v\n", tc.expStatus, rec.Code)
+				}
+				if !strings.Contains(rec.Body.String(), tc.expContent) {
+					t.Errorf("Expected body to contain %q got %v\n", tc.expContent, rec.Body.String())
+				}
+			})
+		}(v)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+parserBusyError is returned if all slots for ad-hoc parsing are in use
+*/
+var parserBusyError = errors.New("parser busy")
+
+/*
+adHocParser, parses pdf with the given year for the dates. Abstraction of parser.PDFToDishesInYearContext for
+testing
+*/
+type adHocParser func(ctx context.Context, pdf []byte, year int) ([]*parser.Dish, error)
+
+/*
+parseTimings, are the runtimes of an ad-hoc parse in milliseconds. Stages are summed up, tesseract runs once per
+tile
+*/
+type parseTimings struct {
+	TotalMs  int64            `json:"totalMs"`
+	StagesMs map[string]int64 `json:"stagesMs"`
+}
+
+type parseResult struct {
+	Dishes   []*v1Dish     `json:"dishes"`
+	Warnings []string      `json:"warnings"`
+	Timings  *parseTimings `json:"timings"`
+}
+
+/*
+parseHandler starts a job, see parseJobHandler, that parses the PDF passed in the body, see readPDF, without
+caching its dishes. OCR takes longer than server.writeTimeout, so the handler answers 202 with the url of the job.
+The year of the dates defaults to the current one and can be passed as year query parameter or form field
+*/
+func (app *application) parseHandler(w http.ResponseWriter, r *http.Request) {
+	//disabled
+	if app.parseSlots == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	pdf, err := readPDF(w, r, int64(app.config().Parser.AdHocMaxSize))
+	if err != nil {
+		app.writeProblem(w, r, err)
+		return
+	}
+	year := time.Now().In(time.Local).Year()
+	if v := r.FormValue("year"); v != "" {
+		if year, err = strconv.Atoi(v); err != nil || year < 1000 || year > 9999 {
+			app.writeProblem(w, r, fmt.Errorf("parseHandler: %w: year must have four digits", badRequestError))
+			return
+		}
+	}
+
+	//the slot is held until the job finished
+	select {
+	case app.parseSlots <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "10")
+		app.writeProblem(w, r, fmt.Errorf("parseHandler: %w: %v parses running", parserBusyError, cap(app.parseSlots)))
+		return
+	}
+	slots := app.parseSlots
+
+	j, err := app.startJob("parse", false, func(ctx context.Context) (interface{}, error) {
+		defer func() { <-slots }()
+		return app.parseAdHoc(ctx, pdf, year)
+	})
+	if err != nil {
+		<-slots
+		app.writeProblem(w, r, err)
+		return
+	}
+	app.writeJobStarted(w, j, "/parse/"+j.ID)
+}
+
+/*
+parseAdHoc, parses pdf with year for the dates and returns the dishes, warnings and timings
+*/
+func (app *application) parseAdHoc(ctx context.Context, pdf []byte, year int) (*parseResult, error) {
+	var lock sync.Mutex
+	timings := &parseTimings{StagesMs: make(map[string]int64)}
+	ctx = parser.WithStageObserver(ctx, func(stage string, duration time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		timings.StagesMs[stage] += duration.Milliseconds()
+	})
+	start := time.Now()
+	dishes, err := app.parsePDF(ctx, pdf, year)
+	if err != nil {
+		//the layout of an uploaded pdf is the fault of the client, not of the UKSH website
+		if errors.Is(err, parser.HeaderMissingError) {
+			err = fmt.Errorf("parseAdHoc: %w: %v", badRequestError, err)
+		}
+		return nil, err
+	}
+	timings.TotalMs = time.Since(start).Milliseconds()
+	app.logger.Info("parsed ad-hoc pdf", "size", len(pdf), "dishes", len(dishes), "durationMs", timings.TotalMs)
+
+	return &parseResult{
+		//not cached, so neither corrections nor the tile endpoint know the dishes
+		Dishes:   newV1Dishes(dishes, nil),
+		Warnings: planWarnings(sortedDishes(dishes)),
+		Timings:  timings,
+	}, nil
+}
+
+/*
+parseJobHandler returns the parse job with the id passed in the url. The result of a finished job contains the
+dishes, warnings and timings
+*/
+func (app *application) parseJobHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJob(w, r, "parse")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestParseHandler(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Parser.AdHocMaxSize = 512
+	app := &application{
+		cfg:      cfg,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+		parsePDF: func(_ context.Context, pdf []byte, year int) ([]*parser.Dish, error) {
+			if bytes.Contains(pdf, []byte("unknown layout")) {
+				return nil, fmt.Errorf("fake: %w", parser.HeaderMissingError)
+			}
+			return []*parser.Dish{{Title: "Pasta-Pfanne", Type: "Wok Station", Date: time.Date(year, 11, 16, 0, 0, 0, 0, time.Local)}}, nil
+		},
+		parseSlots: make(chan struct{}, 1),
+	}
+	srv := app.routes()
+
+	multipartBody := func(pdf, year string) (io.Reader, string) {
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+		if err := mw.WriteField("year", year); err != nil {
+			t.Fatal(err)
+		}
+		fw, err := mw.CreateFormFile("pdf", "plan.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(pdf)); err != nil {
+			t.Fatal(err)
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf, mw.FormDataContentType()
+	}
+
+	type testCase struct {
+		name        string
+		url         string
+		body        io.Reader
+		contentType string
+		busy        bool
+		expStatus   int
+		//status of the problem of a failed job
+		expProblem int
+		expDate    string
+	}
+
+	body, contentType := multipartBody("%PDF-1.4 plan", "2020")
+	tests := []*testCase{
+		{name: "Raw body", url: "/parse?year=2021", body: bytes.NewReader([]byte("%PDF-1.4 plan")), expStatus: http.StatusAccepted, expDate: "2021-11-16"},
+		{name: "Multipart", url: "/parse", body: body, contentType: contentType, expStatus: http.StatusAccepted, expDate: "2020-11-16"},
+		{name: "Not a pdf", url: "/parse", body: bytes.NewReader([]byte("plan")), expStatus: http.StatusBadRequest},
+		{name: "Too large", url: "/parse", body: bytes.NewReader(append([]byte("%PDF-1.4"), make([]byte, 512)...)), expStatus: http.StatusBadRequest},
+		{name: "Invalid year", url: "/parse?year=20", body: bytes.NewReader([]byte("%PDF-1.4 plan")), expStatus: http.StatusBadRequest},
+		{name: "Unknown layout", url: "/parse", body: bytes.NewReader([]byte("%PDF-1.4 unknown layout")), expStatus: http.StatusAccepted, expProblem: http.StatusBadRequest},
+		{name: "Busy", url: "/parse", body: bytes.NewReader([]byte("%PDF-1.4 plan")), busy: true, expStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				if tc.busy {
+					app.parseSlots <- struct{}{}
+					defer func() { <-app.parseSlots }()
+				}
+				r := httptest.NewRequest(http.MethodPost, tc.url, tc.body)
+				if tc.contentType != "" {
+					r.Header.Set("Content-Type", tc.contentType)
+				}
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, r)
+				if rec.Code != tc.expStatus {
+					t.Fatalf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+				if tc.busy && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("Expected Retry-After header\n")
+				}
+				if tc.expStatus != http.StatusAccepted {
+					return
+				}
+				j := waitForJob(t, srv, rec, nil)
+				if tc.expProblem != 0 {
+					if j.Status != jobFailed || j.Problem == nil || j.Problem.Status != tc.expProblem {
+						t.Errorf("Expected failed job with status %v got %+v\n", tc.expProblem, j)
+					}
+					return
+				}
+				var got parseResult
+				if err := json.Unmarshal(j.Result, &got); err != nil {
+					t.Fatalf("Unexpected error: %v\n", err)
+				}
+				if len(got.Dishes) != 1 || got.Dishes[0].Date != tc.expDate || len(got.Warnings) != 1 || got.Timings == nil {
+					t.Errorf("Unexpected result %s\n", j.Result)
+				}
+			})
+		}(v)
+	}
+
+	//disabled
+	app.parseSlots = nil
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/parse", bytes.NewReader([]byte("%PDF-1.4 plan"))))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v got %v\n", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestParseHandlerSlow(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Server.WriteTimeout = duration{100 * time.Millisecond}
+	release := make(chan struct{})
+	app := &application{
+		cfg:      cfg,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+		//OCR of a plan takes longer than the write timeout of the server
+		parsePDF: func(ctx context.Context, _ []byte, year int) ([]*parser.Dish, error) {
+			<-release
+			return []*parser.Dish{{Title: "Pasta-Pfanne", Type: "Wok Station", Date: time.Date(year, 11, 16, 0, 0, 0, 0, time.Local)}}, nil
+		},
+		parseSlots: make(chan struct{}, 1),
+	}
+	srv := app.routes()
+	post := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/parse", bytes.NewReader([]byte("%PDF-1.4 plan"))))
+		return rec
+	}
+
+	started := post()
+	if started.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %v got %v: %v\n", http.StatusAccepted, started.Code, started.Body.String())
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, started.Header().Get("Location"), nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Retry-After") == "" || !bytes.Contains(rec.Body.Bytes(), []byte(`"running"`)) {
+		t.Errorf("Expected running job got %v %v: %v\n", rec.Code, rec.Header(), rec.Body.String())
+	}
+	//the running job holds the only slot
+	if rec := post(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v while parsing got %v\n", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	time.Sleep(cfg.Server.WriteTimeout.Duration)
+	close(release)
+	if j := waitForJob(t, srv, started, nil); j.Status != jobDone {
+		t.Errorf("Expected job to succeed got %+v\n", j)
+	}
+	if rec := post(); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected slot to be released got %v: %v\n", rec.Code, rec.Body.String())
+	}
+}
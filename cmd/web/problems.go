@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+badRequestError is used by handlers to signal malformed client input
+*/
+var badRequestError = errors.New("invalid request")
+
+/*
+unauthorizedError is used when a request lacks valid credentials
+*/
+var unauthorizedError = errors.New("unauthorized")
+
+/*
+forbiddenError is used when a request is not allowed regardless of its credentials
+*/
+var forbiddenError = errors.New("forbidden")
+
+/*
+rateLimitedError is returned if a client sends more requests than allowed by api.rateLimit
+*/
+var rateLimitedError = errors.New("rate limit exceeded")
+
+/*
+quotaExceededError is returned if an api key has used up its daily quota
+*/
+var quotaExceededError = errors.New("quota exceeded")
+
+/*
+problem, is an RFC 7807 problem details object
+*/
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+/*
+problemType, maps an error to the problem returned to clients
+*/
+type problemType struct {
+	err    error
+	typ    string
+	title  string
+	status int
+	//returned instead of the error message for server errors, which may contain internal urls, paths or tool
+	//output. The error is logged instead
+	detail string
+}
+
+/*
+problemTypes, is checked in order with errors.Is. Errors not contained here are answered with
+500/InternalServerError without exposing the error message
+*/
+var problemTypes = []*problemType{
+	{err: badRequestError, typ: "urn:uksh-menu:problem:invalid-request", title: "Invalid request", status: http.StatusBadRequest},
+	{err: unauthorizedError, typ: "urn:uksh-menu:problem:unauthorized", title: "Unauthorized", status: http.StatusUnauthorized},
+	{err: forbiddenError, typ: "urn:uksh-menu:problem:forbidden", title: "Forbidden", status: http.StatusForbidden},
+	{err: rateLimitedError, typ: "urn:uksh-menu:problem:rate-limited", title: "Too many requests", status: http.StatusTooManyRequests},
+	{err: quotaExceededError, typ: "urn:uksh-menu:problem:quota-exceeded", title: "Daily quota of the api key exceeded", status: http.StatusTooManyRequests},
+	{err: invDateError, typ: "urn:uksh-menu:problem:date-out-of-range", title: "Date out of range", status: http.StatusBadRequest},
+	{err: unknownFormatError, typ: "urn:uksh-menu:problem:unsupported-format", title: "Unsupported format", status: http.StatusNotAcceptable},
+	{err: unknownWebhookError, typ: "urn:uksh-menu:problem:webhook-not-found", title: "Webhook not found", status: http.StatusNotFound},
+	{err: unknownSubscriberError, typ: "urn:uksh-menu:problem:subscriber-not-found", title: "Subscriber not found", status: http.StatusNotFound},
+	{err: unknownCorrectionError, typ: "urn:uksh-menu:problem:correction-not-found", title: "Correction not found", status: http.StatusNotFound},
+	{err: unknownReportError, typ: "urn:uksh-menu:problem:report-not-found", title: "Report not found", status: http.StatusNotFound},
+	{err: unknownDishError, typ: "urn:uksh-menu:problem:dish-not-found", title: "Dish not found", status: http.StatusNotFound},
+	{err: unknownAlertError, typ: "urn:uksh-menu:problem:alert-not-found", title: "Alert not found", status: http.StatusNotFound},
+	{err: unknownJobError, typ: "urn:uksh-menu:problem:job-not-found", title: "Job not found", status: http.StatusNotFound},
+	{err: unknownWeekError, typ: "urn:uksh-menu:problem:week-not-found", title: "Week not found", status: http.StatusNotFound},
+	{err: notPublishedError, typ: "urn:uksh-menu:problem:not-published", title: "Menu not published yet", status: http.StatusNotFound},
+	{err: tooManyReportsError, typ: "urn:uksh-menu:problem:too-many-reports", title: "Too many reports wait for review", status: http.StatusServiceUnavailable,
+		detail: "Reports are not accepted until the open ones are reviewed, try again later"},
+	{err: parserBusyError, typ: "urn:uksh-menu:problem:parser-busy", title: "Too many PDFs are parsed at the moment", status: http.StatusServiceUnavailable,
+		detail: "All parser slots are in use, try again later"},
+	{err: upstreamError, typ: "urn:uksh-menu:problem:upstream-unavailable", title: "UKSH website unavailable", status: http.StatusBadGateway,
+		detail: "The menu plans could not be fetched from the UKSH website, try again later"},
+	{err: parser.HeaderMissingError, typ: "urn:uksh-menu:problem:header-missing", title: "Menu plan has an unknown layout", status: http.StatusBadGateway,
+		detail: "The column headers of the menu plan were not found, the plan could not be parsed"},
+	{err: parser.ParseTimeoutError, typ: "urn:uksh-menu:problem:parse-timeout", title: "Parsing the menu plan timed out", status: http.StatusGatewayTimeout,
+		detail: "Parsing the menu plan took too long, try again later"},
+}
+
+/*
+newProblem, maps err to a problem for the request r. The error message is only exposed for client errors, without
+the call chain in front of the sentinel error
+*/
+func newProblem(r *http.Request, err error) *problem {
+	for _, pt := range problemTypes {
+		if errors.Is(err, pt.err) {
+			detail := clientDetail(err, pt.err)
+			if pt.status >= http.StatusInternalServerError {
+				detail = pt.detail
+			}
+			return &problem{
+				Type:     pt.typ,
+				Title:    pt.title,
+				Status:   pt.status,
+				Detail:   detail,
+				Instance: redactedURI(r),
+			}
+		}
+	}
+	return &problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusInternalServerError),
+		Status:   http.StatusInternalServerError,
+		Instance: redactedURI(r),
+	}
+}
+
+/*
+clientDetail, returns the message of err starting at the message of sentinel, so that the function names of the
+call chain wrapped around it are not exposed
+*/
+func clientDetail(err, sentinel error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, sentinel.Error()); i >= 0 {
+		return msg[i:]
+	}
+	return msg
+}
+
+/*
+writeProblem, answers r with the problem+json representation of err
+*/
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := newProblem(r, err)
+	if p.Status >= http.StatusInternalServerError {
+		app.logger.Error("request failed", "requestId", requestID(r.Context()), "method", r.Method, "uri", redactedURI(r), "error", err)
+	}
+	response, err := json.Marshal(p)
+	if err != nil {
+		app.errorLog.Printf("Failed to marshal problem: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if _, err := w.Write(response); err != nil {
+		app.errorLog.Printf("Failed to write error response\n")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestNewProblem(t *testing.T) {
+	type testCase struct {
+		name      string
+		in        error
+		expStatus int
+		expType   string
+		expDetail string
+	}
+
+	tests := []*testCase{
+		{
+			name:      "Not published",
+			in:        fmt.Errorf("GetMenu: %w: no dishes", notPublishedError),
+			expStatus: http.StatusNotFound,
+			expType:   "urn:uksh-menu:problem:not-published",
+			expDetail: notPublishedError.Error() + ": no dishes",
+		},
+		{
+			name:      "Bad request behind call chain",
+			in:        fmt.Errorf("submitReport: %w", fmt.Errorf("Add: %w: comment too long", badRequestError)),
+			expStatus: http.StatusBadRequest,
+			expType:   "urn:uksh-menu:problem:invalid-request",
+			expDetail: "invalid request: comment too long",
+		},
+		{
+			name:      "Upstream behind refresh",
+			in:        fmt.Errorf("GetMenu: failed to refresh: %w", fmt.Errorf("extractPDFsFromMenuSite: %w: GET http://10.0.0.1/menu failed", upstreamError)),
+			expStatus: http.StatusBadGateway,
+			expType:   "urn:uksh-menu:problem:upstream-unavailable",
+		},
+		{
+			name:      "Parser timeout",
+			in:        fmt.Errorf("GetMenu: failed to refresh: %w", parser.ParseTimeoutError),
+			expStatus: http.StatusGatewayTimeout,
+			expType:   "urn:uksh-menu:problem:parse-timeout",
+		},
+		{
+			name:      "Header missing",
+			in:        fmt.Errorf("parse: %w: pdftotext /tmp/plan123.pdf", parser.HeaderMissingError),
+			expStatus: http.StatusBadGateway,
+			expType:   "urn:uksh-menu:problem:header-missing",
+		},
+		{
+			name:      "Unknown error",
+			in:        errors.New("something broke"),
+			expStatus: http.StatusInternalServerError,
+			expType:   "about:blank",
+		},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				got := newProblem(httptest.NewRequest(http.MethodGet, "/menu/2020-11-16", nil), tc.in)
+				if got.Status != tc.expStatus || got.Type != tc.expType {
+					t.Errorf("Expected (%v,%v) got (%v,%v)\n", tc.expStatus, tc.expType, got.Status, got.Type)
+				}
+				if got.Status == http.StatusInternalServerError && got.Detail != "" {
+					t.Errorf("Internal error details must not be exposed\n")
+				}
+				if got.Status >= http.StatusInternalServerError && strings.Contains(got.Detail, tc.in.Error()) {
+					t.Errorf("Server error message %q must not be exposed in %q\n", tc.in.Error(), got.Detail)
+				}
+				if got.Status < http.StatusInternalServerError && got.Detail != tc.expDetail {
+					t.Errorf("Expected detail %q got %q\n", tc.expDetail, got.Detail)
+				}
+			})
+		}(v)
+	}
+}
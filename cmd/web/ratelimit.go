@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+maxBuckets, bounds the number of clients tracked by rateLimiter
+*/
+const maxBuckets = 10000
+
+/*
+idleBucket, buckets unused for this long are dropped once rateLimiter is full. They are refilled by then unless the
+rate is very low
+*/
+const idleBucket = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+rateLimiter, limits the requests per client with a token bucket per client. The zero value is ready to use
+*/
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+/*
+take, removes a token from the bucket of client, which is refilled with rate tokens per second up to burst tokens.
+If the bucket is empty, returns false and the time until the next token is available. rate and burst are passed on
+every call, so that config reloads apply to existing buckets
+*/
+func (l *rateLimiter) take(client string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+/*
+sweep, drops idle buckets. Caller must hold l.lock
+*/
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > idleBucket {
+			delete(l.buckets, client)
+		}
+	}
+	if len(l.buckets) >= maxBuckets {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+}
+
+/*
+quotaCounter, counts the requests per api key and day. The zero value is ready to use
+*/
+type quotaCounter struct {
+	lock sync.Mutex
+	day  time.Time
+	used map[string]int
+}
+
+/*
+take, counts a request of the key name if it has not used up its quota for the day of now yet. Otherwise returns
+false and the time until the quota is reset at midnight
+*/
+func (q *quotaCounter) take(name string, quota int, now time.Time) (bool, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if day := roundToDay(now); !day.Equal(q.day) || q.used == nil {
+		q.day = day
+		q.used = make(map[string]int)
+	}
+	if q.used[name] >= quota {
+		return false, q.day.AddDate(0, 0, 1).Sub(now)
+	}
+	q.used[name]++
+	return true, 0
+}
+
+/*
+clientIP, returns the ip of the client sending r. IPv6 addresses are truncated to their /64 prefix, as clients
+usually get a whole prefix
+*/
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	addr := ""
+	if forwarded := r.Header.Values("X-Forwarded-For"); trustForwardedFor && len(forwarded) > 0 {
+		//added by our proxy, the entries before may be forged by the client
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		addr = strings.TrimSpace(hops[len(hops)-1])
+	}
+	if addr == "" {
+		var err error
+		if addr, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+			//e.g. unix sockets
+			addr = r.RemoteAddr
+		}
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return addr
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Date(2020, 11, 16, 12, 0, 0, 0, time.Local)
+	//1 token per second, burst of 2
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("a", 1, 2, now); !ok {
+			t.Fatalf("Expected token %v of the burst\n", i)
+		}
+	}
+	ok, wait := l.take("a", 1, 2, now)
+	if ok || wait != time.Second {
+		t.Errorf("Expected empty bucket with wait 1s got %v %v\n", ok, wait)
+	}
+	if ok, _ := l.take("b", 1, 2, now); !ok {
+		t.Errorf("Expected separate bucket per client\n")
+	}
+	if ok, _ := l.take("a", 1, 2, now.Add(1500*time.Millisecond)); !ok {
+		t.Errorf("Expected refilled token\n")
+	}
+	//refill is capped at burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.take("a", 1, 2, now)
+		if ok != (i < 2) {
+			t.Errorf("Unexpected result %v for request %v\n", ok, i)
+		}
+	}
+}
+
+func TestQuotaCounter(t *testing.T) {
+	var q quotaCounter
+	now := time.Date(2020, 11, 16, 23, 0, 0, 0, time.Local)
+	if ok, _ := q.take("signage", 1, now); !ok {
+		t.Fatalf("Expected first request to pass\n")
+	}
+	if ok, wait := q.take("signage", 1, now); ok || wait != time.Hour {
+		t.Errorf("Expected quota reset in 1h got %v %v\n", ok, wait)
+	}
+	if ok, _ := q.take("widget", 1, now); !ok {
+		t.Errorf("Expected separate quota per key\n")
+	}
+	if ok, _ := q.take("signage", 1, now.Add(2*time.Hour)); !ok {
+		t.Errorf("Expected quota to be reset on the next day\n")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	type testCase struct {
+		name      string
+		remote    string
+		forwarded []string
+		trust     bool
+		exp       string
+	}
+
+	tests := []*testCase{
+		{name: "IPv4", remote: "192.0.2.1:1234", exp: "192.0.2.1"},
+		{name: "IPv6 prefix", remote: "[2001:db8:1:2:3:4:5:6]:1234", exp: "2001:db8:1:2::/64"},
+		{name: "Unix socket", remote: "@", exp: "@"},
+		{name: "Untrusted header", remote: "192.0.2.1:1234", forwarded: []string{"198.51.100.7"}, exp: "192.0.2.1"},
+		{name: "Last hop", remote: "192.0.2.1:1234", forwarded: []string{"203.0.113.9, 198.51.100.7"}, trust: true, exp: "198.51.100.7"},
+		{name: "Last header", remote: "192.0.2.1:1234", forwarded: []string{"203.0.113.9", "198.51.100.7"}, trust: true, exp: "198.51.100.7"},
+		{name: "No header", remote: "192.0.2.1:1234", trust: true, exp: "192.0.2.1"},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				r := httptest.NewRequest("GET", "/v1/menu/2020-11-16", nil)
+				r.RemoteAddr = tc.remote
+				for _, f := range tc.forwarded {
+					r.Header.Add("X-Forwarded-For", f)
+				}
+				if got := clientIP(r, tc.trust); got != tc.exp {
+					t.Errorf("Expected %v got %v\n", tc.exp, got)
+				}
+			})
+		}(v)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+unknownReportError is returned when a report id does not exist
+*/
+var unknownReportError = errors.New("report not found")
+
+/*
+unknownDishError is returned when a report refers to a dish that is not on the menu
+*/
+var unknownDishError = errors.New("dish not found")
+
+/*
+tooManyReportsError is returned if maxOpenReports reports wait for an admin
+*/
+var tooManyReportsError = errors.New("too many open reports")
+
+/*
+maxOpenReports, bounds the number of reports that have not been promoted or removed yet, as anyone can submit
+reports
+*/
+const maxOpenReports = 200
+
+/*
+reportKinds, maps the kinds of error reports to the dish field a promoted report corrects
+*/
+var reportKinds = map[string]string{
+	"price-wrong":       "price",
+	"title-wrong":       "title",
+	"description-wrong": "description",
+	"kcal-wrong":        "kcal",
+	//the suggestion is the title of the missing dish
+	"dish-missing": "title",
+}
+
+/*
+maxReportText, is the maximal length in characters of the suggestion and comment of a report
+*/
+const maxReportText = 500
+
+/*
+Report, is an error in the menu reported by a user. Column is the column of the wrong dish or, for dish-missing,
+the column the missing dish is added to
+*/
+type Report struct {
+	ID     string `json:"id"`
+	Date   string `json:"date"`
+	Column int    `json:"column"`
+	//see reportKinds
+	Kind string `json:"kind"`
+	//optional, the value the user expected
+	Suggestion string    `json:"suggestion,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	Created    time.Time `json:"created"`
+	//set once an admin promoted the report to a correction
+	CorrectionID string `json:"correctionId,omitempty"`
+}
+
+/*
+ReportStore, persists the error reports of users
+*/
+type ReportStore struct {
+	lock    sync.Mutex
+	reports []*Report
+	path    string
+	//new reports are rejected once this many are open
+	maxOpen int
+}
+
+/*
+NewReportStore, loads the reports persisted in dataDir
+*/
+func NewReportStore(dataDir string) (*ReportStore, error) {
+	s := &ReportStore{
+		reports: make([]*Report, 0),
+		path:    filepath.Join(dataDir, "reports.json"),
+		maxOpen: maxOpenReports,
+	}
+	if err := loadJSON(s.path, &s.reports); err != nil {
+		return nil, fmt.Errorf("NewReportStore: %v", err)
+	}
+	return s, nil
+}
+
+/*
+List, returns all reports. If open is true promoted reports are omitted
+*/
+func (s *ReportStore) List(open bool) []*Report {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]*Report, 0, len(s.reports))
+	for _, rep := range s.reports {
+		if !open || rep.CorrectionID == "" {
+			res = append(res, rep)
+		}
+	}
+	return res
+}
+
+/*
+Get, returns the report with id
+*/
+func (s *ReportStore) Get(id string) (*Report, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rep := range s.reports {
+		if rep.ID == id {
+			return rep, nil
+		}
+	}
+	return nil, fmt.Errorf("Get: %w: %v", unknownReportError, id)
+}
+
+/*
+Add, stores a report of kind for the dish in column on date. Fails with tooManyReportsError if the maximal number
+of open reports is reached
+*/
+func (s *ReportStore) Add(date time.Time, column int, kind, suggestion, comment string) (*Report, error) {
+	if _, ok := reportKinds[kind]; !ok {
+		return nil, fmt.Errorf("Add: %w: unknown kind %q", badRequestError, kind)
+	}
+	suggestion, comment = strings.TrimSpace(suggestion), strings.TrimSpace(comment)
+	if utf8.RuneCountInString(suggestion) > maxReportText || utf8.RuneCountInString(comment) > maxReportText {
+		return nil, fmt.Errorf("Add: %w: suggestion and comment are limited to %v characters", badRequestError, maxReportText)
+	}
+	if kind == "dish-missing" && suggestion == "" {
+		return nil, fmt.Errorf("Add: %w: pass the title of the missing dish as suggestion", badRequestError)
+	}
+	id, err := randomID(8)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	rep := &Report{
+		ID:         id,
+		Date:       date.Format("2006-01-02"),
+		Column:     column,
+		Kind:       kind,
+		Suggestion: suggestion,
+		Comment:    comment,
+		Created:    time.Now(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	open := 0
+	for _, r := range s.reports {
+		if r.CorrectionID == "" {
+			open++
+		}
+	}
+	if open >= s.maxOpen {
+		return nil, fmt.Errorf("Add: %w: %v reports wait for an admin", tooManyReportsError, open)
+	}
+	reports := append(append(make([]*Report, 0, len(s.reports)+1), s.reports...), rep)
+	if err := saveJSON(s.path, reports); err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	s.reports = reports
+	return rep, nil
+}
+
+/*
+Promote, marks the report with id as promoted to the correction with correctionID
+*/
+func (s *ReportStore) Promote(id, correctionID string) (*Report, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, rep := range s.reports {
+		if rep.ID == id {
+			//reports are handed out to callers, so replace instead of modify
+			promoted := *rep
+			promoted.CorrectionID = correctionID
+			reports := make([]*Report, len(s.reports))
+			copy(reports, s.reports)
+			reports[i] = &promoted
+			if err := saveJSON(s.path, reports); err != nil {
+				return nil, fmt.Errorf("Promote: %v", err)
+			}
+			s.reports = reports
+			return &promoted, nil
+		}
+	}
+	return nil, fmt.Errorf("Promote: %w: %v", unknownReportError, id)
+}
+
+/*
+Remove, deletes the report with id
+*/
+func (s *ReportStore) Remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, rep := range s.reports {
+		if rep.ID == id {
+			reports := make([]*Report, 0, len(s.reports)-1)
+			reports = append(reports, s.reports[:i]...)
+			reports = append(reports, s.reports[i+1:]...)
+			if err := saveJSON(s.path, reports); err != nil {
+				return fmt.Errorf("Remove: %v", err)
+			}
+			s.reports = reports
+			return nil
+		}
+	}
+	return fmt.Errorf("Remove: %w: %v", unknownReportError, id)
+}
+
+/*
+submitReport, checks the report against the cached menu of date and stores it. For dish-missing a negative column
+selects the first column without dish
+*/
+func (app *application) submitReport(date time.Time, column int, kind, suggestion, comment string) (*Report, error) {
+	//never refresh, anyone can submit reports
+	dishes, ok := app.menuModel.CachedMenu(date)
+	if !ok {
+		return nil, fmt.Errorf("submitReport: %w: no menu cached for %v", notPublishedError, date.Format("2006-01-02"))
+	}
+	used := make(map[int]bool, len(dishes))
+	for _, d := range dishes {
+		used[d.ColID()] = true
+	}
+	if kind == "dish-missing" {
+		if column < 0 {
+			column = 0
+			for used[column] {
+				column++
+			}
+		} else if used[column] {
+			return nil, fmt.Errorf("submitReport: %w: column %v already has a dish", badRequestError, column)
+		}
+	} else if !used[column] {
+		return nil, fmt.Errorf("submitReport: %w: no dish in column %v on %v", unknownDishError, column, date.Format("2006-01-02"))
+	}
+	rep, err := app.reports.Add(date, column, kind, suggestion, comment)
+	if err != nil {
+		return nil, fmt.Errorf("submitReport: %w", err)
+	}
+	app.logger.Info("dish reported", "report", rep.ID, "kind", rep.Kind, "date", rep.Date, "column", rep.Column)
+	return rep, nil
+}
+
+/*
+promoteReport, stores a correction setting the field reported by the report with id to value, or to the suggestion
+of the report if value is empty, and applies it to the cache
+*/
+func (app *application) promoteReport(id, value, author string) (*Report, error) {
+	rep, err := app.reports.Get(id)
+	if err != nil {
+		return nil, fmt.Errorf("promoteReport: %w", err)
+	}
+	if value == "" {
+		value = rep.Suggestion
+	}
+	if value == "" {
+		return nil, fmt.Errorf("promoteReport: %w: report %v has no suggestion, pass the value", badRequestError, id)
+	}
+	date, err := time.ParseInLocation("2006-01-02", rep.Date, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("promoteReport: corrupt report %v: %v", id, err)
+	}
+	comment := "report " + rep.ID
+	if rep.Comment != "" {
+		comment += ": " + rep.Comment
+	}
+	c, err := app.corrections.Set(formatISOWeek(date.ISOWeek()), isoWeekday(date), rep.Column,
+		map[string]string{reportKinds[rep.Kind]: value}, author, comment)
+	if err != nil {
+		return nil, fmt.Errorf("promoteReport: %w", err)
+	}
+	app.menuModel.ApplyCorrections()
+	return app.reports.Promote(id, c.ID)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestReportStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewReportStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+
+	type testCase struct {
+		name       string
+		kind       string
+		suggestion string
+		wantErr    error
+	}
+
+	tests := []*testCase{
+		{name: "Price wrong", kind: "price-wrong", suggestion: "€ 4,80 / € 6,00"},
+		{name: "Without suggestion", kind: "kcal-wrong"},
+		{name: "Dish missing", kind: "dish-missing", suggestion: "Pasta-Pfanne"},
+		{name: "Dish missing without title", kind: "dish-missing", wantErr: badRequestError},
+		{name: "Unknown kind", kind: "tastes-bad", wantErr: badRequestError},
+		{name: "Too long", kind: "price-wrong", suggestion: strings.Repeat("€", maxReportText+1), wantErr: badRequestError},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := s.Add(monday, 0, tc.kind, tc.suggestion, "")
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Expected error %v got %v\n", tc.wantErr, err)
+				}
+			})
+		}(v)
+	}
+
+	reports := s.List(false)
+	if len(reports) != 3 {
+		t.Fatalf("Expected 3 reports got %v\n", reports)
+	}
+	if _, err := s.Promote(reports[0].ID, "correction"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := s.Remove(reports[1].ID); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := s.Remove(reports[1].ID); !errors.Is(err, unknownReportError) {
+		t.Errorf("Expected %v got %v\n", unknownReportError, err)
+	}
+
+	//persisted
+	reloaded, err := NewReportStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if got := reloaded.List(false); len(got) != 2 || got[0].CorrectionID != "correction" {
+		t.Errorf("Reports not persisted, got %v\n", got)
+	}
+	if got := reloaded.List(true); len(got) != 1 || got[0].Kind != "dish-missing" {
+		t.Errorf("Expected only the open report got %v\n", got)
+	}
+
+	//promoted reports do not count towards the limit
+	reloaded.maxOpen = 2
+	if _, err := reloaded.Add(monday, 1, "price-wrong", "", ""); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, err := reloaded.Add(monday, 2, "price-wrong", "", ""); !errors.Is(err, tooManyReportsError) {
+		t.Errorf("Expected %v got %v\n", tooManyReportsError, err)
+	}
+}
+
+func TestReports(t *testing.T) {
+	templateCache, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrections, err := NewCorrectionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	reports, err := NewReportStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	mc := &MenuCache{
+		dateToDishes: make(map[time.Time][]*parser.Dish),
+		corrections:  corrections,
+		infoLog:      log.New(ioutil.Discard, "", 0),
+		errorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	mc.recordPlan([]byte("pdf"), MenuBaseURL, []*parser.Dish{{Title: "Rumpsteak", Price: "€ 5,9O", Type: "Wok Station", Date: monday}}, nil, time.Now())
+	mc.cacheWeek(2020, 47, mc.plans[weekKey{year: 2020, week: 47}].Dishes)
+
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+	app := &application{
+		cfg:           cfg,
+		infoLog:       log.New(ioutil.Discard, "", 0),
+		errorLog:      log.New(ioutil.Discard, "", 0),
+		menuModel:     mc,
+		templateCache: templateCache,
+		corrections:   corrections,
+		reports:       reports,
+	}
+	srv := app.routes()
+
+	type testCase struct {
+		name      string
+		url       string
+		body      string
+		expStatus int
+	}
+
+	tests := []*testCase{
+		{name: "Price wrong", url: "/v1/dish/2020-11-16/0/report", body: `{"kind": "price-wrong", "suggestion": "€ 5,90 / € 7,40"}`, expStatus: http.StatusCreated},
+		{name: "Unknown dish", url: "/v1/dish/2020-11-16/3/report", body: `{"kind": "price-wrong"}`, expStatus: http.StatusNotFound},
+		{name: "Uncached day", url: "/v1/dish/2020-11-21/0/report", body: `{"kind": "price-wrong"}`, expStatus: http.StatusNotFound},
+		{name: "Missing dish exists", url: "/v1/dish/2020-11-16/0/report", body: `{"kind": "dish-missing", "suggestion": "Rumpsteak"}`, expStatus: http.StatusBadRequest},
+		{name: "Malformed column", url: "/v1/dish/2020-11-16/first/report", body: `{"kind": "price-wrong"}`, expStatus: http.StatusBadRequest},
+		{name: "Malformed body", url: "/v1/dish/2020-11-16/0/report", body: `{"kind":`, expStatus: http.StatusBadRequest},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body)))
+				if rec.Code != tc.expStatus {
+					t.Errorf("Expected status %v got %v: %v\n", tc.expStatus, rec.Code, rec.Body.String())
+				}
+			})
+		}(v)
+	}
+
+	//html form of the week page
+	form := url.Values{"title": {"Pasta-Pfanne"}}
+	r := httptest.NewRequest(http.MethodPost, "/dish/2020-11-16/missing", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, r)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/plan/2020-W47?reported=true" {
+		t.Fatalf("Expected redirect to the week got %v %v\n", rec.Code, rec.Header().Get("Location"))
+	}
+
+	admin := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		return rec
+	}
+
+	var open []*Report
+	if err := json.Unmarshal(admin(http.MethodGet, "/admin/reports?open=true", nil).Body.Bytes(), &open); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(open) != 2 || open[1].Kind != "dish-missing" || open[1].Column != 1 {
+		t.Fatalf("Expected the two valid reports got %v\n", open)
+	}
+	for _, rep := range open {
+		if rec := admin(http.MethodPost, "/admin/reports/"+rep.ID+"/promote", []byte(`{"author": "kitchen"}`)); rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %v got %v: %v\n", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := admin(http.MethodPost, "/admin/reports/unknown/promote", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v got %v\n", http.StatusNotFound, rec.Code)
+	}
+
+	dishes, _ := mc.CachedMenu(monday)
+	dishes = sortedDishes(dishes)
+	if len(dishes) != 2 || dishes[0].Price != "€ 5,90 / € 7,40" || dishes[1].Title != "Pasta-Pfanne" || dishes[1].ColID() != 1 {
+		t.Errorf("Expected corrected price and added dish got %v\n", dishes)
+	}
+	if got := reports.List(true); len(got) != 0 {
+		t.Errorf("Expected all reports to be promoted got %v\n", got)
+	}
+	if got := corrections.List(); len(got) != 2 || got[0].Author != "kitchen" {
+		t.Errorf("Expected a correction per report got %v\n", got)
+	}
+	if rec := admin(http.MethodDelete, "/admin/reports/"+open[0].ID, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status %v got %v\n", http.StatusNoContent, rec.Code)
+	}
+}
@@ -5,15 +5,73 @@ import (
 
 	"github.com/bmizerany/pat"
 	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func (app *application) routes() http.Handler {
 
-	standardMiddleware := alice.New(app.logRequest)
+	standardMiddleware := alice.New(app.limitWriteTime, app.assignRequestID, app.logRequest, app.cors, app.recoverPanic, app.compress)
+	adminMiddleware := alice.New(app.requireAdmin)
+	//health checks, metrics, static files and the token protected endpoints are not rate limited
+	apiMiddleware := alice.New(app.authenticateKey, app.limitRequests)
+	publicMiddleware := alice.New(app.limitRequests)
 	//supports semantic urls, put exact matches before wildcard matches
-	mux := pat.New()
+	mux := &instrumentedMux{pat.New()}
 	mux.Get("/alive", http.HandlerFunc(app.aliveHandler))
-	mux.Get("/menu/:date", http.HandlerFunc(app.menuHandler))
+	mux.Get("/healthz", http.HandlerFunc(app.healthzHandler))
+	mux.Get("/readyz", http.HandlerFunc(app.readyzHandler))
+	mux.Get("/metrics", promhttp.Handler())
+	mux.Get("/menu/:date", apiMiddleware.ThenFunc(app.menuHandler))
+	mux.Get("/week/:week", apiMiddleware.ThenFunc(app.weekHandler))
+	mux.Get("/v1/openapi.json", publicMiddleware.ThenFunc(app.openAPIHandler))
+	mux.Get("/v1/menu/:date", apiMiddleware.ThenFunc(app.v1MenuHandler))
+	mux.Get("/v1/events", apiMiddleware.ThenFunc(app.eventsHandler))
+	mux.Get("/v1/week/:week/pdf", apiMiddleware.ThenFunc(app.v1PlanPDFHandler))
+	mux.Get("/v1/week/:week/png", apiMiddleware.ThenFunc(app.v1PlanPNGHandler))
+	mux.Get("/v1/week/:week", apiMiddleware.ThenFunc(app.v1WeekHandler))
+	mux.Get("/v1/dish/:date/:col/tile", apiMiddleware.ThenFunc(app.v1TileHandler))
+	mux.Post("/v1/dish/:date/:col/report", apiMiddleware.ThenFunc(app.v1ReportHandler))
+	mux.Get("/admin/webhooks/deliveries", adminMiddleware.ThenFunc(app.adminWebhookDeliveriesHandler))
+	mux.Get("/admin/webhooks", adminMiddleware.ThenFunc(app.adminListWebhooksHandler))
+	mux.Post("/admin/webhooks", adminMiddleware.ThenFunc(app.adminAddWebhookHandler))
+	mux.Del("/admin/webhooks/:id", adminMiddleware.ThenFunc(app.adminRemoveWebhookHandler))
+	mux.Get("/admin/subscribers", adminMiddleware.ThenFunc(app.adminListSubscribersHandler))
+	mux.Post("/admin/subscribers", adminMiddleware.ThenFunc(app.adminAddSubscriberHandler))
+	mux.Del("/admin/subscribers/:id", adminMiddleware.ThenFunc(app.adminRemoveSubscriberHandler))
+	mux.Get("/admin/alerts", adminMiddleware.ThenFunc(app.adminListAlertsHandler))
+	mux.Post("/admin/alerts", adminMiddleware.ThenFunc(app.adminAddAlertHandler))
+	mux.Del("/admin/alerts/:id", adminMiddleware.ThenFunc(app.adminRemoveAlertHandler))
+	mux.Get("/admin/jobs/:id", adminMiddleware.ThenFunc(app.adminJobHandler))
+	mux.Post("/admin/refresh", adminMiddleware.ThenFunc(app.adminRefreshHandler))
+	mux.Get("/admin/cache", adminMiddleware.ThenFunc(app.adminListCacheHandler))
+	mux.Post("/admin/cache", adminMiddleware.ThenFunc(app.adminUploadPDFHandler))
+	mux.Del("/admin/cache/:week", adminMiddleware.ThenFunc(app.adminEvictWeekHandler))
+	mux.Get("/admin/corrections/audit", adminMiddleware.ThenFunc(app.adminCorrectionAuditHandler))
+	mux.Get("/admin/corrections", adminMiddleware.ThenFunc(app.adminListCorrectionsHandler))
+	mux.Post("/admin/corrections", adminMiddleware.ThenFunc(app.adminSetCorrectionHandler))
+	mux.Del("/admin/corrections/:id", adminMiddleware.ThenFunc(app.adminRemoveCorrectionHandler))
+	mux.Get("/admin/reports", adminMiddleware.ThenFunc(app.adminListReportsHandler))
+	mux.Post("/admin/reports/:id/promote", adminMiddleware.ThenFunc(app.adminPromoteReportHandler))
+	mux.Del("/admin/reports/:id", adminMiddleware.ThenFunc(app.adminRemoveReportHandler))
+	mux.Post("/parse", apiMiddleware.ThenFunc(app.parseHandler))
+	mux.Get("/parse/:id", apiMiddleware.ThenFunc(app.parseJobHandler))
+	mux.Post("/chat/lunch", http.HandlerFunc(app.slashCommandHandler))
+	mux.Get("/feed.atom", publicMiddleware.ThenFunc(app.atomFeedHandler))
+	mux.Get("/feed.rss", publicMiddleware.ThenFunc(app.rssFeedHandler))
+	mux.Get("/plan/:week", publicMiddleware.ThenFunc(app.weekPage))
+	mux.Get("/dish/:date/:col", publicMiddleware.ThenFunc(app.dishPage))
+	mux.Post("/dish/:date/missing", publicMiddleware.ThenFunc(app.reportMissingDishPage))
+	mux.Post("/dish/:date/:col", publicMiddleware.ThenFunc(app.reportDishPage))
+	mux.Post("/subscription/:token/unsubscribe", publicMiddleware.ThenFunc(app.unsubscribePage))
+	mux.Get("/subscription/:token", publicMiddleware.ThenFunc(app.subscriptionPage))
+	mux.Post("/subscription/:token", publicMiddleware.ThenFunc(app.updateSubscriptionPage))
+	mux.Get("/alerts", publicMiddleware.ThenFunc(app.alertsPage))
+	mux.Post("/alerts", publicMiddleware.ThenFunc(app.registerAlertPage))
+	mux.Get("/alert/:token", publicMiddleware.ThenFunc(app.alertPage))
+	mux.Post("/alert/:token/confirm", publicMiddleware.ThenFunc(app.confirmAlertPage))
+	mux.Post("/alert/:token/remove", publicMiddleware.ThenFunc(app.removeAlertPage))
+	mux.Get("/static/", staticHandler())
+	mux.Get("/", publicMiddleware.ThenFunc(app.todayPage))
 
 	return standardMiddleware.Then(mux)
 }
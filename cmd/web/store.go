@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+loadJSON, unmarshals the content of the file at path into v. A missing file is not an error and leaves v
+untouched
+*/
+func loadJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("loadJSON: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("loadJSON: failed to parse %v: %v", path, err)
+	}
+	return nil
+}
+
+/*
+saveJSON, atomically replaces the file at path with the json representation of v
+*/
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveJSON: %v", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("saveJSON: %v", err)
+	}
+	return nil
+}
+
+/*
+writeFileAtomic, replaces the file at path with data. Readers see either the old or the new content
+*/
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("writeFileAtomic: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writeFileAtomic: failed to write %v: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writeFileAtomic: failed to write %v: %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writeFileAtomic: %v", err)
+	}
+	return nil
+}
+
+/*
+appendJSONLine, appends the json representation of v as a single line to the file at path
+*/
+func appendJSONLine(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("appendJSONLine: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("appendJSONLine: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("appendJSONLine: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("appendJSONLine: failed to write %v: %v", path, err)
+	}
+	return nil
+}
+
+/*
+maxPlanHashes, is the number of iso weeks remembered by planHashes
+*/
+const maxPlanHashes = 52
+
+/*
+planRecord, is what planHashes remembers about the last plan of an iso week
+*/
+type planRecord struct {
+	Hash      string    `json:"hash"`
+	Published time.Time `json:"published"`
+	Updated   time.Time `json:"updated"`
+}
+
+/*
+planHashes, remembers the hash and timestamps of the last plan of every iso week handled by a notifier or the
+MenuCache. Plans found while the notifier was not subscribed, e.g. by the refresh on startup, are detected by
+comparing against it. The MenuCache uses it to keep WeekPlan.Published and WeekPlan.Updated across restarts
+*/
+type planHashes struct {
+	lock sync.Mutex
+	path string
+	//iso week, see formatISOWeek, to the last plan of the week
+	records map[string]*planRecord
+	//false if nothing was stored at path yet
+	loaded bool
+}
+
+/*
+loadPlanHashes, reads the records stored at path
+*/
+func loadPlanHashes(path string) (*planHashes, error) {
+	p := &planHashes{path: path}
+	if _, err := os.Stat(path); err == nil {
+		p.loaded = true
+	}
+	if err := loadJSON(path, &p.records); err != nil {
+		return nil, fmt.Errorf("loadPlanHashes: %v", err)
+	}
+	if p.records == nil {
+		p.records = make(map[string]*planRecord)
+	}
+	return p, nil
+}
+
+/*
+get, returns a copy of the record of the given iso week
+*/
+func (p *planHashes) get(year, week int) (planRecord, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rec, ok := p.records[formatISOWeek(year, week)]
+	if !ok {
+		return planRecord{}, false
+	}
+	return *rec, true
+}
+
+/*
+record, stores the hash and timestamps of plan and drops the oldest weeks beyond maxPlanHashes
+*/
+func (p *planHashes) record(plan *WeekPlan) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.records[formatISOWeek(plan.Year, plan.Week)] = &planRecord{Hash: plan.Hash, Published: plan.Published, Updated: plan.Updated}
+	if len(p.records) > maxPlanHashes {
+		weeks := make([]string, 0, len(p.records))
+		for w := range p.records {
+			weeks = append(weeks, w)
+		}
+		//the format sorts chronologically
+		sort.Strings(weeks)
+		for _, w := range weeks[:len(weeks)-maxPlanHashes] {
+			delete(p.records, w)
+		}
+	}
+	p.loaded = true
+	if err := saveJSON(p.path, p.records); err != nil {
+		return fmt.Errorf("record: %v", err)
+	}
+	return nil
+}
+
+/*
+missed, returns an update for every plan whose hash differs from the recorded one. All days of these plans count
+as changed, as the previous plan is unknown. If no hashes were stored yet, e.g. on the first start, the plans are
+recorded instead, so that existing plans are not notified again
+*/
+func (p *planHashes) missed(plans []*WeekPlan) ([]*PlanUpdate, error) {
+	p.lock.Lock()
+	loaded := p.loaded
+	p.lock.Unlock()
+	updates := make([]*PlanUpdate, 0)
+	for _, plan := range plans {
+		if !loaded {
+			if err := p.record(plan); err != nil {
+				return nil, fmt.Errorf("missed: %v", err)
+			}
+			continue
+		}
+		rec, known := p.get(plan.Year, plan.Week)
+		if rec.Hash == plan.Hash {
+			continue
+		}
+		u := &PlanUpdate{Plan: plan, Changed: known}
+		for _, day := range groupByDay(plan.Dishes) {
+			u.ChangedDays = append(u.ChangedDays, day.Date)
+		}
+		updates = append(updates, u)
+	}
+	return updates, nil
+}
+
+/*
+randomID, returns a random hex string with 2*n characters
+*/
+func randomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("randomID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
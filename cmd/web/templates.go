@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+/*
+uiFiles, contains the html templates and the static assets served under /static/
+*/
+//go:embed ui
+var uiFiles embed.FS
+
+/*
+dayView, groups the dishes served on a single day
+*/
+type dayView struct {
+	Date   time.Time
+	Dishes []*parser.Dish
+}
+
+/*
+templateData, is passed to all html templates. Pages only use the fields relevant to them
+*/
+type templateData struct {
+	Title string
+	Today time.Time
+	//set by todayPage
+	Day *dayView
+	//set by weekPage
+	Year, Week         int
+	Days               []*dayView
+	PrevWeek, NextWeek string
+	//set by dishPage
+	Dish *parser.Dish
+	//true if the tile of Dish is served by v1TileHandler
+	HasTile bool
+	//set by subscriptionPage
+	Subscriber *Subscriber
+	//set by alertPage
+	Alert *Alert
+	//show the form of alertsPage
+	AlertForm bool
+	//shown instead of content, e.g. if no menu is available
+	Message string
+}
+
+var templateFuncs = template.FuncMap{
+	"weekday": func(t time.Time) string {
+		return weekdayNames[t.Weekday()]
+	},
+	"date": func(t time.Time) string {
+		return t.Format("02.01.2006")
+	},
+	"isoDate": func(t time.Time) string {
+		return t.Format("2006-01-02")
+	},
+	"isoWeek": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return formatISOWeek(year, week)
+	},
+}
+
+/*
+newTemplateCache, parses each page in ui/templates/pages together with the shared base layout
+*/
+func newTemplateCache() (map[string]*template.Template, error) {
+	cache := make(map[string]*template.Template)
+	pages, err := fs.Glob(uiFiles, "ui/templates/pages/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("newTemplateCache: %v", err)
+	}
+	for _, page := range pages {
+		ts, err := template.New(path.Base(page)).Funcs(templateFuncs).ParseFS(uiFiles, "ui/templates/base.tmpl", page)
+		if err != nil {
+			return nil, fmt.Errorf("newTemplateCache: failed to parse %v: %v", page, err)
+		}
+		cache[path.Base(page)] = ts
+	}
+	return cache, nil
+}
+
+/*
+staticHandler, serves the embedded static assets
+*/
+func staticHandler() http.Handler {
+	static, err := fs.Sub(uiFiles, "ui/static")
+	if err != nil {
+		//only fails if "ui/static" is not a valid path, which we control
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
+
+/*
+render, executes the template page with data and writes the result with status to w
+*/
+func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
+	ts, ok := app.templateCache[page]
+	if !ok {
+		app.errorLog.Printf("Template %v does not exist\n", page)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data.Today = roundToDay(time.Now().In(time.Local))
+
+	//render to buffer first, so that template errors do not result in half written pages
+	buf := new(bytes.Buffer)
+	if err := ts.ExecuteTemplate(buf, "base", data); err != nil {
+		app.errorLog.Printf("Failed to execute template %v: %v\n", page, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		app.errorLog.Printf("Failed to write html response: %v\n", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+tracer, creates the spans of the web service. Spans are discarded until setupTracing installs an exporter
+*/
+var tracer = otel.Tracer("github.com/alyrot/uksh-menu-parser/cmd/web")
+
+/*
+tracingConfig, selects the span exporter
+*/
+type tracingConfig struct {
+	//"otlp" or "stdout", empty disables tracing
+	exporter string
+	//host:port of the OTLP/HTTP collector
+	endpoint string
+	//use http instead of https to talk to the collector
+	insecure bool
+}
+
+/*
+setupTracing, installs the global tracer provider and W3C trace context propagation. The returned function
+flushes pending spans and must be called before exiting
+*/
+func setupTracing(cfg *tracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.endpoint)}
+		if cfg.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("setupTracing: unknown exporter %q", cfg.exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setupTracing: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("uksh-menu-parser"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+/*
+endSpan, records err on span and ends it
+*/
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	//handler spans continue the trace of the client
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/menu/2020-11-16", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	instrument("/menu/:date", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := recorder.Ended()
+	if len(ended) != 1 || ended[0].Name() != "GET /menu/:date" || ended[0].SpanContext().TraceID().String() != traceID {
+		t.Fatalf("Unexpected handler spans %+v\n", ended)
+	}
+
+	//every download is a child of extractPDFsFromMenuSite
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	downloadMock, _, err := createDownloaderMock(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := extractPDFsFromMenuSite(context.Background(), downloadMock, MenuBaseURL); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	ended = recorder.Ended()[1:]
+	if len(ended) != 4 {
+		t.Fatalf("Expected 3 download spans and their parent got %v spans\n", len(ended))
+	}
+	parent := ended[len(ended)-1]
+	if parent.Name() != "extractPDFsFromMenuSite" {
+		t.Fatalf("Expected parent span extractPDFsFromMenuSite got %v\n", parent.Name())
+	}
+	for _, s := range ended[:3] {
+		if s.Name() != "download" || s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Unexpected span %v with parent %v\n", s.Name(), s.Parent().SpanID())
+		}
+	}
+}
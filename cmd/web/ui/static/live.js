@@ -0,0 +1,25 @@
+// Keeps the page of today's menu up to date, e.g. on screens that show it all day. The menu events of /v1/events
+// replace the content of the page without reloading it.
+(function () {
+    if (!window.EventSource || !window.fetch) {
+        return;
+    }
+    var first = true;
+    var events = new EventSource("/v1/events");
+    events.addEventListener("menu", function () {
+        // the page was rendered with the menu of the first event
+        if (first) {
+            first = false;
+            return;
+        }
+        fetch("/", {cache: "no-store"}).then(function (res) {
+            return res.ok ? res.text() : Promise.reject(res.status);
+        }).then(function (html) {
+            var page = new DOMParser().parseFromString(html, "text/html");
+            document.querySelector("main").innerHTML = page.querySelector("main").innerHTML;
+            document.title = page.title;
+        }).catch(function (err) {
+            console.error("failed to update menu", err);
+        });
+    });
+})();
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+unknownWebhookError is returned when a webhook id is not registered
+*/
+var unknownWebhookError = errors.New("webhook not found")
+
+/*
+maxDeliveries, is the maximal number of entries returned by WebhookNotifier.Deliveries
+*/
+const maxDeliveries = 1000
+
+const (
+	webhookEventPublished = "week.published"
+	webhookEventChanged   = "week.changed"
+)
+
+/*
+Webhook, is an url that receives a signed webhookPayload for every new or changed plan
+*/
+type Webhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	//Static webhooks are configured via environment and cannot be removed via the admin api
+	Static bool `json:"static"`
+}
+
+/*
+webhookPayload, is the json body sent to webhooks. Dishes use the /v1 representation
+*/
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	Year        int       `json:"year"`
+	Week        int       `json:"week"`
+	ChangedDays []string  `json:"changedDays"`
+	Link        string    `json:"link,omitempty"`
+	Dishes      []*v1Dish `json:"dishes"`
+}
+
+/*
+webhookDelivery, is a single delivery attempt as stored in the delivery log
+*/
+type webhookDelivery struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhookId"`
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	Attempt   int       `json:"attempt"`
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Success   bool      `json:"success"`
+}
+
+/*
+WebhookNotifier, delivers PlanUpdate values to the registered webhooks. Register Notify with MenuCache.Subscribe
+*/
+type WebhookNotifier struct {
+	lock  sync.Mutex
+	hooks []*Webhook
+	//registered via admin api, persisted to hooksPath
+	hooksPath string
+	//append only log of all delivery attempts, protected by logLock instead of lock
+	logPath string
+	logLock sync.Mutex
+	//hashes of the delivered plans, see NotifyMissed
+	notified *planHashes
+	//iso week, see formatISOWeek, to the hash of the last plan passed to Notify, protected by lock
+	latest map[string]string
+	//public url of the service used for links in the payload, may be empty
+	baseURL string
+	client  *http.Client
+	//maximal number of attempts per delivery
+	attempts int
+	//wait time before the first retry, doubled for every further retry
+	backoff  time.Duration
+	inFlight sync.WaitGroup
+	errorLog *log.Logger
+	infoLog  *log.Logger
+}
+
+/*
+NewWebhookNotifier, creates a WebhookNotifier that persists its state in dataDir. staticURLs are signed with
+staticSecret
+*/
+func NewWebhookNotifier(dataDir string, staticURLs []string, staticSecret, baseURL string, errorLog, infoLog *log.Logger) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		hooks:     make([]*Webhook, 0),
+		latest:    make(map[string]string),
+		hooksPath: filepath.Join(dataDir, "webhooks.json"),
+		logPath:   filepath.Join(dataDir, "webhook-deliveries.log"),
+		baseURL:   baseURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		attempts:  5,
+		backoff:   30 * time.Second,
+		errorLog:  errorLog,
+		infoLog:   infoLog,
+	}
+	stored := make([]*Webhook, 0)
+	if err := loadJSON(n.hooksPath, &stored); err != nil {
+		return nil, fmt.Errorf("NewWebhookNotifier: %v", err)
+	}
+	notified, err := loadPlanHashes(filepath.Join(dataDir, "webhook-notified.json"))
+	if err != nil {
+		return nil, fmt.Errorf("NewWebhookNotifier: %v", err)
+	}
+	n.notified = notified
+	n.hooks = append(n.hooks, stored...)
+	if err := n.SetStatic(staticURLs, staticSecret); err != nil {
+		return nil, fmt.Errorf("NewWebhookNotifier: %v", err)
+	}
+	return n, nil
+}
+
+/*
+SetStatic, replaces the webhooks from the configuration with staticURLs, signed with staticSecret. Webhooks
+registered via the admin api are kept
+*/
+func (n *WebhookNotifier) SetStatic(staticURLs []string, staticSecret string) error {
+	hooks, err := staticWebhooks(staticURLs, staticSecret)
+	if err != nil {
+		return fmt.Errorf("SetStatic: %v", err)
+	}
+	n.replaceStatic(hooks)
+	return nil
+}
+
+/*
+staticWebhooks, validates staticURLs and returns the webhooks for them, signed with staticSecret
+*/
+func staticWebhooks(staticURLs []string, staticSecret string) ([]*Webhook, error) {
+	if len(staticURLs) > 0 && staticSecret == "" {
+		return nil, fmt.Errorf("staticWebhooks: webhook urls configured without secret")
+	}
+	hooks := make([]*Webhook, 0, len(staticURLs))
+	for i, u := range staticURLs {
+		if err := validateWebhookURL(u); err != nil {
+			return nil, fmt.Errorf("staticWebhooks: %v", err)
+		}
+		hooks = append(hooks, &Webhook{ID: fmt.Sprintf("static-%d", i), URL: u, Secret: staticSecret, Static: true})
+	}
+	return hooks, nil
+}
+
+/*
+replaceStatic, replaces the static webhooks with hooks, see staticWebhooks
+*/
+func (n *WebhookNotifier) replaceStatic(hooks []*Webhook) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, h := range n.hooks {
+		if !h.Static {
+			hooks = append(hooks, h)
+		}
+	}
+	n.hooks = hooks
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an absolute http(s) url", badRequestError, raw)
+	}
+	return nil
+}
+
+/*
+persist, writes all non static webhooks to n.hooksPath. Caller must hold n.lock
+*/
+func (n *WebhookNotifier) persist() error {
+	stored := make([]*Webhook, 0, len(n.hooks))
+	for _, h := range n.hooks {
+		if !h.Static {
+			stored = append(stored, h)
+		}
+	}
+	return saveJSON(n.hooksPath, stored)
+}
+
+/*
+List, returns all registered webhooks
+*/
+func (n *WebhookNotifier) List() []*Webhook {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	res := make([]*Webhook, len(n.hooks))
+	copy(res, n.hooks)
+	return res
+}
+
+/*
+Add, registers a new webhook for rawURL. If secret is empty a random one is generated
+*/
+func (n *WebhookNotifier) Add(rawURL, secret string) (*Webhook, error) {
+	if err := validateWebhookURL(rawURL); err != nil {
+		return nil, fmt.Errorf("Add: %w", err)
+	}
+	id, err := randomID(8)
+	if err != nil {
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	if secret == "" {
+		if secret, err = randomID(32); err != nil {
+			return nil, fmt.Errorf("Add: %v", err)
+		}
+	}
+	h := &Webhook{ID: id, URL: rawURL, Secret: secret}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.hooks = append(n.hooks, h)
+	if err := n.persist(); err != nil {
+		n.hooks = n.hooks[:len(n.hooks)-1]
+		return nil, fmt.Errorf("Add: %v", err)
+	}
+	return h, nil
+}
+
+/*
+Remove, unregisters the webhook with id. Static webhooks cannot be removed
+*/
+func (n *WebhookNotifier) Remove(id string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i, h := range n.hooks {
+		if h.ID == id && !h.Static {
+			hooks := make([]*Webhook, 0, len(n.hooks)-1)
+			hooks = append(hooks, n.hooks[:i]...)
+			hooks = append(hooks, n.hooks[i+1:]...)
+			old := n.hooks
+			n.hooks = hooks
+			if err := n.persist(); err != nil {
+				n.hooks = old
+				return fmt.Errorf("Remove: %v", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Remove: %w: %v", unknownWebhookError, id)
+}
+
+/*
+Deliveries, returns the last limit entries of the delivery log, newest first. limit is capped at maxDeliveries.
+Only blocks the logging of deliveries, not the notifications
+*/
+func (n *WebhookNotifier) Deliveries(limit int) ([]*webhookDelivery, error) {
+	if limit < 1 {
+		return []*webhookDelivery{}, nil
+	}
+	if limit > maxDeliveries {
+		limit = maxDeliveries
+	}
+	n.logLock.Lock()
+	defer n.logLock.Unlock()
+	f, err := os.Open(n.logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*webhookDelivery{}, nil
+		}
+		return nil, fmt.Errorf("Deliveries: %v", err)
+	}
+	defer f.Close()
+
+	//ring buffer of the last limit entries, the log grows with every delivery
+	last := make([]*webhookDelivery, limit)
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		d := &webhookDelivery{}
+		if err := json.Unmarshal(scanner.Bytes(), d); err != nil {
+			return nil, fmt.Errorf("Deliveries: corrupt log entry: %v", err)
+		}
+		last[count%limit] = d
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Deliveries: %v", err)
+	}
+
+	res := make([]*webhookDelivery, 0, limit)
+	for i := count - 1; i >= 0 && len(res) < limit; i-- {
+		res = append(res, last[i%limit])
+	}
+	return res, nil
+}
+
+/*
+newWebhookPayload, builds the payload for u
+*/
+func (n *WebhookNotifier) newWebhookPayload(u *PlanUpdate) *webhookPayload {
+	p := &webhookPayload{
+		Event:       webhookEventPublished,
+		Year:        u.Plan.Year,
+		Week:        u.Plan.Week,
+		ChangedDays: make([]string, 0, len(u.ChangedDays)),
+		Dishes:      newV1Dishes(u.Plan.Dishes, u.Plan.dishInfo),
+	}
+	if u.Changed {
+		p.Event = webhookEventChanged
+	}
+	for _, day := range u.ChangedDays {
+		p.ChangedDays = append(p.ChangedDays, day.Format("2006-01-02"))
+	}
+	if n.baseURL != "" {
+		p.Link = weekURL(n.baseURL, u.Plan)
+	}
+	return p
+}
+
+/*
+Notify, is a PlanListener that asynchronously delivers u to all webhooks. Changed plans without changed days
+are not delivered. The hash of the plan is recorded for NotifyMissed once every delivery succeeded or ran out of
+attempts, so that a restart during the retries delivers the plan again
+*/
+func (n *WebhookNotifier) Notify(u *PlanUpdate) {
+	week := formatISOWeek(u.Plan.Year, u.Plan.Week)
+	n.lock.Lock()
+	n.latest[week] = u.Plan.Hash
+	hooks := make([]*Webhook, len(n.hooks))
+	copy(hooks, n.hooks)
+	n.lock.Unlock()
+
+	if u.Changed && len(u.ChangedDays) == 0 {
+		n.record(week, u.Plan)
+		return
+	}
+	payload := n.newWebhookPayload(u)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		n.errorLog.Printf("WebhookNotifier: failed to marshal payload: %v\n", err)
+		return
+	}
+	var deliveries sync.WaitGroup
+	for _, h := range hooks {
+		deliveries.Add(1)
+		go func(h *Webhook) {
+			defer deliveries.Done()
+			n.deliver(h, payload.Event, body)
+		}(h)
+	}
+	n.inFlight.Add(1)
+	go func() {
+		defer n.inFlight.Done()
+		deliveries.Wait()
+		n.record(week, u.Plan)
+	}()
+}
+
+/*
+record, stores the hash of plan for NotifyMissed, unless a newer plan of the week was passed to Notify meanwhile
+*/
+func (n *WebhookNotifier) record(week string, plan *WeekPlan) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.latest[week] != plan.Hash {
+		return
+	}
+	delete(n.latest, week)
+	if err := n.notified.record(plan); err != nil {
+		n.errorLog.Printf("WebhookNotifier: %v\n", err)
+	}
+}
+
+/*
+NotifyMissed, notifies about the plans that changed since the last notification, e.g. because they were found by
+the refresh on startup before Notify was subscribed. Pass MenuCache.CachedWeeks
+*/
+func (n *WebhookNotifier) NotifyMissed(plans []*WeekPlan) error {
+	updates, err := n.notified.missed(plans)
+	if err != nil {
+		return fmt.Errorf("NotifyMissed: %v", err)
+	}
+	for _, u := range updates {
+		n.Notify(u)
+	}
+	return nil
+}
+
+/*
+Wait, blocks until all pending deliveries are done
+*/
+func (n *WebhookNotifier) Wait() {
+	n.inFlight.Wait()
+}
+
+/*
+signPayload, returns the value of the X-Menu-Signature header for body
+*/
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+deliver, posts body to h and retries with exponential backoff until it succeeds or n.attempts is reached.
+Every attempt is appended to the delivery log
+*/
+func (n *WebhookNotifier) deliver(h *Webhook, event string, body []byte) {
+	deliveryID, err := randomID(8)
+	if err != nil {
+		n.errorLog.Printf("WebhookNotifier: %v\n", err)
+		return
+	}
+	wait := n.backoff
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		d := &webhookDelivery{ID: deliveryID, WebhookID: h.ID, URL: h.URL, Event: event, Attempt: attempt, Time: time.Now()}
+		d.Status, err = n.post(h, event, deliveryID, body)
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Success = true
+		}
+		n.logLock.Lock()
+		if err := appendJSONLine(n.logPath, d); err != nil {
+			n.errorLog.Printf("WebhookNotifier: failed to log delivery: %v\n", err)
+		}
+		n.logLock.Unlock()
+
+		if d.Success {
+			n.infoLog.Printf("Delivered %v to webhook %v\n", event, h.ID)
+			return
+		}
+		n.errorLog.Printf("Delivery %v of %v to webhook %v failed (attempt %v/%v): %v\n", deliveryID, event, h.ID, attempt, n.attempts, err)
+		if attempt < n.attempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+/*
+post, sends a single delivery attempt. Any status other than 2xx is an error
+*/
+func (n *WebhookNotifier) post(h *Webhook, event, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Menu-Event", event)
+	req.Header.Set("X-Menu-Delivery", deliveryID)
+	req.Header.Set("X-Menu-Signature", signPayload(h.Secret, body))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
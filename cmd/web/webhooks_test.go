@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyrot/uksh-menu-parser/pkg/parser"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	const secret = "top secret"
+
+	var lock sync.Mutex
+	var calls int
+	var payload webhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		//fail first attempt to test retries
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+		if got, exp := r.Header.Get("X-Menu-Signature"), signPayload(secret, body); got != exp {
+			t.Errorf("Expected signature %v got %v\n", exp, got)
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+	}))
+	defer srv.Close()
+
+	dataDir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	n, err := NewWebhookNotifier(dataDir, []string{srv.URL}, secret, "", log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = time.Millisecond
+
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	n.Notify(&PlanUpdate{
+		Plan:        &WeekPlan{Year: 2020, Week: 47, Dishes: []*parser.Dish{{Title: "Pasta-Pfanne", Date: monday}}},
+		ChangedDays: []time.Time{monday},
+	})
+	n.Wait()
+
+	if calls != 2 {
+		t.Errorf("Expected 2 calls got %v\n", calls)
+	}
+	if payload.Event != webhookEventPublished || payload.Week != 47 || len(payload.ChangedDays) != 1 || payload.ChangedDays[0] != "2020-11-16" {
+		t.Errorf("Unexpected payload %+v\n", payload)
+	}
+
+	deliveries, err := n.Deliveries(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(deliveries) != 2 || !deliveries[0].Success || deliveries[1].Success || deliveries[0].Attempt != 2 {
+		t.Errorf("Unexpected delivery log %+v\n", deliveries)
+	}
+
+	//changed plans without changed days are not delivered
+	n.Notify(&PlanUpdate{Plan: &WeekPlan{Year: 2020, Week: 47}, Changed: true})
+	n.Wait()
+	if calls != 2 {
+		t.Errorf("Expected no further calls got %v\n", calls-2)
+	}
+
+	//registered hooks survive a restart, static hooks cannot be removed
+	h, err := n.Add("https://example.org/hook", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if h.Secret == "" {
+		t.Errorf("Expected generated secret\n")
+	}
+	if _, err := n.Add("not a url", ""); !errors.Is(err, badRequestError) {
+		t.Errorf("Expected %v error but got %v\n", badRequestError, err)
+	}
+	if err := n.Remove("static-0"); !errors.Is(err, unknownWebhookError) {
+		t.Errorf("Expected %v error but got %v\n", unknownWebhookError, err)
+	}
+	restarted, err := NewWebhookNotifier(dataDir, nil, "", "", log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks := restarted.List(); len(hooks) != 1 || hooks[0].ID != h.ID {
+		t.Errorf("Expected persisted webhook %v got %v\n", h, hooks)
+	}
+	if err := restarted.Remove(h.ID); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
+
+func TestWebhookNotifyRecordsAfterDelivery(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	dataDir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	start := func() *WebhookNotifier {
+		n, err := NewWebhookNotifier(dataDir, []string{srv.URL}, "secret", "", log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.backoff = time.Millisecond
+		return n
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	w47 := &WeekPlan{Year: 2020, Week: 47, Hash: "a", Dishes: []*parser.Dish{{Title: "Pasta-Pfanne", Date: monday}}}
+	changed := *w47
+	changed.Hash = "b"
+	n := start()
+	if err := n.NotifyMissed([]*WeekPlan{w47}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	//a restart while the delivery is retried delivers the plan again
+	n.Notify(&PlanUpdate{Plan: &changed, Changed: true, ChangedDays: []time.Time{monday}})
+	restarted := start()
+	if updates, err := restarted.notified.missed([]*WeekPlan{&changed}); err != nil || len(updates) != 1 {
+		t.Errorf("Expected the pending plan to be missed got %v, %v\n", updates, err)
+	}
+
+	//failed deliveries are recorded once they ran out of attempts
+	close(release)
+	n.Wait()
+	restarted = start()
+	if rec, _ := restarted.notified.get(2020, 47); rec.Hash != "b" {
+		t.Errorf("Expected hash b to be recorded got %q\n", rec.Hash)
+	}
+
+	//an older plan finishing after a newer one does not overwrite its hash
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	newer := changed
+	newer.Hash = "c"
+	n.Notify(&PlanUpdate{Plan: &newer, Changed: true, ChangedDays: []time.Time{monday}})
+	n.record(formatISOWeek(2020, 47), &changed)
+	n.Wait()
+	if rec, _ := n.notified.get(2020, 47); rec.Hash != "c" {
+		t.Errorf("Expected hash c to be recorded got %q\n", rec.Hash)
+	}
+}
+
+func TestWebhookNotifyMissed(t *testing.T) {
+	var lock sync.Mutex
+	events := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, r.Header.Get("X-Menu-Event"))
+	}))
+	defer srv.Close()
+
+	dataDir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	start := func() *WebhookNotifier {
+		n, err := NewWebhookNotifier(dataDir, []string{srv.URL}, "secret", "", log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	monday := time.Date(2020, 11, 16, 0, 0, 0, 0, time.Local)
+	w47 := &WeekPlan{Year: 2020, Week: 47, Hash: "a", Dishes: []*parser.Dish{{Title: "Pasta-Pfanne", Date: monday}}}
+	w48 := &WeekPlan{Year: 2020, Week: 48, Hash: "b", Dishes: []*parser.Dish{{Title: "Rumpsteak", Date: monday.AddDate(0, 0, 7)}}}
+
+	//the plans cached on the first start are not notified
+	n := start()
+	if err := n.NotifyMissed([]*WeekPlan{w47}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	n.Wait()
+	if len(events) != 0 {
+		t.Errorf("Expected no delivery on first start got %v\n", events)
+	}
+
+	//plans found by the refresh on startup are notified once
+	changed := *w47
+	changed.Hash = "c"
+	n = start()
+	if err := n.NotifyMissed([]*WeekPlan{&changed, w48}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	n.Wait()
+	if len(events) != 2 || events[0] == events[1] {
+		t.Errorf("Expected a changed and a published event got %v\n", events)
+	}
+	n = start()
+	if err := n.NotifyMissed([]*WeekPlan{&changed, w48}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	n.Wait()
+	if len(events) != 2 {
+		t.Errorf("Expected no further deliveries got %v\n", events)
+	}
+
+	//the listing does not contain the secrets
+	cfg := defaultConfig()
+	cfg.AdminToken = "admin"
+	app := &application{
+		cfg:      cfg,
+		infoLog:  log.New(ioutil.Discard, "", 0),
+		errorLog: log.New(ioutil.Discard, "", 0),
+		webhooks: n,
+	}
+	r := httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), srv.URL) || strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("Unexpected listing %v %v\n", rec.Code, rec.Body.String())
+	}
+}
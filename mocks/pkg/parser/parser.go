@@ -5,6 +5,7 @@
 package mock_parser
 
 import (
+	context "context"
 	parser "github.com/alyrot/uksh-menu-parser/pkg/parser"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
@@ -47,3 +48,18 @@ func (mr *MockUKSHParserIMockRecorder) PDFToDishes(pdf interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PDFToDishes", reflect.TypeOf((*MockUKSHParserI)(nil).PDFToDishes), pdf)
 }
+
+// PDFToDishesContext mocks base method
+func (m *MockUKSHParserI) PDFToDishesContext(ctx context.Context, pdf []byte) ([]*parser.Dish, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PDFToDishesContext", ctx, pdf)
+	ret0, _ := ret[0].([]*parser.Dish)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PDFToDishesContext indicates an expected call of PDFToDishesContext
+func (mr *MockUKSHParserIMockRecorder) PDFToDishesContext(ctx, pdf interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PDFToDishesContext", reflect.TypeOf((*MockUKSHParserI)(nil).PDFToDishesContext), ctx, pdf)
+}
@@ -4,6 +4,8 @@ package parser
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
@@ -21,8 +23,79 @@ import (
 
 	"github.com/disintegration/imaging"
 	"github.com/snabb/isoweek"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+/*
+HeaderMissingError is returned if the pdf lacks the week number or the table header. This usually means
+that the layout of the plan changed
+*/
+var HeaderMissingError = errors.New("menu header missing")
+
+/*
+ParseTimeoutError is returned if one of the external programs does not finish within CommandTimeout
+*/
+var ParseTimeoutError = errors.New("parse timeout")
+
+/*
+CommandTimeout is the maximal runtime of a single call to tesseract, pdftoppm or pdftotext
+*/
+var CommandTimeout = 2 * time.Minute
+
+/*
+ObserveStage is called with the runtime of every parse stage. stage is one of "pdftotext",
+"pdftoppm", "tiles" (cutting the plan into tiles) or "tesseract" (once per tile). Nil disables the observation
+*/
+var ObserveStage func(stage string, duration time.Duration)
+
+type stageObserverKey struct{}
+
+/*
+WithStageObserver, returns a copy of ctx whose parse stages are additionally reported to observe. Allows to collect
+the timings of a single parse, ObserveStage sees the stages of all parses
+*/
+func WithStageObserver(ctx context.Context, observe func(stage string, duration time.Duration)) context.Context {
+	return context.WithValue(ctx, stageObserverKey{}, observe)
+}
+
+type tileObserverKey struct{}
+
+/*
+WithTileObserver, returns a copy of ctx for which observe is called with every parsed dish and the png of the cell
+of the plan its price was read from via OCR
+*/
+func WithTileObserver(ctx context.Context, observe func(d *Dish, tile []byte)) context.Context {
+	return context.WithValue(ctx, tileObserverKey{}, observe)
+}
+
+var tracer = otel.Tracer("github.com/alyrot/uksh-menu-parser/pkg/parser")
+
+/*
+startStage, starts a trace span for stage. The returned function ends the span, records err on it and reports
+the runtime to ObserveStage and the observer set by WithStageObserver
+*/
+func startStage(ctx context.Context, stage string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, stage, trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		duration := time.Since(start)
+		if ObserveStage != nil {
+			ObserveStage(stage, duration)
+		}
+		if observe, ok := ctx.Value(stageObserverKey{}).(func(string, time.Duration)); ok {
+			observe(stage, duration)
+		}
+	}
+}
+
 type Dish struct {
 	Title       string
 	Description string
@@ -36,6 +109,7 @@ type Dish struct {
 
 type UKSHParserI interface {
 	PDFToDishes(pdf []byte) ([]*Dish, error)
+	PDFToDishesContext(ctx context.Context, pdf []byte) ([]*Dish, error)
 }
 
 type UKSHParser struct{}
@@ -44,6 +118,36 @@ func (p *UKSHParser) PDFToDishes(pdf []byte) ([]*Dish, error) {
 	return PDFToDishes(pdf)
 }
 
+func (p *UKSHParser) PDFToDishesContext(ctx context.Context, pdf []byte) ([]*Dish, error) {
+	return PDFToDishesContext(ctx, pdf)
+}
+
+/*
+NewDish, returns an empty dish served on date in column col that has not been parsed from a plan, e.g. one added
+by a manual correction
+*/
+func NewDish(date time.Time, col int) *Dish {
+	row := int(date.Weekday()) - 1
+	if row < 0 {
+		row = 6
+	}
+	return &Dish{Date: date, colID: col, rowID: row}
+}
+
+/*
+ColID, returns the index of the menu column the dish was parsed from
+*/
+func (d *Dish) ColID() int {
+	return d.colID
+}
+
+/*
+RowID, returns the index of the menu row (the weekday) the dish was parsed from
+*/
+func (d *Dish) RowID() int {
+	return d.rowID
+}
+
 func (d Dish) String() string {
 	return fmt.Sprintf("Type: %v Title=%v Description=%v Price=%v Kcal=%v\n", d.Type, d.Title, d.Description, d.Price, d.Kcal)
 }
@@ -51,10 +155,12 @@ func (d Dish) String() string {
 /*
 execInOutCMD, executes the program denoted by value with the provided flags and in as stdin.
 If  returns the stdout of the program or an error. The stderr of the program is currently
-not passed along
+not passed along. The program is killed after CommandTimeout or when ctx is done
 */
-func execInOutCMD(name string, flags []string, in []byte) ([]byte, error) {
-	cmd := exec.Command(name, flags...)
+func execInOutCMD(ctx context.Context, name string, flags []string, in []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, flags...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("attaching stdin failed: %v", err)
@@ -92,6 +198,9 @@ func execInOutCMD(name string, flags []string, in []byte) ([]byte, error) {
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w: %v did not finish within %v", ParseTimeoutError, name, CommandTimeout)
+		}
 		return nil, fmt.Errorf("%v %s", err, errMsg)
 	}
 	if stdInErr != nil {
@@ -100,14 +209,45 @@ func execInOutCMD(name string, flags []string, in []byte) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-/**
+/*
+CheckTools, verifies that the external programs used for parsing are installed and working. The result maps
+"tesseract", "pdftotext" and "pdftoppm" to nil or the reason the program is not usable. tesseract additionally
+needs the "deu" language data
+*/
+func CheckTools() map[string]error {
+	run := func(name string, args ...string) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%v failed: %v", name, err)
+		}
+		return out, nil
+	}
+	res := make(map[string]error)
+	_, res["pdftotext"] = run("pdftotext", "-v")
+	_, res["pdftoppm"] = run("pdftoppm", "-v")
+	langs, err := run("tesseract", "--list-langs")
+	if err == nil && !regexp.MustCompile(`(?m)^deu\s*$`).Match(langs) {
+		err = fmt.Errorf("tesseract is missing the deu language data")
+	}
+	res["tesseract"] = err
+	return res
+}
+
+/*
+*
 OCRImage, passes the image contained in img to tesseract with "-l deu" and returns
 the text recognized by tesseract or an error
 */
 func OCRImage(img []byte) (string, error) {
-	out, err := execInOutCMD("tesseract", []string{"-l", "deu", "stdin", "stdout"}, img)
+	return ocrImage(context.Background(), img)
+}
+
+func ocrImage(ctx context.Context, img []byte) (string, error) {
+	out, err := execInOutCMD(ctx, "tesseract", []string{"-l", "deu", "stdin", "stdout"}, img)
 	if err != nil {
-		return "", fmt.Errorf("OCRImage: %v", err)
+		return "", fmt.Errorf("OCRImage: %w", err)
 	}
 	return string(out), nil
 }
@@ -116,14 +256,31 @@ func OCRImage(img []byte) (string, error) {
 PDFToPng, uses "pdftoppm" to convert pdf to an img
 */
 func PDFToPng(pdf []byte) ([]byte, error) {
-	out, err := execInOutCMD("pdftoppm", []string{"-png"}, pdf)
+	return pdfToPng(context.Background(), pdf)
+}
+
+/*
+PDFToPngContext, is PDFToPng with a trace span as child of the span in ctx. Canceling ctx kills pdftoppm
+*/
+func PDFToPngContext(ctx context.Context, pdf []byte) ([]byte, error) {
+	return pdfToPng(ctx, pdf)
+}
+
+func pdfToPng(ctx context.Context, pdf []byte) (out []byte, err error) {
+	ctx, end := startStage(ctx, "pdftoppm")
+	defer func() { end(err) }()
+	out, err = execInOutCMD(ctx, "pdftoppm", []string{"-png"}, pdf)
 	if err != nil {
-		return nil, fmt.Errorf("PDFToPng: %v", err)
+		return nil, fmt.Errorf("PDFToPng: %w", err)
 	}
 	return out, nil
 }
 
 func PDFToText(pdf []byte) ([]byte, error) {
+	return pdfToText(context.Background(), pdf)
+}
+
+func pdfToText(ctx context.Context, pdf []byte) ([]byte, error) {
 	outFile, err := ioutil.TempFile("", "*")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tmp output file: %v", err)
@@ -131,9 +288,11 @@ func PDFToText(pdf []byte) ([]byte, error) {
 	defer os.Remove(outFile.Name())
 	defer outFile.Close()
 	//outFilePath := filepath.Join(os.TempDir(),outFile.Name())
-	_, err = execInOutCMD("pdftotext", []string{"-layout", "-", outFile.Name()}, pdf)
+	stageCtx, end := startStage(ctx, "pdftotext")
+	_, err = execInOutCMD(stageCtx, "pdftotext", []string{"-layout", "-", outFile.Name()}, pdf)
+	end(err)
 	if err != nil {
-		return nil, fmt.Errorf("PDFToText: %v", err)
+		return nil, fmt.Errorf("PDFToText: %w", err)
 	}
 	out, err := ioutil.ReadAll(outFile)
 	if err != nil {
@@ -220,9 +379,13 @@ func parseDish(text string) (*Dish, error) {
 }
 
 func TileToDish(tile []byte) (*Dish, error) {
-	text, err := OCRImage(tile)
+	return tileToDish(context.Background(), tile)
+}
+
+func tileToDish(ctx context.Context, tile []byte) (*Dish, error) {
+	text, err := ocrImage(ctx, tile)
 	if err != nil {
-		return nil, fmt.Errorf("OCRImage: %v", err)
+		return nil, fmt.Errorf("OCRImage: %w", err)
 	}
 	return parseDish(text)
 }
@@ -333,7 +496,7 @@ func textToDishInYear(text []byte, year int) ([]*Dish, error) {
 		if strings.HasPrefix(strings.Trim(lines[i], " "), "Speiseplan Bistro") {
 			weekNrBytes := isoWeekRegexp.Find([]byte(lines[i]))
 			if weekNrBytes == nil {
-				return nil, fmt.Errorf("textToDish: parsing error: failed to locate week number")
+				return nil, fmt.Errorf("textToDish: %w: failed to locate week number", HeaderMissingError)
 			}
 			weekNr, err := strconv.ParseInt(string(weekNrBytes), 10, 32)
 			if err != nil {
@@ -343,7 +506,7 @@ func textToDishInYear(text []byte, year int) ([]*Dish, error) {
 		}
 	}
 	if anchorDate.Equal(time.Time{}) {
-		return nil, fmt.Errorf("textToDish: parsing error: failed to locate week number")
+		return nil, fmt.Errorf("textToDish: %w: failed to locate week number", HeaderMissingError)
 	}
 
 	//find Wochentag line or exit
@@ -354,7 +517,7 @@ func textToDishInYear(text []byte, year int) ([]*Dish, error) {
 		}
 	}
 	if lineWochentag == -1 {
-		return nil, fmt.Errorf("textToDish: parsing error: \"Wochentag\" line not found")
+		return nil, fmt.Errorf("textToDish: %w: \"Wochentag\" line not found", HeaderMissingError)
 	}
 
 	//get whitespace offset of the headers in the lines
@@ -364,7 +527,7 @@ func textToDishInYear(text []byte, year int) ([]*Dish, error) {
 	for i := range headers {
 		index := strings.Index(headerLine, headers[i])
 		if index == -1 {
-			return nil, fmt.Errorf("textToDish: parsing error: failed to locate %v in \"Wochentag\" line", headers[i])
+			return nil, fmt.Errorf("textToDish: %w: failed to locate %v in \"Wochentag\" line", HeaderMissingError, headers[i])
 		}
 		columns = append(columns, &column{offset: index, name: headers[i], id: i})
 	}
@@ -462,48 +625,160 @@ mergeTextAndOCR, contains the information with textToDish with the price informa
 the OCR analysis
 */
 func PDFToDishesInYear(pdf []byte, year int) ([]*Dish, error) {
+	return pdfToDishesInYear(context.Background(), pdf, year)
+}
+
+/*
+PDFToDishesContext, is PDFToDishes with trace spans for every stage as children of the span in ctx. Canceling ctx
+kills the external programs
+*/
+func PDFToDishesContext(ctx context.Context, pdf []byte) ([]*Dish, error) {
+	return pdfToDishesInYear(ctx, pdf, time.Now().In(time.Local).Year())
+}
+
+/*
+PDFToDishesInYearContext, is PDFToDishesInYear with trace spans for every stage as children of the span in ctx.
+Canceling ctx kills the external programs
+*/
+func PDFToDishesInYearContext(ctx context.Context, pdf []byte, year int) ([]*Dish, error) {
+	return pdfToDishesInYear(ctx, pdf, year)
+}
+
+func pdfToDishesInYear(ctx context.Context, pdf []byte, year int) (dishes []*Dish, err error) {
+	ctx, span := tracer.Start(ctx, "parser.PDFToDishes", trace.WithAttributes(attribute.Int("pdf.size", len(pdf))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 
-	text, err := PDFToText(pdf)
+	text, err := pdfToText(ctx, pdf)
 	if err != nil {
-		return nil, fmt.Errorf("mergeTextAndOCR: %v", err)
+		return nil, fmt.Errorf("mergeTextAndOCR: %w", err)
 	}
 
-	pdfAsPNG, err := PDFToPng(pdf)
+	pdfAsPNG, err := pdfToPng(ctx, pdf)
 	if err != nil {
-		return nil, fmt.Errorf("mergeTextAndOCR: %v", err)
+		return nil, fmt.Errorf("mergeTextAndOCR: %w", err)
 	}
 
+	_, end := startStage(ctx, "tiles")
 	tiles, err := UKSHMenuToTiles(pdfAsPNG)
+	end(err)
 	if err != nil {
-		return nil, fmt.Errorf("mergeTextAndOCR: %v", err)
+		return nil, fmt.Errorf("mergeTextAndOCR: %w", err)
 	}
 
 	rowColPrice := make([][]string, 7)
+	rowColTile := make([][][]byte, 7)
 	for i := range rowColPrice {
 		rowColPrice[i] = make([]string, 4)
+		rowColTile[i] = make([][]byte, 4)
 	}
 	buf := new(bytes.Buffer)
 	for i := range tiles {
 		if err := png.Encode(buf, tiles[i].img); err != nil {
 			return nil, fmt.Errorf("mergeTextAndOCR: conversion of tile (%v,%v) to []byte failed: %v", tiles[i].rowID, tiles[i].colID, err)
 		}
-		d, err := TileToDish(buf.Bytes())
+		//buf is reused for the next tile
+		tile := append([]byte(nil), buf.Bytes()...)
+		tileCtx, end := startStage(ctx, "tesseract", attribute.Int("tile.row", tiles[i].rowID), attribute.Int("tile.col", tiles[i].colID))
+		d, err := tileToDish(tileCtx, tile)
+		end(err)
 		buf.Reset()
 		if err != nil {
-			return nil, fmt.Errorf("mergeTextAndOCR: tile (%v,%v): %v", tiles[i].rowID, tiles[i].colID, err)
+			return nil, fmt.Errorf("mergeTextAndOCR: tile (%v,%v): %w", tiles[i].rowID, tiles[i].colID, err)
 		}
 		rowColPrice[tiles[i].rowID][tiles[i].colID] = d.Price
+		rowColTile[tiles[i].rowID][tiles[i].colID] = tile
 	}
 
-	dishes, err := textToDishInYear(text, year)
+	dishes, err = textToDishInYear(text, year)
 	if err != nil {
-		return nil, fmt.Errorf("mergeTextAndOCR: %v", err)
+		return nil, fmt.Errorf("mergeTextAndOCR: %w", err)
 	}
 
+	observe, _ := ctx.Value(tileObserverKey{}).(func(*Dish, []byte))
 	for i := range dishes {
 		dishes[i].Price = rowColPrice[dishes[i].rowID][dishes[i].colID]
+		if tile := rowColTile[dishes[i].rowID][dishes[i].colID]; observe != nil && tile != nil {
+			observe(dishes[i], tile)
+		}
 	}
 
 	return dishes, nil
 
 }
+
+/*
+ID, returns an identifier for d that is stable across parser runs, as long as the dish stays in the same
+column on the same date
+*/
+func (d *Dish) ID() string {
+	return fmt.Sprintf("%v-%d", d.Date.Format("2006-01-02"), d.colID)
+}
+
+/*
+Price, is the structured version of Dish.Price. Amounts are in euro cents
+*/
+type Price struct {
+	Employee int
+	Guest    int
+}
+
+/*
+Nutrition, is the structured version of Dish.Kcal
+*/
+type Nutrition struct {
+	Kcal int
+	KJ   int
+}
+
+/*
+ParsePrice, parses the employee and guest price from a price string like "€ 4,80 / € 6,00".
+As the price string is obtained via OCR, this fails more often than one would like
+*/
+func ParsePrice(s string) (*Price, error) {
+	amountRegexp := regexp.MustCompile(`([0-9]+)[,.]([0-9]{2})`)
+	amounts := amountRegexp.FindAllStringSubmatch(s, -1)
+	if len(amounts) != 2 {
+		return nil, fmt.Errorf("ParsePrice: expected 2 amounts in %q got %v", s, len(amounts))
+	}
+	cents := make([]int, 0, len(amounts))
+	for i := range amounts {
+		euros, err := strconv.Atoi(amounts[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("ParsePrice: failed to parse %v: %v", amounts[i][0], err)
+		}
+		fraction, err := strconv.Atoi(amounts[i][2])
+		if err != nil {
+			return nil, fmt.Errorf("ParsePrice: failed to parse %v: %v", amounts[i][0], err)
+		}
+		cents = append(cents, euros*100+fraction)
+	}
+	return &Price{Employee: cents[0], Guest: cents[1]}, nil
+}
+
+/*
+ParseNutrition, parses the energy values from a string like "kcal 528 / kJ 2212"
+*/
+func ParseNutrition(s string) (*Nutrition, error) {
+	kcalRegexp := regexp.MustCompile(`kcal\s*([0-9]+)`)
+	kjRegexp := regexp.MustCompile(`kJ\s*([0-9]+)`)
+	kcal := kcalRegexp.FindStringSubmatch(s)
+	kj := kjRegexp.FindStringSubmatch(s)
+	if kcal == nil || kj == nil {
+		return nil, fmt.Errorf("ParseNutrition: failed to locate kcal and kJ in %q", s)
+	}
+	n := &Nutrition{}
+	var err error
+	if n.Kcal, err = strconv.Atoi(kcal[1]); err != nil {
+		return nil, fmt.Errorf("ParseNutrition: failed to parse %v: %v", kcal[1], err)
+	}
+	if n.KJ, err = strconv.Atoi(kj[1]); err != nil {
+		return nil, fmt.Errorf("ParseNutrition: failed to parse %v: %v", kj[1], err)
+	}
+	return n, nil
+}
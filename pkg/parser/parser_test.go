@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -263,6 +264,24 @@ func TestTextToDish(t *testing.T) {
 
 }
 
+func TestTextToDishHeaderMissing(t *testing.T) {
+	t.Parallel()
+
+	path := "../../testFiles/planKW47.txt"
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to open test input %v: %v\n", path, err)
+	}
+
+	for _, header := range []string{"Speiseplan Bistro", "Wochentag", "Vegetarisch"} {
+		broken := strings.ReplaceAll(string(text), header, "")
+		_, err := textToDishInYear([]byte(broken), 2020)
+		if !errors.Is(err, HeaderMissingError) {
+			t.Errorf("Expected %v error without %q but got %v\n", HeaderMissingError, header, err)
+		}
+	}
+}
+
 func TestColumnifyLine(t *testing.T) {
 	t.Parallel()
 	type testCase struct {
@@ -319,3 +338,54 @@ func TestColumnifyLine(t *testing.T) {
 	}
 
 }
+
+func TestParsePrice(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name       string
+		in         string
+		exp        Price
+		shouldFail bool
+	}
+
+	tests := []*testCase{
+		{name: "Regular", in: "€ 4,80 / € 6,00", exp: Price{Employee: 480, Guest: 600}},
+		{name: "OCR noise", in: "€ 5,90 /€7,38 ", exp: Price{Employee: 590, Guest: 738}},
+		{name: "Single amount", in: "€ 4,80", shouldFail: true},
+		{name: "Empty", in: "", shouldFail: true},
+	}
+
+	for _, v := range tests {
+		func(tc *testCase) {
+			t.Run(tc.name, func(t *testing.T) {
+				got, err := ParsePrice(tc.in)
+				if err != nil {
+					if !tc.shouldFail {
+						t.Errorf("Unexpected error: %v\n", err)
+					}
+					return
+				}
+				if tc.shouldFail {
+					t.Errorf("Did not encounter expected error\n")
+				} else if *got != tc.exp {
+					t.Errorf("Expected %v got %v\n", tc.exp, *got)
+				}
+			})
+		}(v)
+	}
+}
+
+func TestParseNutrition(t *testing.T) {
+	t.Parallel()
+	got, err := ParseNutrition("kcal 528 / kJ 2212")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if exp := (Nutrition{Kcal: 528, KJ: 2212}); *got != exp {
+		t.Errorf("Expected %v got %v\n", exp, *got)
+	}
+
+	if _, err := ParseNutrition("kcal / kJ"); err == nil {
+		t.Errorf("Did not encounter expected error\n")
+	}
+}